@@ -0,0 +1,262 @@
+package balance
+
+import (
+	"context"
+	"fmt"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PolicyRoundRobin = "round_robin"
+	// the backends are picked in proportion to their weights
+	PolicyWeighted = "weighted"
+	// consistent hashing on the key set by WithHashKey, the weighted policy is used if the key is absent
+	PolicyHash = "hash"
+)
+
+const (
+	balancerPrefix = "grpcr_"
+	// virtual nodes of a backend with weight 1 on the hash ring
+	ringReplicas = 100
+)
+
+var (
+	// a backend is ejected after MaxFailures consecutive failed calls, 0 means never
+	MaxFailures = 5
+	// an ejected backend is not picked for EjectTime, unless all backends are ejected
+	EjectTime = 30 * time.Second
+)
+
+func init() {
+	for _, policy := range []string{PolicyRoundRobin, PolicyWeighted, PolicyHash} {
+		balancer.Register(&builder{policy: policy})
+	}
+}
+
+// ServiceConfig returns the service config selecting the policy, for grpc.WithDefaultServiceConfig
+func ServiceConfig(policy string) (string, error) {
+	switch policy {
+	case PolicyRoundRobin, PolicyWeighted, PolicyHash:
+		return fmt.Sprintf(`{"loadBalancingConfig":[{"%v%v":{}}]}`, balancerPrefix, policy), nil
+	}
+	return "", fmt.Errorf("unknown balance policy:%v", policy)
+}
+
+type hashKeyCtx struct{}
+
+// WithHashKey sets the key used by PolicyHash to pick the backend of the call
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtx{}, key)
+}
+
+type builder struct {
+	policy string
+}
+
+func (b *builder) Name() string {
+	return balancerPrefix + b.policy
+}
+
+// Build creates a balancer which only picks READY connections,
+// the failures of the calls are tracked by each ClientConn separately.
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{policy: b.policy, ejector: newEjector()}
+	return base.NewBalancerBuilder(b.Name(), pb, base.Config{}).Build(cc, opts)
+}
+
+type pickerBuilder struct {
+	policy  string
+	ejector *ejector
+}
+
+type backend struct {
+	sc     balancer.SubConn
+	addr   string
+	weight int
+}
+
+type ringNode struct {
+	hash  uint64
+	index int
+}
+
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) <= 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{ejector: pb.ejector}
+	for sc, scInfo := range info.ReadySCs {
+		b := &backend{sc: sc, addr: scInfo.Address.Addr, weight: 1}
+		if pb.policy != PolicyRoundRobin {
+			b.weight = getWeight(scInfo.Address)
+		}
+		p.backends = append(p.backends, b)
+	}
+	sort.Slice(p.backends, func(i, j int) bool {
+		return p.backends[i].addr < p.backends[j].addr
+	})
+
+	// interleaved, so that a heavy backend doesn't take a long run of calls
+	maxWeight := 0
+	for _, b := range p.backends {
+		maxWeight = max(maxWeight, b.weight)
+	}
+	for round := 0; round < maxWeight; round++ {
+		for i, b := range p.backends {
+			if b.weight > round {
+				p.schedule = append(p.schedule, i)
+			}
+		}
+	}
+
+	if pb.policy == PolicyHash {
+		for i, b := range p.backends {
+			for j := 0; j < b.weight*ringReplicas; j++ {
+				p.ring = append(p.ring, ringNode{hash: Hash64(b.addr + "-" + strconv.Itoa(j)), index: i})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool {
+			return p.ring[i].hash < p.ring[j].hash
+		})
+	}
+	return p
+}
+
+type picker struct {
+	backends []*backend
+	// indexes of the backends, each appears as many times as its weight
+	schedule []int
+	next     atomic.Uint32
+	// sorted by hash, only for PolicyHash
+	ring    []ringNode
+	ejector *ejector
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	index := -1
+	if key, ok := info.Ctx.Value(hashKeyCtx{}).(string); ok && len(p.ring) > 0 {
+		index = p.pickHash(key)
+	}
+	if index < 0 {
+		index = p.pickNext()
+	}
+
+	b := p.backends[index]
+	return balancer.PickResult{
+		SubConn: b.sc,
+		Done: func(di balancer.DoneInfo) {
+			p.ejector.done(b.addr, di.Err)
+		},
+	}, nil
+}
+
+func (p *picker) pickNext() int {
+	now := time.Now()
+	n := uint32(len(p.schedule))
+	start := p.next.Add(1)
+	for i := uint32(0); i < n; i++ {
+		index := p.schedule[(start+i)%n]
+		if !p.ejector.ejected(p.backends[index].addr, now) {
+			return index
+		}
+	}
+	// all backends are ejected
+	return p.schedule[start%n]
+}
+
+// pickHash returns the first backend clockwise from the key on the ring which is not ejected
+func (p *picker) pickHash(key string) int {
+	now := time.Now()
+	h := Hash64(key)
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	for i := 0; i < len(p.ring); i++ {
+		node := p.ring[(start+i)%len(p.ring)]
+		if !p.ejector.ejected(p.backends[node.index].addr, now) {
+			return node.index
+		}
+	}
+	return p.ring[start%len(p.ring)].index
+}
+
+// Hash64 hashes the keys of PolicyHash, the result is evenly distributed even for similar keys
+func Hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s)) // nolint: errcheck
+	// fnv barely changes the high bits for keys differing in the last bytes, e.g. user-1 and user-2,
+	// mix them with the finalizer of murmur3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ejector counts the consecutive failed calls of each backend
+type ejector struct {
+	mu           sync.Mutex
+	failures     map[string]int
+	ejectedUntil map[string]time.Time
+}
+
+func newEjector() *ejector {
+	return &ejector{failures: make(map[string]int), ejectedUntil: make(map[string]time.Time)}
+}
+
+func (e *ejector) done(addr string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !isFailure(err) {
+		delete(e.failures, addr)
+		return
+	}
+	e.failures[addr]++
+	if MaxFailures > 0 && e.failures[addr] >= MaxFailures {
+		slog.Warn("balance, eject %v for %v after %v consecutive failures, error:%v",
+			addr, EjectTime, e.failures[addr], err)
+		e.ejectedUntil[addr] = time.Now().Add(EjectTime)
+		delete(e.failures, addr)
+	}
+}
+
+func (e *ejector) ejected(addr string, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	until, ok := e.ejectedUntil[addr]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(e.ejectedUntil, addr)
+		return false
+	}
+	return true
+}
+
+// isFailure tells whether the error indicates a problem of the backend rather than of the request
+func isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package balance
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"testing"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+}
+
+func buildPicker(policy string, weights map[string]int) (balancer.Picker, map[balancer.SubConn]string) {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	names := make(map[balancer.SubConn]string)
+	for addr, weight := range weights {
+		sc := &fakeSubConn{}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: resolver.Address{
+			Addr:               addr,
+			BalancerAttributes: attributes.New(weightKey{}, weight),
+		}}
+		names[sc] = addr
+	}
+	pb := &pickerBuilder{policy: policy, ejector: newEjector()}
+	return pb.Build(info), names
+}
+
+func pickN(t *testing.T, p balancer.Picker, names map[balancer.SubConn]string, ctx context.Context,
+	n int, err error) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		result, e := p.Pick(balancer.PickInfo{Ctx: ctx})
+		assert.Nil(t, e)
+		counts[names[result.SubConn]]++
+		result.Done(balancer.DoneInfo{Err: err})
+	}
+	return counts
+}
+
+func TestPickerWeighted(t *testing.T) {
+	weights := map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 3}
+	p, names := buildPicker(PolicyWeighted, weights)
+	counts := pickN(t, p, names, context.Background(), 40, nil)
+	assert.Equal(t, map[string]int{"10.0.0.1:80": 10, "10.0.0.2:80": 30}, counts)
+
+	p, names = buildPicker(PolicyRoundRobin, weights)
+	counts = pickN(t, p, names, context.Background(), 40, nil)
+	assert.Equal(t, map[string]int{"10.0.0.1:80": 20, "10.0.0.2:80": 20}, counts)
+}
+
+func TestPickerEject(t *testing.T) {
+	p, names := buildPicker(PolicyRoundRobin, map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 1})
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	// each backend fails MaxFailures times, the second one recovers first
+	for i := 0; i < MaxFailures*2; i++ {
+		result, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		assert.Nil(t, err)
+		if names[result.SubConn] == "10.0.0.2:80" {
+			result.Done(balancer.DoneInfo{Err: unavailable})
+		} else {
+			// application errors don't count
+			result.Done(balancer.DoneInfo{Err: status.Error(codes.NotFound, "not found")})
+		}
+	}
+	counts := pickN(t, p, names, context.Background(), 10, nil)
+	assert.Equal(t, map[string]int{"10.0.0.1:80": 10}, counts)
+}
+
+func TestPickerHash(t *testing.T) {
+	weights := map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 1, "10.0.0.3:80": 1}
+	p, names := buildPicker(PolicyHash, weights)
+
+	backends := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ctx := WithHashKey(context.Background(), "user-"+strconv.Itoa(i))
+		counts := pickN(t, p, names, ctx, 5, nil)
+		// always the same backend for a key
+		assert.Len(t, counts, 1)
+		for addr := range counts {
+			backends[addr] = true
+		}
+	}
+	assert.Len(t, backends, 3)
+
+	// the same key goes to the same backend after the picker is rebuilt
+	ctx := WithHashKey(context.Background(), "user-1")
+	first := pickN(t, p, names, ctx, 1, nil)
+	p, names = buildPicker(PolicyHash, weights)
+	assert.Equal(t, first, pickN(t, p, names, ctx, 1, nil))
+}
+
+func TestHashKey(t *testing.T) {
+	msg := &protocol.Message{Request: &protocol.MsgItem{
+		Headers: map[string]string{"x-user-id": "u1"},
+		Body:    `{"user":{"userId":"u2","age":30},"items":[{"id":"1"}]}`,
+	}}
+	cases := map[string]string{
+		"header:X-User-Id":   "u1",
+		"field:user.user_id": "u2",
+		"field:user.age":     "30",
+		"field:items.0.id":   "1",
+		"field:items.1.id":   "",
+		"field:user":         "",
+	}
+	for s, expected := range cases {
+		key, err := ParseHashKey(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, key.Value(msg), s)
+	}
+
+	_, err := ParseHashKey("cookie:a")
+	assert.NotNil(t, err)
+}
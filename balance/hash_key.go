@@ -0,0 +1,98 @@
+package balance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/vearne/grpcreplay/protocol"
+	"strconv"
+	"strings"
+)
+
+// HashKey extracts the key of PolicyHash from a message, so that the requests of a user go to the same backend
+//
+//	header:x-user-id    the value of a request header
+//	field:user.id       the value of a field of the request body, the path is separated by "."
+type HashKey struct {
+	Header string
+	// path of the field
+	Field []string
+}
+
+// ParseHashKey parses strings like "header:x-user-id" or "field:user.id"
+func ParseHashKey(s string) (*HashKey, error) {
+	kind, name, ok := strings.Cut(s, ":")
+	if !ok || len(name) <= 0 {
+		return nil, fmt.Errorf("invalid hash key:%v, expect header:<name> or field:<path>", s)
+	}
+	switch kind {
+	case "header":
+		return &HashKey{Header: strings.ToLower(name)}, nil
+	case "field":
+		return &HashKey{Field: strings.Split(name, ".")}, nil
+	}
+	return nil, fmt.Errorf("invalid hash key:%v, expect header:<name> or field:<path>", s)
+}
+
+// Value returns the key of the message, empty if it is absent
+func (k *HashKey) Value(msg *protocol.Message) string {
+	if msg.Request == nil {
+		return ""
+	}
+	if len(k.Header) > 0 {
+		return msg.Request.Headers[k.Header]
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(msg.Request.Body)))
+	decoder.UseNumber()
+	var v interface{}
+	if decoder.Decode(&v) != nil {
+		return ""
+	}
+	for _, name := range k.Field {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			// the body is encoded with the JSON names of the fields, e.g. userId for user_id
+			value, ok := x[name]
+			if !ok {
+				value = x[jsonName(name)]
+			}
+			v = value
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(x) {
+				return ""
+			}
+			v = x[i]
+		default:
+			return ""
+		}
+	}
+
+	switch x := v.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	case string:
+		return x
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// jsonName converts the proto name of a field to its JSON name, user_id -> userId
+func jsonName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,191 @@
+package balance
+
+import (
+	"context"
+	"fmt"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheme of the targets returned by Register
+const Scheme = "grpcr-lb"
+
+var (
+	// the host names of the backends are resolved again after DNSRefreshInterval
+	DNSRefreshInterval = 30 * time.Second
+)
+
+const (
+	// grpc asks for re-resolution whenever a connection fails, it is not done more often than this
+	minResolveInterval = time.Second
+	lookupTimeout      = 10 * time.Second
+)
+
+// Backend is a server among which the requests are balanced.
+// If Addr contains a host name, each address it resolves to is a backend with the same weight.
+type Backend struct {
+	Addr   string
+	Weight int
+}
+
+var (
+	groups   sync.Map
+	groupSeq atomic.Int64
+)
+
+func init() {
+	resolver.Register(&resolverBuilder{})
+}
+
+// Register returns a target for grpc.NewClient, which resolves to the backends
+func Register(backends []Backend) string {
+	name := "group-" + strconv.FormatInt(groupSeq.Add(1), 10)
+	groups.Store(name, backends)
+	return Scheme + ":///" + name
+}
+
+type weightKey struct{}
+
+func getWeight(addr resolver.Address) int {
+	if w, ok := addr.BalancerAttributes.Value(weightKey{}).(int); ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+type resolverBuilder struct{}
+
+func (b *resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn,
+	_ resolver.BuildOptions) (resolver.Resolver, error) {
+	v, ok := groups.Load(target.Endpoint())
+	if !ok {
+		return nil, fmt.Errorf("unknown backend group:%v", target.Endpoint())
+	}
+	r := &dnsResolver{
+		backends:   v.([]Backend),
+		cc:         cc,
+		resolved:   make(map[string][]string),
+		resolveNow: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (b *resolverBuilder) Scheme() string {
+	return Scheme
+}
+
+// dnsResolver resolves the host names of the backends periodically and when grpc asks for it
+type dnsResolver struct {
+	backends []Backend
+	cc       resolver.ClientConn
+	// host -> the ips it resolved to last time, used if the lookup fails
+	resolved   map[string][]string
+	last       string
+	resolveNow chan struct{}
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+func (r *dnsResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *dnsResolver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+	})
+}
+
+func (r *dnsResolver) watch() {
+	ticker := time.NewTicker(DNSRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		r.resolve()
+
+		select {
+		case <-ticker.C:
+		case <-r.resolveNow:
+			select {
+			case <-time.After(minResolveInterval):
+			case <-r.closeChan:
+				return
+			}
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+func (r *dnsResolver) resolve() {
+	addrs := make([]resolver.Address, 0, len(r.backends))
+	seen := make(map[string]bool)
+	for _, backend := range r.backends {
+		host, port, err := net.SplitHostPort(backend.Addr)
+		if err != nil {
+			slog.Error("balance, invalid backend %v, error:%v", backend.Addr, err)
+			continue
+		}
+		for _, ip := range r.lookup(host) {
+			addr := net.JoinHostPort(ip, port)
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			addrs = append(addrs, resolver.Address{
+				Addr: addr,
+				// the certificate of the server is verified against the host name
+				ServerName:         host,
+				BalancerAttributes: attributes.New(weightKey{}, backend.Weight),
+			})
+		}
+	}
+
+	if len(addrs) <= 0 {
+		r.cc.ReportError(fmt.Errorf("no backend is resolved"))
+		return
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.Addr+"/"+strconv.Itoa(getWeight(addr)))
+	}
+	sort.Strings(list)
+	if current := strings.Join(list, ","); current != r.last {
+		slog.Info("balance, backends:%v", current)
+		r.last = current
+	}
+	err := r.cc.UpdateState(resolver.State{Addresses: addrs})
+	if err != nil {
+		slog.Warn("balance, UpdateState:%v", err)
+	}
+}
+
+func (r *dnsResolver) lookup(host string) []string {
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		slog.Warn("balance, lookup %v, use the last result:%v, error:%v", host, r.resolved[host], err)
+		return r.resolved[host]
+	}
+	sort.Strings(ips)
+	r.resolved[host] = ips
+	return ips
+}
@@ -0,0 +1,60 @@
+package balance
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func startHealthServer(t *testing.T, calls *atomic.Int32) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		calls.Add(1)
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis) // nolint: errcheck
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func TestBalancedClient(t *testing.T) {
+	var calls1, calls2 atomic.Int32
+	addr1 := startHealthServer(t, &calls1)
+	addr2 := startHealthServer(t, &calls2)
+
+	serviceConfig, err := ServiceConfig(PolicyWeighted)
+	assert.Nil(t, err)
+	target := Register([]Backend{{Addr: addr1, Weight: 1}, {Addr: addr2, Weight: 3}})
+	cc, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(serviceConfig))
+	assert.Nil(t, err)
+	defer cc.Close()
+
+	client := healthpb.NewHealthClient(cc)
+	// until both backends are ready
+	for i := 0; i < 1000 && (calls1.Load() == 0 || calls2.Load() == 0); i++ {
+		_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.Nil(t, err)
+	}
+	calls1.Store(0)
+	calls2.Store(0)
+
+	for i := 0; i < 100; i++ {
+		_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(25), calls1.Load())
+	assert.Equal(t, int32(75), calls2.Load())
+
+	_, err = ServiceConfig("random")
+	assert.NotNil(t, err)
+}
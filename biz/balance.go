@@ -0,0 +1,50 @@
+package biz
+
+import (
+	"github.com/vearne/grpcreplay/balance"
+	"github.com/vearne/grpcreplay/config"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc"
+)
+
+// newBalancedTarget creates a target balancing the calls among settings.OutputGRPCLBTargets.
+// The options of grpcs:// are taken from the first backend, the backends can't mix the schemes.
+func newBalancedTarget(settings *config.AppSettings) *Target {
+	var first *Target
+	backends := make([]balance.Backend, 0, len(settings.OutputGRPCLBTargets))
+	for _, item := range settings.OutputGRPCLBTargets {
+		target, err := parseTarget(item)
+		if err != nil {
+			slog.Fatal("OutputGRPCLBTarget addr error:%v", err)
+		}
+		if first == nil {
+			first = target
+		} else if target.Scheme != first.Scheme {
+			slog.Fatal("OutputGRPCLBTarget, %v and %v use different schemes", settings.OutputGRPCLBTargets[0], item)
+		}
+		backends = append(backends, balance.Backend{Addr: target.Addr, Weight: target.Weight})
+	}
+
+	serviceConfig, err := balance.ServiceConfig(settings.OutputGRPCLBPolicy)
+	if err != nil {
+		slog.Fatal("OutputGRPCLBPolicy error:%v", err)
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithDefaultServiceConfig(serviceConfig)}, first.DialOptions...)
+	return &Target{Scheme: first.Scheme, Addr: balance.Register(backends), DialOptions: dialOptions,
+		PerRPCCredentials: first.PerRPCCredentials, Weight: 1}
+}
+
+// newHashKey returns the key of the hash policy, nil for the other policies
+func newHashKey(settings *config.AppSettings) *balance.HashKey {
+	if settings.OutputGRPCLBPolicy != balance.PolicyHash {
+		return nil
+	}
+	if len(settings.OutputGRPCLBHashKey) <= 0 {
+		slog.Fatal("--output-grpc-lb-hash-key is required by the hash policy")
+	}
+	key, err := balance.ParseHashKey(settings.OutputGRPCLBHashKey)
+	if err != nil {
+		slog.Fatal("OutputGRPCLBHashKey error:%v", err)
+	}
+	return key
+}
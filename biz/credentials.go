@@ -0,0 +1,151 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the token is renewed before it expires
+	tokenExpiryDelta = 30 * time.Second
+	// used if the token endpoint doesn't return expires_in
+	defaultTokenLifetime = time.Hour
+	tokenRequestTimeout  = 10 * time.Second
+)
+
+// tokenFileCredentials sends the bearer token in a file, e.g. a projected service account token.
+// The file is read again when it changes.
+type tokenFileCredentials struct {
+	path    string
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+func newTokenFileCredentials(path string) *tokenFileCredentials {
+	return &tokenFileCredentials{path: path}
+}
+
+func (c *tokenFileCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("token-file:%w", err)
+	}
+	if !info.ModTime().Equal(c.modTime) {
+		data, err := os.ReadFile(c.path)
+		if err != nil {
+			return nil, fmt.Errorf("token-file:%w", err)
+		}
+		c.token = strings.TrimSpace(string(data))
+		c.modTime = info.ModTime()
+	}
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c *tokenFileCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// oauthCredentials obtains a bearer token with the OAuth 2.0 client credentials grant(RFC 6749 4.4),
+// the token is cached until it is about to expire
+type oauthCredentials struct {
+	tokenURL   string
+	clientID   string
+	secretFile string
+	scope      string
+	client     *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newOAuthCredentials(tokenURL, clientID, secretFile, scope string) *oauthCredentials {
+	return &oauthCredentials{
+		tokenURL:   tokenURL,
+		clientID:   clientID,
+		secretFile: secretFile,
+		scope:      scope,
+		client:     &http.Client{Timeout: tokenRequestTimeout},
+	}
+}
+
+func (c *oauthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.token) <= 0 || time.Until(c.expiry) < tokenExpiryDelta {
+		if err := c.fetchToken(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c *oauthCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+func (c *oauthCredentials) fetchToken(ctx context.Context) error {
+	secret, err := os.ReadFile(c.secretFile)
+	if err != nil {
+		return fmt.Errorf("oauth-client-secret-file:%w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(c.scope) > 0 {
+		form.Set("scope", c.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// RFC 6749 2.3.1, the client id and secret are form-urlencoded before basic auth
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(strings.TrimSpace(string(secret))))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oauth token request:%w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("oauth token response:%w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth token request, status:%v, body:%s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("oauth token response:%w", err)
+	}
+	if len(result.AccessToken) <= 0 {
+		return fmt.Errorf("oauth token response without access_token")
+	}
+
+	lifetime := defaultTokenLifetime
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	c.token = result.AccessToken
+	c.expiry = time.Now().Add(lifetime)
+	return nil
+}
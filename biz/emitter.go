@@ -3,10 +3,15 @@
 package biz
 
 import (
+	"fmt"
 	"io"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/vearne/grpcreplay/filter"
+	"github.com/vearne/grpcreplay/metrics"
+	"github.com/vearne/grpcreplay/protocol"
 	slog "github.com/vearne/simplelog"
 )
 
@@ -18,15 +23,18 @@ type Emitter struct {
 	plugins     *InOutPlugins // 输入和输出插件的集合
 	filterChain filter.Filter // 过滤器链，用于过滤不需要的消息
 	limiter     Limiter       // 限流器，用于控制消息处理速率
+	transformer Transformer   // 转换器，用于在发送前修改消息，可以为 nil
 }
 
 // NewEmitter 创建并初始化一个新的 Emitter 对象。
-// 参数 f 是过滤器链，用于过滤消息；参数 lim 是限流器，用于控制处理速率。
+// 参数 f 是过滤器链，用于过滤消息；参数 lim 是限流器，用于控制处理速率；
+// 参数 t 是转换器，用于修改消息。
 // 返回初始化完成的 Emitter 实例。
-func NewEmitter(f filter.Filter, lim Limiter) *Emitter {
+func NewEmitter(f filter.Filter, lim Limiter, t Transformer) *Emitter {
 	var e Emitter
 	e.filterChain = f
 	e.limiter = lim
+	e.transformer = t
 	return &e
 }
 
@@ -67,28 +75,74 @@ func (e *Emitter) Close() {
 // 1. 从源读取器读取消息
 // 2. 通过过滤器链过滤消息
 // 3. 应用限流策略
-// 4. 将消息写入所有目标写入器
+// 4. 通过转换器修改消息
+// 5. 将消息写入所有目标写入器
 // 该方法会持续运行直到源读取器关闭或发生不可恢复的错误。
 func (e *Emitter) CopyMulty(src PluginReader, writers ...PluginWriter) error {
+	names := make([]string, len(writers))
+	for i, dst := range writers {
+		names[i] = outputName(dst)
+	}
 	for {
 		msg, err := src.Read()
 		if err != nil {
 			slog.Error("src.Read:%v", err)
 			continue
 		}
+		metrics.MessagesRead.Inc()
 		msg, ok := e.filterChain.Filter(msg)
 		if !ok {
+			metrics.MessagesDropped.WithLabelValues(metrics.ReasonFilter).Inc()
+			continue
+		}
+
+		// 回放结果不是新的请求，不受限流和转换的影响
+		if msg.Replay != nil {
+			e.write(msg, writers, names)
 			continue
 		}
 
 		if e.limiter != nil && !e.limiter.Allow() {
+			metrics.MessagesDropped.WithLabelValues(metrics.ReasonLimiter).Inc()
 			continue
 		}
 
-		for _, dst := range writers {
-			if err = dst.Write(msg); err != nil {
-				slog.Error("dst.Write:%v", err)
+		if e.transformer != nil {
+			if err = e.transformer.Transform(msg); err != nil {
+				slog.Error("transformer.Transform, method:%v, error:%v", msg.Method, err)
+				metrics.MessagesDropped.WithLabelValues(metrics.ReasonTransformer).Inc()
+				continue
 			}
 		}
+
+		e.write(msg, writers, names)
+	}
+}
+
+// write 将消息写入所有目标写入器，names 是写入器在监控指标中的名称
+func (e *Emitter) write(msg *protocol.Message, writers []PluginWriter, names []string) {
+	for i, dst := range writers {
+		start := time.Now()
+		err := dst.Write(msg)
+		metrics.ObserveWrite(names[i], start, err)
+		if err != nil {
+			slog.Error("dst.Write:%v", err)
+		}
+	}
+}
+
+// outputName 返回输出插件在监控指标中的名称，
+// 优先使用插件的 String 方法，否则使用类型名，例如 StdOutput
+func outputName(w PluginWriter) string {
+	if sw, ok := w.(*sampledWriter); ok {
+		return outputName(sw.PluginWriter)
+	}
+	if s, ok := w.(fmt.Stringer); ok {
+		return s.String()
+	}
+	t := reflect.TypeOf(w)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
 	}
+	return t.Name()
 }
@@ -0,0 +1,18 @@
+package biz
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/plugin"
+	"testing"
+)
+
+func TestOutputName(t *testing.T) {
+	w := &countWriter{}
+	assert.Equal(t, "countWriter", outputName(w))
+	assert.Equal(t, "countWriter", outputName(&sampledWriter{PluginWriter: w}))
+
+	// the outputs of the same type are told apart
+	dir := t.TempDir()
+	o := plugin.NewFileDirOutput("simple", dir, &plugin.FileDirOutputConfig{})
+	assert.Equal(t, "FileDirOutput:"+dir, outputName(o))
+}
@@ -0,0 +1,26 @@
+package biz
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/protocol"
+	"testing"
+)
+
+func TestFilterChainReflection(t *testing.T) {
+	c, err := NewFilterChain(&config.AppSettings{})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		method   string
+		expected bool
+	}{
+		{"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", false},
+		{"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", false},
+		{"/SearchService/CurrentTime", true},
+	}
+	for _, item := range cases {
+		_, ok := c.Filter(&protocol.Message{Method: item.method})
+		assert.Equal(t, item.expected, ok, item.method)
+	}
+}
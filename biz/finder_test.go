@@ -0,0 +1,69 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/config"
+	pb "github.com/vearne/grpcreplay/example/service_proto"
+	"github.com/vearne/grpcreplay/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	"net"
+	"testing"
+)
+
+type searchServer struct {
+	pb.UnimplementedSearchServiceServer
+}
+
+func (s *searchServer) Search(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	return &pb.SearchResponse{StaffID: 100, StaffName: in.StaffName}, nil
+}
+
+// unknownFinder is a local finder without the method, e.g. a capture taken before the method existed
+type unknownFinder struct{}
+
+func (unknownFinder) Get(svcAndMethod string) (*http2.MethodInputOutput, error) {
+	return nil, errors.New("method not found")
+}
+
+func (unknownFinder) GetDescriptorSource() grpcurl.DescriptorSource {
+	return nil
+}
+
+func (unknownFinder) Refresh(svcAndMethod string) bool {
+	return false
+}
+
+func TestNewFinderFallsBackToReflection(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	pb.RegisterSearchServiceServer(server, &searchServer{})
+	reflection.Register(server)
+	go server.Serve(lis) // nolint: errcheck
+	defer server.Stop()
+
+	finder := newFinder(&config.AppSettings{}, unknownFinder{}, &Target{Addr: lis.Addr().String()})
+	m, err := finder.Get("/SearchService/Search")
+	assert.Nil(t, err)
+	assert.Equal(t, "SearchRequest", string(m.InType.ProtoReflect().Descriptor().Name()))
+}
+
+func TestNewFinderCombinesProtoFilesWithReflection(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	pb.RegisterSearchServiceServer(server, &searchServer{})
+	reflection.Register(server)
+	go server.Serve(lis) // nolint: errcheck
+	defer server.Stop()
+
+	// common.proto doesn't define any service
+	local := http2.NewFilePBFinder([]string{"testdata/common.proto"}, "../http2")
+	finder := newFinder(&config.AppSettings{}, local, &Target{Addr: lis.Addr().String()})
+	_, err = finder.Get("/SearchService/Search")
+	assert.Nil(t, err)
+}
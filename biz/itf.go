@@ -28,6 +28,13 @@ type PluginWriter interface {
 	Write(msg *protocol.Message) (err error)
 }
 
+// Reporter 定义了生成报告的插件的接口。
+// 程序退出前会调用所有实现该接口的插件，输出最终的报告。
+type Reporter interface {
+	// WriteReport 输出到目前为止的报告。
+	WriteReport() error
+}
+
 // Limiter 定义了限流器的接口。
 // 实现该接口的组件可以控制消息处理的速率，
 // 防止系统过载或资源耗尽。
@@ -37,3 +44,12 @@ type Limiter interface {
 	// 该方法通常基于时间窗口、令牌桶等算法实现限流。
 	Allow() bool
 }
+
+// Transformer 定义了消息转换器的接口。
+// 实现该接口的组件在消息通过过滤器之后、写入输出插件之前修改消息，
+// 如替换请求体中的字段。
+type Transformer interface {
+	// Transform 原地修改消息。
+	// 返回错误表示消息无法转换，该消息不会被发送到输出插件。
+	Transform(msg *protocol.Message) error
+}
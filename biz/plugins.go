@@ -4,12 +4,13 @@ import (
 	"fmt"
 	psnet "github.com/shirou/gopsutil/v3/net"
 	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/diff"
 	"github.com/vearne/grpcreplay/http2"
 	"github.com/vearne/grpcreplay/plugin"
 	"github.com/vearne/grpcreplay/util"
 	slog "github.com/vearne/simplelog"
 	"net"
-	"net/url"
+	"path/filepath"
 	"reflect"
 	"strings"
 )
@@ -19,17 +20,20 @@ type InOutPlugins struct {
 	Inputs  []PluginReader
 	Outputs []PluginWriter
 	All     []interface{}
+	// finds the descriptors of the messages, nil if no protobuf definition is available
+	Finder http2.PBFinder
 }
 
 // NewPlugins specify and initialize all available plugins
 func NewPlugins(settings *config.AppSettings) *InOutPlugins {
-	//  get proto from files
-	var finder http2.PBFinder
-	if len(settings.ProtoFiles) > 0 {
-		finder = http2.NewFilePBFinder(settings.ProtoFiles)
-	}
+	//  get proto from files, it is shared by all inputs and outputs
+	localFinder := newLocalFinder(settings)
 
 	plugins := new(InOutPlugins)
+	// finders of the inputs, used to save the descriptors of the captured methods
+	inputFinders := make([]http2.PBFinder, 0)
+	// finders of the outputs
+	outputFinders := make([]http2.PBFinder, 0)
 
 	for _, item := range settings.InputRAW {
 		slog.Debug("options: %q", item)
@@ -38,20 +42,35 @@ func NewPlugins(settings *config.AppSettings) *InOutPlugins {
 			slog.Warn("net.SplitHostPort:%v", err)
 			continue
 		}
-		if finder == nil {
-			finder = http2.NewReflectionPBFinder(findOneServerAddr(host, port))
-		}
+		finder := newFinder(settings, localFinder, &Target{Addr: findOneServerAddr(host, port)})
+		inputFinders = append(inputFinders, finder)
 		plugins.registerPlugin(plugin.NewRAWInput, item, settings.RecordResponse, finder)
 	}
 
+	var profile *plugin.LoadProfile
+	if len(settings.InputFileLoadProfile) > 0 {
+		var err error
+		profile, err = plugin.LoadProfileFromFile(settings.InputFileLoadProfile)
+		if err != nil {
+			slog.Fatal("--input-file-load-profile:%v", err)
+		}
+		if settings.InputFileClosedLoop {
+			slog.Fatal("--input-file-load-profile can't be used with --input-file-closed-loop")
+		}
+	}
 	for _, path := range settings.InputFileDir {
 		err := plugin.IsValidDir(path)
 		if err != nil {
 			slog.Fatal("%v", err)
 		}
 		slog.Debug("NewFileDirInput, path:%v", path)
-		plugins.registerPlugin(plugin.NewFileDirInput, settings.Codec, path,
-			settings.InputFileReadDepth, settings.InputFileReplaySpeed)
+		plugins.registerPlugin(plugin.NewFileDirInput, settings.Codec, path, &plugin.FileDirInputConfig{
+			ReadDepth:   settings.InputFileReadDepth,
+			ReplaySpeed: settings.InputFileReplaySpeed,
+			Profile:     profile,
+			ClosedLoop:  settings.InputFileClosedLoop,
+			Ordered:     len(settings.OutputGRPCOrderBy) > 0,
+		})
 	}
 
 	if len(settings.InputRocketMQNameServer) > 0 {
@@ -60,25 +79,110 @@ func NewPlugins(settings *config.AppSettings) *InOutPlugins {
 			settings.InputRocketMQAccessKey, settings.InputRocketMQSecretKey)
 	}
 	// ----------output----------
+	sampleRules := newSampleRules(settings)
 	if settings.OutputStdout {
 		slog.Debug("NewStdOutput")
 		plugins.registerPlugin(plugin.NewStdOutput, settings.Codec)
+		plugins.sampleLastOutput(sampleRules, "output-stdout", "")
 	}
 
 	if len(settings.OutputRocketMQNameServer) > 0 {
 		plugins.registerPlugin(plugin.NewRocketMQOutput, settings.OutputRocketMQNameServer,
 			settings.OutputRocketMQTopic, settings.OutputRocketMQAccessKey, settings.OutputRocketMQSecretKey)
+		plugins.sampleLastOutput(sampleRules, "output-rocketmq-topic", settings.OutputRocketMQTopic)
 	}
 
+	var comparator *plugin.ResponseComparator
+	if len(settings.OutputGRPCDiffFile) > 0 {
+		comparator = plugin.NewResponseComparator(settings.OutputGRPCDiffFile, newDiffOptions(settings))
+	}
+	var rewriter *plugin.HeaderRewriter
+	if len(settings.OutputGRPCHeaderRules) > 0 {
+		rewriter = plugin.NewHeaderRewriter(settings.OutputGRPCHeaderRules)
+	}
+	routes := newRoutes(settings, localFinder)
+	deadline := newDeadline(settings)
+	retry := newRetryPolicy(settings)
+	breaker := newBreakerConfig(settings)
+	deadLetter := newDeadLetter(settings, combineFinders(localFinder, inputFinders))
+	partition := newPartition(settings)
+	report := newReplayReport(settings)
+	outputTargets := make([]*Target, 0, len(settings.OutputGRPC)+1)
 	for _, item := range settings.OutputGRPC {
-		addr, err := extractAddr(item)
+		target, err := parseTarget(item)
 		if err != nil {
 			slog.Fatal("OutputGRPC addr error:%v", err)
 		}
-		if finder == nil {
-			finder = http2.NewReflectionPBFinder(addr)
+		outputTargets = append(outputTargets, target)
+	}
+	var balancedTarget *Target
+	if len(settings.OutputGRPCLBTargets) > 0 {
+		balancedTarget = newBalancedTarget(settings)
+		outputTargets = append(outputTargets, balancedTarget)
+	}
+	for i, target := range outputTargets {
+		finder := newFinder(settings, localFinder, target)
+		outputFinders = append(outputFinders, finder)
+		cf := &plugin.GRPCOutputConfig{
+			WorkerNum:         settings.OutputGRPCWorkerNumber,
+			DialOptions:       target.DialOptions,
+			PerRPCCredentials: target.PerRPCCredentials,
+			Comparator:        comparator,
+			HeaderRewriter:    rewriter,
+			Routes:            routes,
+			// the first output sends the messages to the targets of the routes
+			SkipRouteTargets: i > 0,
+			Results:          settings.OutputGRPCResults,
+			Deadline:         deadline,
+			Retry:            retry,
+			Breaker:          breaker,
+			Partition:        partition,
+			Native:           settings.OutputGRPCNative,
+			Concurrency:      newConcurrencyConfig(settings, i, len(outputTargets)),
 		}
-		plugins.registerPlugin(plugin.NewGRPCOutput, addr, settings.OutputGRPCWorkerNumber, finder)
+		if report != nil {
+			cf.Report = report
+		}
+		if deadLetter != nil {
+			cf.DeadLetter = deadLetter
+		}
+		if target == balancedTarget {
+			cf.HashKey = newHashKey(settings)
+		}
+		plugins.registerPlugin(plugin.NewGRPCOutput, target.Addr, finder, cf)
+		if settings.OutputGRPCResults {
+			output := plugins.All[len(plugins.All)-1].(*plugin.GRPCOutput)
+			plugins.Inputs = append(plugins.Inputs, output.Results())
+		}
+		var sampled *sampledWriter
+		if target == balancedTarget {
+			sampled = plugins.sampleLastOutput(sampleRules, "output-grpc-lb-target", "")
+		} else {
+			sampled = plugins.sampleLastOutput(sampleRules, "output-grpc", settings.OutputGRPC[i])
+		}
+		if sampled != nil && i == 0 && len(routes) > 0 {
+			// the targets of the routes are not sampled with the first output
+			sampled.unsampled = routedToTarget(routes)
+		}
+	}
+	if comparator != nil {
+		// closed after the outputs using it
+		plugins.All = append(plugins.All, comparator)
+	}
+	if deadLetter != nil {
+		plugins.All = append(plugins.All, deadLetter)
+	}
+	if report != nil && len(outputTargets) > 0 {
+		plugins.All = append(plugins.All, report)
+	}
+
+	if len(settings.OutputShadowPrimary) > 0 {
+		cf := newShadowOutputConfig(settings, localFinder)
+		cf.HeaderRewriter = rewriter
+		cf.Deadline = deadline
+		outputFinders = append(outputFinders, cf.Primary.Finder)
+		plugins.registerPlugin(plugin.NewShadowOutput, cf)
+		plugins.sampleLastOutput(sampleRules, "output-shadow-primary", settings.OutputShadowPrimary)
 	}
 
 	for _, path := range settings.OutputFileDir {
@@ -90,22 +194,202 @@ func NewPlugins(settings *config.AppSettings) *InOutPlugins {
 			MaxSize:    settings.OutputFileMaxSize,
 			MaxBackups: settings.OutputFileMaxBackups,
 			MaxAge:     settings.OutputFileMaxAge,
+			Finder:     combineFinders(localFinder, inputFinders),
 		}
 		plugins.registerPlugin(plugin.NewFileDirOutput, settings.Codec, path, cf)
+		plugins.sampleLastOutput(sampleRules, "output-file-directory", path)
 	}
 
+	checkSampleRules(sampleRules)
+
+	// the messages come from the inputs, the descriptors of the outputs are tried if those of the inputs fail
+	plugins.Finder = combineFinders(localFinder, append(inputFinders, outputFinders...))
 	return plugins
 }
 
-func extractAddr(outputGrpc string) (string, error) {
-	if !strings.Contains(outputGrpc, "grpc://") {
-		outputGrpc = "grpc://" + outputGrpc
+func newDiffOptions(settings *config.AppSettings) *diff.Options {
+	return &diff.Options{
+		IgnorePaths:    settings.DiffIgnorePaths,
+		FloatTolerance: settings.DiffFloatTolerance,
+		UnorderedPaths: settings.DiffUnorderedPaths,
+	}
+}
+
+func newDeadline(settings *config.AppSettings) *plugin.Deadline {
+	if settings.OutputGRPCTimeoutScale <= 0 {
+		slog.Fatal("--output-grpc-timeout-scale must be positive, got:%v", settings.OutputGRPCTimeoutScale)
+	}
+	return &plugin.Deadline{
+		Scale:   settings.OutputGRPCTimeoutScale,
+		Default: settings.OutputGRPCDefaultTimeout,
+		Max:     settings.OutputGRPCMaxTimeout,
+	}
+}
+
+func newReplayReport(settings *config.AppSettings) *plugin.ReplayReport {
+	if len(settings.OutputGRPCReport) <= 0 && settings.OutputGRPCReportInterval <= 0 {
+		return nil
+	}
+	return plugin.NewReplayReport(&plugin.ReportConfig{
+		File:     settings.OutputGRPCReport,
+		Interval: settings.OutputGRPCReportInterval,
+	})
+}
+
+// WriteReports writes the reports of the plugins, it is called before exit
+func (p *InOutPlugins) WriteReports() {
+	for _, item := range p.All {
+		if r, ok := item.(Reporter); ok {
+			if err := r.WriteReport(); err != nil {
+				slog.Error("WriteReport:%v", err)
+			}
+		}
+	}
+}
+
+// newConcurrencyConfig creates the config of the i-th of n gRPC outputs,
+// each of them writes its own capacity report.
+func newConcurrencyConfig(settings *config.AppSettings, i, n int) *plugin.ConcurrencyConfig {
+	if settings.OutputGRPCConcurrency <= 0 {
+		return nil
+	}
+	if settings.OutputGRPCConcurrencyInterval <= 0 {
+		slog.Fatal("--output-grpc-concurrency-interval must be positive")
 	}
-	u, err := url.Parse(outputGrpc)
+	return &plugin.ConcurrencyConfig{
+		Concurrency:  settings.OutputGRPCConcurrency,
+		Max:          settings.OutputGRPCMaxConcurrency,
+		Step:         settings.OutputGRPCConcurrencyStep,
+		Interval:     settings.OutputGRPCConcurrencyInterval,
+		MaxErrorRate: settings.OutputGRPCMaxErrorRate,
+		MaxLatency:   settings.OutputGRPCMaxLatency,
+		ReportFile:   capacityReportFile(settings.OutputGRPCCapacityReport, i, n),
+	}
+}
+
+// capacityReportFile returns the report file of the i-th of n outputs,
+// e.g. capacity-0.json, capacity-1.json if there are several outputs.
+func capacityReportFile(path string, i, n int) string {
+	if len(path) <= 0 || n <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(path, ext), i, ext)
+}
+
+func newPartition(settings *config.AppSettings) *plugin.Partition {
+	if len(settings.OutputGRPCOrderBy) <= 0 {
+		return nil
+	}
+	partition, err := plugin.ParsePartition(settings.OutputGRPCOrderBy)
 	if err != nil {
-		return "nil", err
+		slog.Fatal("--output-grpc-order-by:%v", err)
+	}
+	return partition
+}
+
+func newShadowOutputConfig(settings *config.AppSettings, localFinder http2.PBFinder) *plugin.ShadowOutputConfig {
+	if len(settings.OutputShadowCandidate) <= 0 {
+		slog.Fatal("--output-shadow-candidate is required by --output-shadow-primary")
+	}
+	newTarget := func(item string) *plugin.OutputTarget {
+		target, err := parseTarget(item)
+		if err != nil {
+			slog.Fatal("OutputShadow addr error:%v", err)
+		}
+		return &plugin.OutputTarget{
+			Addr:              target.Addr,
+			Finder:            newFinder(settings, localFinder, target),
+			DialOptions:       target.DialOptions,
+			PerRPCCredentials: target.PerRPCCredentials,
+		}
+	}
+
+	cf := &plugin.ShadowOutputConfig{
+		WorkerNum:         settings.OutputGRPCWorkerNumber,
+		Primary:           newTarget(settings.OutputShadowPrimary),
+		Candidate:         newTarget(settings.OutputShadowCandidate),
+		DiffOptions:       newDiffOptions(settings),
+		ReportFile:        settings.OutputShadowReport,
+		RelativeThreshold: settings.OutputShadowRelativeThreshold,
+		AbsoluteThreshold: settings.OutputShadowAbsoluteThreshold,
+	}
+	if len(settings.OutputShadowSecondary) > 0 {
+		cf.Secondary = newTarget(settings.OutputShadowSecondary)
+	}
+	return cf
+}
+
+// newLocalFinder creates a PBFinder from proto files, descriptor sets
+// and the descriptors saved in the input capture directories, nil if none is available
+func newLocalFinder(settings *config.AppSettings) http2.PBFinder {
+	finders := make([]http2.PBFinder, 0, 2+len(settings.InputFileDir))
+	if len(settings.ProtoFiles) > 0 {
+		finders = append(finders, http2.NewFilePBFinder(settings.ProtoFiles, settings.ProtoImportPaths...))
+	}
+	if len(settings.ProtoSetFiles) > 0 {
+		finders = append(finders, http2.NewProtoSetPBFinder(settings.ProtoSetFiles))
+	}
+	for _, path := range settings.InputFileDir {
+		if plugin.IsValidDir(path) != nil {
+			continue
+		}
+		if finder := plugin.NewCaptureDescFinder(path); finder != nil {
+			finders = append(finders, finder)
+		}
+	}
+
+	switch len(finders) {
+	case 0:
+		return nil
+	case 1:
+		return finders[0]
+	default:
+		return http2.NewCompositePBFinder(finders...)
+	}
+}
+
+// newFinder creates the PBFinder owned by one input or output.
+// Local proto files, descriptor sets and the descriptors saved with the captures take precedence over
+// the reflection service of target, which is still used for the methods they don't know,
+// the reflection services specified by --reflection-addr are tried afterwards.
+func newFinder(settings *config.AppSettings, localFinder http2.PBFinder, target *Target) http2.PBFinder {
+	finders := make([]http2.PBFinder, 0, len(settings.ReflectionAddr)+2)
+	if localFinder != nil {
+		finders = append(finders, localFinder)
+	}
+	finders = append(finders, http2.NewReflectionPBFinder(target.Addr, target.DialOptions...))
+	for _, item := range settings.ReflectionAddr {
+		reflectionTarget, err := parseTarget(item)
+		if err != nil {
+			slog.Fatal("reflection addr error:%v", err)
+		}
+		// the reflection service of target has been added
+		if reflectionTarget.Addr == target.Addr {
+			continue
+		}
+		finders = append(finders, http2.NewReflectionPBFinder(reflectionTarget.Addr, reflectionTarget.DialOptions...))
+	}
+
+	if len(finders) == 1 {
+		return finders[0]
+	}
+	return http2.NewCompositePBFinder(finders...)
+}
+
+// combineFinders creates a PBFinder trying the finders of several plugins in order,
+// e.g. the one used to save the descriptors next to the captured messages.
+// The finders already contain localFinder, which is returned if there are none.
+func combineFinders(localFinder http2.PBFinder, finders []http2.PBFinder) http2.PBFinder {
+	switch len(finders) {
+	case 0:
+		// may be nil, e.g. the descriptors are not saved
+		return localFinder
+	case 1:
+		return finders[0]
+	default:
+		return http2.NewCompositePBFinder(finders...)
 	}
-	return u.Host, nil
 }
 
 // Automatically detects type of plugin and initialize it
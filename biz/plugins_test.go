@@ -2,7 +2,7 @@ package biz
 
 import "testing"
 
-func TestExtractAddr(t *testing.T) {
+func TestParseTargetAddr(t *testing.T) {
 	cases := []struct {
 		serverAddr, expected string
 	}{
@@ -10,18 +10,38 @@ func TestExtractAddr(t *testing.T) {
 		{"grpc://192.168.1.100:8080/abc", "192.168.1.100:8080"},
 		{"192.168.1.100:8080", "192.168.1.100:8080"},
 		{"192.168.1.100:8080/abc", "192.168.1.100:8080"},
+		{"grpcs://example.com:443", "example.com:443"},
+		{"grpcs://example.com:443?server-name=abc&insecure-skip-verify=true", "example.com:443"},
 	}
 
 	for _, c := range cases {
-		ans, err := extractAddr(c.serverAddr)
+		target, err := parseTarget(c.serverAddr)
 		if err != nil {
-			t.Fatalf("expectd:%v, got:%v, error:%v",
-				c.expected, ans, err)
+			t.Fatalf("expectd:%v, error:%v", c.expected, err)
 		}
-		if ans != c.expected {
+		if target.Addr != c.expected {
 			t.Fatalf("expectd:%v, got:%v",
-				c.expected, ans)
+				c.expected, target.Addr)
 		}
 
 	}
 }
+
+func TestCapacityReportFile(t *testing.T) {
+	cases := []struct {
+		path     string
+		i, n     int
+		expected string
+	}{
+		{"", 1, 2, ""},
+		{"./capacity.json", 0, 1, "./capacity.json"},
+		{"./capacity.json", 0, 2, "./capacity-0.json"},
+		{"./capacity.json", 1, 2, "./capacity-1.json"},
+		{"/tmp/capacity", 1, 2, "/tmp/capacity-1"},
+	}
+	for _, c := range cases {
+		if got := capacityReportFile(c.path, c.i, c.n); got != c.expected {
+			t.Errorf("capacityReportFile(%v, %v, %v) = %v, expected %v", c.path, c.i, c.n, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package biz
+
+import (
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/plugin"
+	slog "github.com/vearne/simplelog"
+	"strings"
+)
+
+func newRetryPolicy(settings *config.AppSettings) *plugin.RetryPolicy {
+	if settings.OutputGRPCRetryMaxAttempts < 2 {
+		return nil
+	}
+	codes, err := plugin.ParseCodes(strings.Split(settings.OutputGRPCRetryCodes, ","))
+	if err != nil {
+		slog.Fatal("--output-grpc-retry-codes:%v", err)
+	}
+	return &plugin.RetryPolicy{
+		MaxAttempts:    settings.OutputGRPCRetryMaxAttempts,
+		Codes:          codes,
+		InitialBackoff: settings.OutputGRPCRetryBackoff,
+		MaxBackoff:     settings.OutputGRPCRetryMaxBackoff,
+	}
+}
+
+func newBreakerConfig(settings *config.AppSettings) *plugin.BreakerConfig {
+	if settings.OutputGRPCBreakerThreshold <= 0 {
+		return nil
+	}
+	return &plugin.BreakerConfig{
+		Threshold: settings.OutputGRPCBreakerThreshold,
+		OpenTime:  settings.OutputGRPCBreakerOpenTime,
+	}
+}
+
+// newDeadLetter returns the output of the messages which fail to be replayed, in the same format as the captures
+func newDeadLetter(settings *config.AppSettings, finder http2.PBFinder) *plugin.FileDirOutput {
+	if len(settings.OutputGRPCDeadLetter) <= 0 {
+		return nil
+	}
+	err := plugin.IsValidDir(settings.OutputGRPCDeadLetter)
+	if err != nil {
+		slog.Fatal("--output-grpc-dead-letter:%v", err)
+	}
+	return plugin.NewFileDirOutput(settings.Codec, settings.OutputGRPCDeadLetter, &plugin.FileDirOutputConfig{
+		MaxSize:    settings.OutputFileMaxSize,
+		MaxBackups: settings.OutputFileMaxBackups,
+		MaxAge:     settings.OutputFileMaxAge,
+		Finder:     finder,
+	})
+}
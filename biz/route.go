@@ -0,0 +1,75 @@
+package biz
+
+import (
+	"encoding/json"
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/plugin"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"os"
+	"regexp"
+)
+
+// routeRule is the json form of plugin.Route
+type routeRule struct {
+	// regular expression of the methods
+	Method string `json:"method"`
+	// (optional) the new method, may reference the groups of Method
+	Rewrite string `json:"rewrite"`
+	// (optional) e.g. "grpc://127.0.0.1:35002", the address of --output-grpc if empty
+	Target string `json:"target"`
+}
+
+// newRoutes loads the routing table of the gRPC outputs from settings.OutputGRPCRoutes
+func newRoutes(settings *config.AppSettings, localFinder http2.PBFinder) []*plugin.Route {
+	if len(settings.OutputGRPCRoutes) <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(settings.OutputGRPCRoutes)
+	if err != nil {
+		slog.Fatal("read routes, error:%v", err)
+	}
+	var rules []routeRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		slog.Fatal("parse routes %v, error:%v", settings.OutputGRPCRoutes, err)
+	}
+
+	routes := make([]*plugin.Route, 0, len(rules))
+	for _, rule := range rules {
+		var route plugin.Route
+		route.Method, err = regexp.Compile(rule.Method)
+		if err != nil {
+			slog.Fatal("route method %v, error:%v", rule.Method, err)
+		}
+		route.Rewrite = rule.Rewrite
+		if len(rule.Target) > 0 {
+			target, err := parseTarget(rule.Target)
+			if err != nil {
+				slog.Fatal("route target error:%v", err)
+			}
+			route.Target = &plugin.OutputTarget{
+				Addr:              target.Addr,
+				Finder:            newFinder(settings, localFinder, target),
+				DialOptions:       target.DialOptions,
+				PerRPCCredentials: target.PerRPCCredentials,
+			}
+		}
+		routes = append(routes, &route)
+	}
+	return routes
+}
+
+// routedToTarget reports whether the first route matching the message sends it to its own target,
+// instead of the address of the output
+func routedToTarget(routes []*plugin.Route) func(msg *protocol.Message) bool {
+	return func(msg *protocol.Message) bool {
+		for _, route := range routes {
+			if route.Method.MatchString(msg.Method) {
+				return route.Target != nil
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+package biz
+
+import (
+	"encoding/json"
+	"github.com/vearne/grpcreplay/balance"
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/filter"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"os"
+	"regexp"
+)
+
+// sampleRule is the json form of the sampling rule of an output
+type sampleRule struct {
+	// the name of the output flag, e.g. "output-grpc" for all gRPC outputs,
+	// or with its value for one of them, e.g. "output-grpc=grpc://127.0.0.1:35002"
+	Output  string  `json:"output"`
+	Percent float64 `json:"percent"`
+	// (optional) header:<name> or field:<path>, sample by the hash of the key instead of randomly
+	Key string `json:"key"`
+	// (optional) percentages of the methods, the first match overrides Percent
+	Methods []struct {
+		Method  string  `json:"method"`
+		Percent float64 `json:"percent"`
+	} `json:"methods"`
+
+	sampler *filter.Sampler
+	// applied to an output
+	used bool
+}
+
+// sampledWriter only writes the messages let through by the sampler
+type sampledWriter struct {
+	PluginWriter
+	sampler filter.Filter
+	// (optional) the messages which are always written, e.g. those the output sends to the targets of the routes
+	unsampled func(msg *protocol.Message) bool
+}
+
+func (w *sampledWriter) Write(msg *protocol.Message) error {
+	if w.unsampled != nil && w.unsampled(msg) {
+		return w.PluginWriter.Write(msg)
+	}
+	if _, ok := w.sampler.Filter(msg); !ok {
+		return nil
+	}
+	return w.PluginWriter.Write(msg)
+}
+
+// newSampleRules loads the sampling rules of the outputs from settings.OutputSampleRules
+func newSampleRules(settings *config.AppSettings) []*sampleRule {
+	if len(settings.OutputSampleRules) <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(settings.OutputSampleRules)
+	if err != nil {
+		slog.Fatal("read sample rules, error:%v", err)
+	}
+	var rules []*sampleRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		slog.Fatal("parse sample rules %v, error:%v", settings.OutputSampleRules, err)
+	}
+
+	for _, rule := range rules {
+		rule.sampler = &filter.Sampler{Percent: rule.Percent}
+		if len(rule.Key) > 0 {
+			rule.sampler.Key, err = balance.ParseHashKey(rule.Key)
+			if err != nil {
+				slog.Fatal("sample rule of %v, error:%v", rule.Output, err)
+			}
+		}
+		for _, m := range rule.Methods {
+			r, err := regexp.Compile(m.Method)
+			if err != nil {
+				slog.Fatal("sample rule of %v, method %v, error:%v", rule.Output, m.Method, err)
+			}
+			rule.sampler.Methods = append(rule.sampler.Methods, &filter.MethodPercent{Method: r, Percent: m.Percent})
+		}
+	}
+	return rules
+}
+
+// sampleLastOutput applies the first matching sampling rule to the output registered last,
+// flag and value are the command line option which created it. Returns nil if no rule matches.
+func (plugins *InOutPlugins) sampleLastOutput(rules []*sampleRule, flag string, value string) *sampledWriter {
+	for _, rule := range rules {
+		if rule.Output != flag && rule.Output != flag+"="+value {
+			continue
+		}
+		rule.used = true
+		last := len(plugins.Outputs) - 1
+		slog.Info("output %v=%v, sample %v%%", flag, value, rule.Percent)
+		w := &sampledWriter{PluginWriter: plugins.Outputs[last], sampler: rule.sampler}
+		plugins.Outputs[last] = w
+		return w
+	}
+	return nil
+}
+
+// checkSampleRules exits if a rule matches no output, e.g. a typo would send all the traffic to a canary
+func checkSampleRules(rules []*sampleRule) {
+	for _, rule := range unusedSampleRules(rules) {
+		slog.Fatal("sample rule of %v matches no output", rule.Output)
+	}
+}
+
+func unusedSampleRules(rules []*sampleRule) []*sampleRule {
+	unused := make([]*sampleRule, 0)
+	for _, rule := range rules {
+		if !rule.used {
+			unused = append(unused, rule)
+		}
+	}
+	return unused
+}
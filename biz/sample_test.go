@@ -0,0 +1,134 @@
+package biz
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/balance"
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/filter"
+	"github.com/vearne/grpcreplay/plugin"
+	"github.com/vearne/grpcreplay/protocol"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+type countWriter struct {
+	users map[string]bool
+	count int
+}
+
+func (w *countWriter) Write(msg *protocol.Message) error {
+	w.count++
+	w.users[msg.Request.Headers["x-user-id"]] = true
+	return nil
+}
+
+func (w *countWriter) Close() error {
+	return nil
+}
+
+func TestSampleOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.json")
+	err := os.WriteFile(path, []byte(`[
+		{"output": "output-grpc=grpc://127.0.0.1:35002", "percent": 5, "key": "header:x-user-id"},
+		{"output": "output-grpc", "percent": 20, "key": "header:x-user-id",
+			"methods": [{"method": "Search$", "percent": 0}]}
+	]`), 0600)
+	assert.Nil(t, err)
+	rules := newSampleRules(&config.AppSettings{OutputSampleRules: path})
+
+	five, twenty, all := &countWriter{users: map[string]bool{}}, &countWriter{users: map[string]bool{}},
+		&countWriter{users: map[string]bool{}}
+	var plugins InOutPlugins
+	plugins.Outputs = append(plugins.Outputs, five)
+	plugins.sampleLastOutput(rules, "output-grpc", "grpc://127.0.0.1:35002")
+	plugins.Outputs = append(plugins.Outputs, twenty)
+	plugins.sampleLastOutput(rules, "output-grpc", "grpc://127.0.0.1:35003")
+	plugins.Outputs = append(plugins.Outputs, all)
+	plugins.sampleLastOutput(rules, "output-file-directory", "/tmp/mycapture")
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 1000; i++ {
+			msg := &protocol.Message{Method: "/SearchService/CurrentTime", Request: &protocol.MsgItem{
+				Headers: map[string]string{"x-user-id": strconv.Itoa(i)},
+			}}
+			for _, w := range plugins.Outputs {
+				assert.Nil(t, w.Write(msg))
+			}
+			msg.Method = "/SearchService/Search"
+			for _, w := range plugins.Outputs {
+				assert.Nil(t, w.Write(msg))
+			}
+		}
+	}
+
+	assert.Len(t, unusedSampleRules(rules), 0)
+
+	assert.Equal(t, 4000, all.count)
+	assert.InDelta(t, 50, len(five.users), 25)
+	assert.InDelta(t, 200, len(twenty.users), 50)
+	// a given user is always in or out, and the users in 5% are also in 20%
+	assert.Equal(t, 2*len(twenty.users), twenty.count)
+	for user := range five.users {
+		assert.True(t, twenty.users[user], user)
+	}
+}
+
+func TestUnusedSampleRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.json")
+	err := os.WriteFile(path, []byte(`[
+		{"output": "output-grpc=grpc://127.0.0.1:35002", "percent": 5},
+		{"output": "output-grcp", "percent": 20}
+	]`), 0600)
+	assert.Nil(t, err)
+	rules := newSampleRules(&config.AppSettings{OutputSampleRules: path})
+
+	var plugins InOutPlugins
+	plugins.Outputs = append(plugins.Outputs, &countWriter{users: map[string]bool{}})
+	plugins.sampleLastOutput(rules, "output-grpc", "grpc://127.0.0.1:35002")
+	unused := unusedSampleRules(rules)
+	assert.Len(t, unused, 1)
+	assert.Equal(t, "output-grcp", unused[0].Output)
+}
+
+func TestSampleRouteTargets(t *testing.T) {
+	routes := []*plugin.Route{
+		{Method: regexp.MustCompile("^/SearchService/Search$"), Rewrite: "/SearchService/SearchV2"},
+		{Method: regexp.MustCompile("^/SearchService/"), Target: &plugin.OutputTarget{Addr: "127.0.0.1:35003"}},
+	}
+	w := &countWriter{users: map[string]bool{}}
+	sampled := &sampledWriter{PluginWriter: w, sampler: &filter.Sampler{Percent: 0},
+		unsampled: routedToTarget(routes)}
+
+	for _, method := range []string{"/SearchService/Search", "/SearchService/CurrentTime", "/OrderService/Get"} {
+		msg := &protocol.Message{Method: method, Request: &protocol.MsgItem{Headers: map[string]string{}}}
+		assert.Nil(t, sampled.Write(msg))
+	}
+	// only the message sent to the target of the route
+	assert.Equal(t, 1, w.count)
+}
+
+func TestSampleIndependentOfHashPolicy(t *testing.T) {
+	key, err := balance.ParseHashKey("header:x-user-id")
+	assert.Nil(t, err)
+	sampler := &filter.Sampler{Percent: 5, Key: key}
+
+	sampled, upperHalf := 0, 0
+	for i := 0; i < 2000; i++ {
+		user := strconv.Itoa(i)
+		msg := &protocol.Message{Request: &protocol.MsgItem{Headers: map[string]string{"x-user-id": user}}}
+		if _, ok := sampler.Filter(msg); !ok {
+			continue
+		}
+		sampled++
+		// the position of the key on the ring of the hash policy
+		if balance.Hash64(user) >= 1<<63 {
+			upperHalf++
+		}
+	}
+	assert.InDelta(t, 100, sampled, 50)
+	// the sampled users are spread over the ring instead of the lowest 5%
+	assert.InDelta(t, sampled/2, upperHalf, float64(sampled)/4)
+}
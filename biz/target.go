@@ -0,0 +1,187 @@
+package biz
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	schemeGRPC  = "grpc"
+	schemeGRPCS = "grpcs"
+)
+
+// Target is a gRPC server that messages are sent to, or whose reflection service is used.
+//
+//	grpc://127.0.0.1:35001
+//	grpcs://example.com:443?ca=./ca.pem&cert=./client.pem&key=./client-key.pem&server-name=example.com
+//
+// Both schemes support the option
+//
+//	weight                    weight of the server among the targets of --output-grpc-lb-target, 1 by default
+//
+// grpcs also supports the following options:
+//
+//	ca                        PEM file of the CAs used to verify the server, the system CAs by default
+//	cert, key                 PEM files of the client certificate and its key, for mTLS
+//	server-name               overrides the name used to verify the server certificate
+//	insecure-skip-verify      don't verify the server certificate
+//	token-file                file containing a bearer token, it is read again when it changes
+//	oauth-token-url           token endpoint of the OAuth client credentials grant
+//	oauth-client-id           client id of the OAuth client credentials grant
+//	oauth-client-secret-file  file containing the client secret of the OAuth client credentials grant
+//	oauth-scope               (optional) scope of the OAuth client credentials grant
+//
+// With per-call credentials, the recorded authorization header is not sent.
+type Target struct {
+	// grpc or grpcs
+	Scheme      string
+	Addr        string
+	DialOptions []grpc.DialOption
+	// DialOptions contain per-call credentials, token-file or oauth-*
+	PerRPCCredentials bool
+	Weight            int
+}
+
+var tlsOptions = []string{"ca", "cert", "key", "server-name", "insecure-skip-verify"}
+
+var callCredentialOptions = []string{"token-file",
+	"oauth-token-url", "oauth-client-id", "oauth-client-secret-file", "oauth-scope"}
+
+// parseTarget parses a url like "grpcs://example.com:443?ca=./ca.pem", the scheme defaults to grpc
+func parseTarget(rawURL string) (*Target, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = schemeGRPC + "://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != schemeGRPC && u.Scheme != schemeGRPCS {
+		return nil, fmt.Errorf("unsupported scheme:%v, expect grpc or grpcs", u.Scheme)
+	}
+
+	query := u.Query()
+	for key := range query {
+		if key != "weight" && !contains(tlsOptions, key) && !contains(callCredentialOptions, key) {
+			return nil, fmt.Errorf("unknown option:%v", key)
+		}
+	}
+
+	var target Target
+	target.Scheme = u.Scheme
+	target.Addr = u.Host
+	target.Weight = 1
+	if query.Has("weight") {
+		target.Weight, err = strconv.Atoi(query.Get("weight"))
+		if err != nil || target.Weight <= 0 {
+			return nil, fmt.Errorf("weight must be a positive integer:%v", query.Get("weight"))
+		}
+		query.Del("weight")
+	}
+	if u.Scheme == schemeGRPC {
+		for key := range query {
+			return nil, fmt.Errorf("option %v requires grpcs://", key)
+		}
+		target.DialOptions = append(target.DialOptions,
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		return &target, nil
+	}
+
+	tlsConfig, err := newTLSConfig(query)
+	if err != nil {
+		return nil, err
+	}
+	target.DialOptions = append(target.DialOptions,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+
+	perRPC, err := newPerRPCCredentials(query)
+	if err != nil {
+		return nil, err
+	}
+	if perRPC != nil {
+		target.DialOptions = append(target.DialOptions, grpc.WithPerRPCCredentials(perRPC))
+		target.PerRPCCredentials = true
+	}
+	return &target, nil
+}
+
+func newTLSConfig(query url.Values) (*tls.Config, error) {
+	var cfg tls.Config
+	cfg.ServerName = query.Get("server-name")
+
+	if value := query.Get("insecure-skip-verify"); len(value) > 0 {
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("insecure-skip-verify:%w", err)
+		}
+		cfg.InsecureSkipVerify = skip
+	}
+
+	if ca := query.Get("ca"); len(ca) > 0 {
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("read ca:%w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ca:%v", ca)
+		}
+		cfg.RootCAs = pool
+	}
+
+	cert, key := query.Get("cert"), query.Get("key")
+	if (len(cert) > 0) != (len(key) > 0) {
+		return nil, fmt.Errorf("cert and key must be specified together")
+	}
+	if len(cert) > 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("load cert and key:%w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return &cfg, nil
+}
+
+func newPerRPCCredentials(query url.Values) (credentials.PerRPCCredentials, error) {
+	tokenFile := query.Get("token-file")
+	tokenURL := query.Get("oauth-token-url")
+	if len(tokenFile) > 0 && len(tokenURL) > 0 {
+		return nil, fmt.Errorf("token-file and oauth-token-url are mutually exclusive")
+	}
+
+	if len(tokenFile) > 0 {
+		return newTokenFileCredentials(tokenFile), nil
+	}
+	if len(tokenURL) > 0 {
+		clientID := query.Get("oauth-client-id")
+		secretFile := query.Get("oauth-client-secret-file")
+		if len(clientID) <= 0 || len(secretFile) <= 0 {
+			return nil, fmt.Errorf("oauth-token-url requires oauth-client-id and oauth-client-secret-file")
+		}
+		return newOAuthCredentials(tokenURL, clientID, secretFile, query.Get("oauth-scope")), nil
+	}
+	for _, key := range []string{"oauth-client-id", "oauth-client-secret-file", "oauth-scope"} {
+		if query.Has(key) {
+			return nil, fmt.Errorf("%v requires oauth-token-url", key)
+		}
+	}
+	return nil, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
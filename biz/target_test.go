@@ -0,0 +1,84 @@
+package biz
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTargetError(t *testing.T) {
+	cases := []string{
+		"http://127.0.0.1:8080",
+		"grpc://127.0.0.1:8080?ca=./ca.pem",
+		"grpcs://127.0.0.1:8080?unknown=1",
+		"grpcs://127.0.0.1:8080?cert=./client.pem",
+		"grpcs://127.0.0.1:8080?ca=./not-exist.pem",
+		"grpcs://127.0.0.1:8080?insecure-skip-verify=abc",
+		"grpcs://127.0.0.1:8080?oauth-token-url=http://127.0.0.1:8081/token",
+		"grpcs://127.0.0.1:8080?oauth-client-id=abc",
+		"grpc://127.0.0.1:8080?weight=0",
+	}
+	for _, c := range cases {
+		_, err := parseTarget(c)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestParseTargetWeight(t *testing.T) {
+	target, err := parseTarget("grpc://127.0.0.1:8080?weight=3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, target.Weight)
+
+	target, err = parseTarget("grpcs://127.0.0.1:8080?insecure-skip-verify=true")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, target.Weight)
+}
+
+func TestTokenFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(path, []byte("abc\n"), 0600))
+
+	target, err := parseTarget("grpcs://127.0.0.1:8080?token-file=" + path)
+	assert.Nil(t, err)
+	assert.Len(t, target.DialOptions, 2)
+
+	c := newTokenFileCredentials(path)
+	md, err := c.GetRequestMetadata(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer abc", md["authorization"])
+}
+
+func TestOAuthCredentials(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" ||
+			r.FormValue("scope") != "replay" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"xyz","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(secretFile, []byte("secret"), 0600))
+
+	c := newOAuthCredentials(server.URL, "client", secretFile, "replay")
+	for i := 0; i < 2; i++ {
+		md, err := c.GetRequestMetadata(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, "Bearer xyz", md["authorization"])
+	}
+	// the token is cached
+	assert.Equal(t, 1, requests)
+
+	c = newOAuthCredentials(server.URL, "client", secretFile, "other")
+	_, err := c.GetRequestMetadata(context.Background())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,28 @@
+package biz
+
+import (
+	"github.com/vearne/grpcreplay/config"
+	"github.com/vearne/grpcreplay/transform"
+	slog "github.com/vearne/simplelog"
+)
+
+// NewTransformer creates the transformer of the request bodies, nil if no rules are specified.
+// The descriptors are looked up by the finders of the plugins.
+func NewTransformer(settings *config.AppSettings, plugins *InOutPlugins) Transformer {
+	if len(settings.TransformRules) <= 0 {
+		return nil
+	}
+	rules, err := transform.LoadRules(settings.TransformRules)
+	if err != nil {
+		slog.Fatal("load transform rules, error:%v", err)
+	}
+	if plugins.Finder == nil {
+		slog.Fatal("--transform-rules requires the protobuf definitions, see --proto and --reflection-addr")
+	}
+	t, err := transform.NewTransformer(rules, plugins.Finder)
+	if err != nil {
+		slog.Fatal("create transformer, error:%v", err)
+	}
+	slog.Info("create transformer, %v rules", len(rules))
+	return t
+}
@@ -61,6 +61,8 @@ func (h *MultiIntOption) Set(value string) error {
 // 该结构体的字段对应于命令行参数，包括输入源、输出目标、过滤器、限流器等配置。
 type AppSettings struct {
 	ExitAfter time.Duration `json:"exit-after"`
+	// serve /metrics on it, empty means disabled
+	MetricsAddr string `json:"metrics-addr"`
 
 	// ######################## input #######################
 	InputRAW []string `json:"input-raw"`
@@ -69,6 +71,10 @@ type AppSettings struct {
 	InputFileDir         []string `json:"input-file-directory"`
 	InputFileReadDepth   int      `json:"input-file-read-depth"`
 	InputFileReplaySpeed float64  `json:"input-file-replay-speed"`
+	// json file of the load profile, replaces InputFileReplaySpeed
+	InputFileLoadProfile string `json:"input-file-load-profile"`
+	// ignore the timestamps, the messages are read as fast as the outputs accept them
+	InputFileClosedLoop bool `json:"input-file-closed-loop"`
 
 	// intput RocketMQ
 	InputRocketMQNameServer []string `json:"input-rocketmq-name-server"`
@@ -82,6 +88,84 @@ type AppSettings struct {
 	OutputGRPC   []string `json:"output-grpc"`
 	// multiple workers call services concurrently
 	OutputGRPCWorkerNumber int `json:"output-grpc-worker-number"`
+	// json file of the rules rewriting the request headers before replay
+	OutputGRPCHeaderRules string `json:"output-grpc-header-rules"`
+	// json file of the routing table, the methods can be sent to other targets and renamed
+	OutputGRPCRoutes string `json:"output-grpc-routes"`
+	// compare the responses with the recorded ones, and write the diff records to the file
+	OutputGRPCDiffFile string `json:"output-grpc-diff-file"`
+	// the results of the calls(response, status, latency) are sent to the other outputs
+	OutputGRPCResults bool `json:"output-grpc-results"`
+	// the recorded grpc-timeout is multiplied by it
+	OutputGRPCTimeoutScale float64 `json:"output-grpc-timeout-scale"`
+	// the deadline of the requests without grpc-timeout, 0 means no deadline
+	OutputGRPCDefaultTimeout time.Duration
+	// the upper limit of the deadlines, 0 means no limit
+	OutputGRPCMaxTimeout time.Duration
+	// including the first call, no retry if it is less than 2
+	OutputGRPCRetryMaxAttempts int `json:"output-grpc-retry-max-attempts"`
+	// comma separated status codes which are retried, e.g. UNAVAILABLE,RESOURCE_EXHAUSTED
+	OutputGRPCRetryCodes      string `json:"output-grpc-retry-codes"`
+	OutputGRPCRetryBackoff    time.Duration
+	OutputGRPCRetryMaxBackoff time.Duration
+	// the circuit breaker of a target opens after the consecutive failures, 0 means disabled
+	OutputGRPCBreakerThreshold int `json:"output-grpc-breaker-threshold"`
+	OutputGRPCBreakerOpenTime  time.Duration
+	// the messages which fail to be replayed are written to the directory
+	OutputGRPCDeadLetter string `json:"output-grpc-dead-letter"`
+	// keep the order of the messages with the same key: connection, header:<name> or field:<path>
+	OutputGRPCOrderBy string `json:"output-grpc-order-by"`
+	// send the unary calls without grpcurl, for high throughput
+	OutputGRPCNative bool `json:"output-grpc-native"`
+	// the number of calls in flight, 0 means the rate of the input is followed
+	OutputGRPCConcurrency int `json:"output-grpc-concurrency"`
+	// the concurrency is increased up to it, until the thresholds are crossed
+	OutputGRPCMaxConcurrency      int `json:"output-grpc-max-concurrency"`
+	OutputGRPCConcurrencyStep     int `json:"output-grpc-concurrency-step"`
+	OutputGRPCConcurrencyInterval time.Duration
+	// in percent
+	OutputGRPCMaxErrorRate float64 `json:"output-grpc-max-error-rate"`
+	// the threshold of the 99th percentile latency
+	OutputGRPCMaxLatency time.Duration
+	// the throughput of each concurrency is written to the file
+	OutputGRPCCapacityReport string `json:"output-grpc-capacity-report"`
+	// the replay report is written to the files with the prefix on exit, .txt, .json and .html
+	OutputGRPCReport string `json:"output-grpc-report"`
+	// a summary of the calls is printed at the interval, 0 means never
+	OutputGRPCReportInterval time.Duration
+	// fields that are not compared
+	DiffIgnorePaths []string `json:"diff-ignore-path"`
+	// numbers are considered equal if they differ by no more than it
+	DiffFloatTolerance float64 `json:"diff-float-tolerance"`
+	// repeated fields whose order doesn't matter
+	DiffUnorderedPaths []string `json:"diff-unordered-path"`
+
+	// json file of the sampling rules of the outputs
+	OutputSampleRules string `json:"output-sample-rules"`
+
+	// --- output grpc lb ---
+	// the backends among which the requests of one output are balanced
+	OutputGRPCLBTargets []string `json:"output-grpc-lb-target"`
+	// round_robin, weighted or hash
+	OutputGRPCLBPolicy string `json:"output-grpc-lb-policy"`
+	// key of the hash policy, header:<name> or field:<path>
+	OutputGRPCLBHashKey string `json:"output-grpc-lb-hash-key"`
+	// a backend is ejected after this many consecutive failures
+	OutputGRPCLBMaxFailures int `json:"output-grpc-lb-max-failures"`
+	// the host names of the backends are resolved again after this duration
+	OutputGRPCLBDNSRefresh time.Duration
+	// an ejected backend is not used for this duration
+	OutputGRPCLBEjectTime time.Duration
+
+	// --- output shadow ---
+	// the current build, the candidate build and(optional) another instance of the current build
+	OutputShadowPrimary   string `json:"output-shadow-primary"`
+	OutputShadowCandidate string `json:"output-shadow-candidate"`
+	OutputShadowSecondary string `json:"output-shadow-secondary"`
+	OutputShadowReport    string `json:"output-shadow-report"`
+	// thresholds in percent to decide whether a field is noisy
+	OutputShadowRelativeThreshold float64 `json:"output-shadow-relative-threshold"`
+	OutputShadowAbsoluteThreshold float64 `json:"output-shadow-absolute-threshold"`
 
 	// --- outputfile ---
 	OutputFileDir []string `json:"output-file-directory"`
@@ -106,6 +190,10 @@ type AppSettings struct {
 	// Query per second
 	RateLimitQPS int `json:"rate-limit-qps"`
 
+	// --- transform ---
+	// json file of the rules editing the request bodies
+	TransformRules string `json:"transform-rules"`
+
 	// --- other ---
 	Codec string `json:"codec"`
 
@@ -114,7 +202,17 @@ type AppSettings struct {
 	// file or directory
 	ProtoFileStr string `json:"proto"`
 	ProtoFiles   []string
+	// directories used to locate the files imported by the proto files
+	ProtoImportPaths []string `json:"proto-import-path"`
+	// files containing an encoded FileDescriptorSet
+	ProtoSetFiles []string `json:"protoset"`
+	// additional gRPC reflection services to look up the definition of methods
+	ReflectionAddr []string `json:"reflection-addr"`
 
 	// If the output has been processed, the maximum time to wait for the input to be processed
 	WaitDefaultDuration time.Duration
+	// connections without any packet for this duration are considered closed
+	ConnIdleTimeout time.Duration
+	// descriptors obtained through reflection are resolved again after this duration
+	DescriptorTTL time.Duration
 }
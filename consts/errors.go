@@ -4,4 +4,6 @@ import "errors"
 
 var (
 	ErrProtocal = errors.New("protocal error")
+	// some bytes of the TCP stream were never captured
+	ErrTCPGap = errors.New("gap in tcp stream")
 )
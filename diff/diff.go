@@ -0,0 +1,219 @@
+// Package diff compares two json documents semantically,
+// e.g. the recorded response and the replayed one.
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options controls how the documents are compared.
+// A path consists of field names and array indexes separated by ".", e.g. "items.0.price".
+// In a pattern, "*" matches one element of the path and "**" matches any number of them.
+type Options struct {
+	// the fields are not compared, e.g. "header.requestId", "items.*.updateTime"
+	IgnorePaths []string
+	// numbers are considered equal if they differ by no more than FloatTolerance
+	FloatTolerance float64
+	// the order of the elements of these arrays doesn't matter, "**" for all arrays
+	UnorderedPaths []string
+}
+
+// Difference is a value that differs between the documents.
+// Expected or Actual is absent if the value only exists in one of them.
+type Difference struct {
+	Path     string `json:"path"`
+	Expected any    `json:"expected,omitempty"`
+	Actual   any    `json:"actual,omitempty"`
+}
+
+// Compare returns the differences between the expected and actual json documents
+func Compare(expected, actual []byte, opts *Options) ([]Difference, error) {
+	e, err := decode(expected)
+	if err != nil {
+		return nil, err
+	}
+	a, err := decode(actual)
+	if err != nil {
+		return nil, err
+	}
+
+	var c comparator
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.compare(nil, e, a)
+	return c.diffs, nil
+}
+
+// decode keeps the numbers as json.Number, so that large integers are not rounded
+func decode(data []byte) (any, error) {
+	if len(bytes.TrimSpace(data)) <= 0 {
+		// no body, e.g. the call failed
+		return map[string]any{}, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	err := d.Decode(&v)
+	return v, err
+}
+
+type comparator struct {
+	opts  Options
+	diffs []Difference
+}
+
+func (c *comparator) compare(path []string, expected, actual any) {
+	if matchAny(c.opts.IgnorePaths, path) {
+		return
+	}
+
+	switch e := expected.(type) {
+	case map[string]any:
+		if a, ok := actual.(map[string]any); ok {
+			c.compareObject(path, e, a)
+			return
+		}
+	case []any:
+		if a, ok := actual.([]any); ok {
+			if matchAny(c.opts.UnorderedPaths, path) {
+				c.compareUnordered(path, e, a)
+			} else {
+				c.compareOrdered(path, e, a)
+			}
+			return
+		}
+	case json.Number:
+		if a, ok := actual.(json.Number); ok {
+			if !c.equalNumber(e, a) {
+				c.add(path, expected, actual)
+			}
+			return
+		}
+	}
+
+	if expected != actual {
+		c.add(path, expected, actual)
+	}
+}
+
+func (c *comparator) compareObject(path []string, expected, actual map[string]any) {
+	keys := make([]string, 0, len(expected)+len(actual))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		e, eok := expected[key]
+		a, aok := actual[key]
+		child := append(path[:len(path):len(path)], key)
+		if eok && aok {
+			c.compare(child, e, a)
+		} else if !matchAny(c.opts.IgnorePaths, child) {
+			c.add(child, e, a)
+		}
+	}
+}
+
+func (c *comparator) compareOrdered(path []string, expected, actual []any) {
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		child := append(path[:len(path):len(path)], strconv.Itoa(i))
+		switch {
+		case i >= len(actual):
+			c.addUnlessIgnored(child, expected[i], nil)
+		case i >= len(expected):
+			c.addUnlessIgnored(child, nil, actual[i])
+		default:
+			c.compare(child, expected[i], actual[i])
+		}
+	}
+}
+
+// compareUnordered pairs each expected element with an equal actual element,
+// the elements left over are reported
+func (c *comparator) compareUnordered(path []string, expected, actual []any) {
+	matched := make([]bool, len(actual))
+	for i, e := range expected {
+		found := false
+		for j, a := range actual {
+			if matched[j] {
+				continue
+			}
+			sub := comparator{opts: c.opts}
+			sub.compare(append(path[:len(path):len(path)], strconv.Itoa(i)), e, a)
+			if len(sub.diffs) <= 0 {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.addUnlessIgnored(append(path[:len(path):len(path)], strconv.Itoa(i)), e, nil)
+		}
+	}
+	for j, a := range actual {
+		if !matched[j] {
+			c.addUnlessIgnored(append(path[:len(path):len(path)], strconv.Itoa(j)), nil, a)
+		}
+	}
+}
+
+func (c *comparator) equalNumber(expected, actual json.Number) bool {
+	if expected == actual {
+		return true
+	}
+	e, err1 := expected.Float64()
+	a, err2 := actual.Float64()
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return math.Abs(e-a) <= c.opts.FloatTolerance
+}
+
+func (c *comparator) addUnlessIgnored(path []string, expected, actual any) {
+	if !matchAny(c.opts.IgnorePaths, path) {
+		c.add(path, expected, actual)
+	}
+}
+
+func (c *comparator) add(path []string, expected, actual any) {
+	c.diffs = append(c.diffs, Difference{Path: strings.Join(path, "."), Expected: expected, Actual: actual})
+}
+
+func matchAny(patterns []string, path []string) bool {
+	for _, pattern := range patterns {
+		if match(strings.Split(pattern, "."), path) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern []string, path []string) bool {
+	if len(pattern) <= 0 {
+		return len(path) <= 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if match(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) <= 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+		return false
+	}
+	return match(pattern[1:], path[1:])
+}
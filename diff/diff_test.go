@@ -0,0 +1,49 @@
+package diff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	expected := `{"id":"1","price":1.5,"tags":["a","b"],"items":[{"name":"x","updateTime":"t1"}],"extra":1}`
+	actual := `{"id":"1","price":1.5000001,"tags":["b","a"],"items":[{"name":"x","updateTime":"t2"}],"added":2}`
+
+	diffs, err := Compare([]byte(expected), []byte(actual), nil)
+	assert.Nil(t, err)
+	paths := make([]string, 0)
+	for _, d := range diffs {
+		paths = append(paths, d.Path)
+	}
+	assert.Equal(t, []string{"added", "extra", "items.0.updateTime", "price", "tags.0", "tags.1"}, paths)
+
+	opts := &Options{
+		IgnorePaths:    []string{"items.*.updateTime", "extra", "added"},
+		FloatTolerance: 1e-6,
+		UnorderedPaths: []string{"**"},
+	}
+	diffs, err = Compare([]byte(expected), []byte(actual), opts)
+	assert.Nil(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestCompareUnordered(t *testing.T) {
+	expected := `{"books":[{"id":1},{"id":2},{"id":3}]}`
+	actual := `{"books":[{"id":3},{"id":1},{"id":4}]}`
+
+	diffs, err := Compare([]byte(expected), []byte(actual), &Options{UnorderedPaths: []string{"books"}})
+	assert.Nil(t, err)
+	assert.Len(t, diffs, 2)
+	assert.Equal(t, "books.1", diffs[0].Path)
+	assert.Nil(t, diffs[0].Actual)
+	assert.Equal(t, "books.2", diffs[1].Path)
+	assert.Nil(t, diffs[1].Expected)
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, matchAny([]string{"a.*.c"}, []string{"a", "0", "c"}))
+	assert.False(t, matchAny([]string{"a.*.c"}, []string{"a", "c"}))
+	assert.True(t, matchAny([]string{"**.c"}, []string{"c"}))
+	assert.True(t, matchAny([]string{"a.**"}, []string{"a", "b", "c"}))
+	assert.False(t, matchAny([]string{"a"}, []string{"a", "b"}))
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"github.com/vearne/grpcreplay/balance"
+	"github.com/vearne/grpcreplay/protocol"
+	"math/rand/v2"
+	"regexp"
+)
+
+const sampleSalt = "sample:"
+
+// MethodPercent is the percentage of the methods matching Method
+type MethodPercent struct {
+	Method  *regexp.Regexp
+	Percent float64
+}
+
+// Sampler lets a percentage of the messages pass.
+// If Key is specified, the decision depends on the hash of the key only,
+// so a given user is always in or out, and those in 1% are also in 5%.
+type Sampler struct {
+	// 0-100
+	Percent float64
+	// (optional) the messages without the key are sampled randomly
+	Key *balance.HashKey
+	// (optional) the first matching method overrides Percent
+	Methods []*MethodPercent
+}
+
+// Filter :If ok is true, it means that the message can pass
+func (s *Sampler) Filter(msg *protocol.Message) (*protocol.Message, bool) {
+	percent := s.Percent
+	for _, mp := range s.Methods {
+		if mp.Method.MatchString(msg.Method) {
+			percent = mp.Percent
+			break
+		}
+	}
+	if percent >= 100 {
+		return msg, true
+	}
+	if percent <= 0 {
+		return nil, false
+	}
+
+	// in [0, 1)
+	var point float64
+	if key := s.keyOf(msg); len(key) > 0 {
+		// salted, otherwise the sampled keys fall on a narrow arc of the ring of balance.PolicyHash
+		point = float64(balance.Hash64(sampleSalt+key)>>11) / (1 << 53)
+	} else {
+		point = rand.Float64()
+	}
+	if point*100 < percent {
+		return msg, true
+	}
+	return nil, false
+}
+
+func (s *Sampler) keyOf(msg *protocol.Message) string {
+	if s.Key == nil {
+		return ""
+	}
+	return s.Key.Value(msg)
+}
@@ -11,6 +11,9 @@ const (
 	ConnectionPrefaceSize = 24
 	StreamArraySize       = 10000
 	SettingFormatItemSize = 48
+	// frames larger than this are not expected when looking for a frame boundary,
+	// peers rarely raise SETTINGS_MAX_FRAME_SIZE above it
+	resyncMaxFrameSize = 1 << 20
 )
 
 const (
@@ -7,13 +7,18 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/vearne/grpcreplay/consts"
+	"github.com/vearne/grpcreplay/metrics"
 	"github.com/vearne/grpcreplay/protocol"
 	"github.com/vearne/grpcreplay/util"
 	slog "github.com/vearne/simplelog"
 	"golang.org/x/net/http2/hpack"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"io"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,6 +29,12 @@ var (
 	WaitDefaultDuration = 1 * time.Second
 )
 
+// the streams of the reflection service are not captured
+var errReflectionStream = errors.New("method is grpc.reflection")
+
+// the headers may be decoded wrongly after a gap in the tcp stream
+var errStaleTable = errors.New("headers refer to a stale dynamic table")
+
 const (
 	PseudoHeaderPath = ":path"
 )
@@ -31,6 +42,8 @@ const (
 const (
 	// http://http2.github.io/http2-spec/#SettingValues
 	http2initialHeaderTableSize = 4096
+	// https://www.rfc-editor.org/rfc/rfc7541#appendix-A
+	hpackStaticTableLen = 61
 )
 
 const (
@@ -131,12 +144,16 @@ type Http2Conn struct {
 	Processor          *Processor
 	RecordResponse     bool
 	MaxHeaderStringLen uint32
+	closeOnce          sync.Once
 }
 
 type MessageParser struct {
 	TCPBuffer           *TCPBuffer
 	MaxDynamicTableSize uint32
 	HeaderDecoder       *hpack.Decoder
+	// the dynamic table may miss the entries added by the header blocks lost in a gap,
+	// it is trusted again once the encoder empties it
+	staleTable bool
 }
 
 func NewMessageParser(maxDynamicTableSize uint32) *MessageParser {
@@ -169,82 +186,171 @@ func NewHttp2Conn(conn DirectConn, maxDynamicTableSize uint32, p *Processor) *Ht
 	return &hc
 }
 
+// Close closes the TCPBuffers, so that DealInput and DealOutput exit.
+// The streams that have not finished are abandoned.
+func (hc *Http2Conn) Close() {
+	hc.closeOnce.Do(func() {
+		hc.Input.TCPBuffer.Close()
+		hc.Output.TCPBuffer.Close()
+
+		abandoned := 0
+		for _, stream := range hc.Streams {
+			if atomic.LoadUint32(&stream.StreamID) != 0 {
+				abandoned++
+			}
+		}
+		slog.Info("close Http2Conn, Connection:%v, abandoned streams:%v",
+			hc.DirectConn.String(), abandoned)
+	})
+}
+
 func (hc *Http2Conn) DealOutput() {
 	dc := hc.DirectConn.Reverse()
 	slog.Debug("[start]Http2Conn.DealOutput, Connection:%v", dc.String())
+	hc.deal(hc.Output, dc, false)
+	slog.Debug("[end]Http2Conn.DealOutput, Connection:%v", dc.String())
+}
+
+func (hc *Http2Conn) DealInput() {
+	slog.Debug("[start]Http2Conn.DealInput, Connection:%v", hc.DirectConn.String())
+	hc.deal(hc.Input, hc.DirectConn, true)
+	slog.Debug("[end]Http2Conn.deal, Connection:%v", hc.DirectConn.String())
+}
 
+func (hc *Http2Conn) deal(parser *MessageParser, dc DirectConn, inputFlag bool) {
 	var err error
 	var fb *FrameBase
 
+	resync := false
 	for {
-		slog.Debug("Http2Conn.DealOutput, Connection:%v", dc.String())
-		buf := make([]byte, HeaderSize)
-		_, err = io.ReadFull(hc.Output.TCPBuffer, buf)
-		if err != nil {
-			slog.Warn("Http2Conn.DealOutput, ReadFull:%v", err)
+		slog.Debug("Http2Conn.deal, Connection:%v", dc.String())
+		fb, err = readFrame(parser.TCPBuffer, dc, inputFlag, resync)
+		if errors.Is(err, consts.ErrTCPGap) {
+			// The frame being read is incomplete, so are the streams it belongs to
+			slog.Warn("Http2Conn.deal, Connection:%v, gap in tcp stream, resynchronize", dc.String())
+			hc.resetStreams(inputFlag)
+			parser.staleTable = true
+			resync = true
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			slog.Debug("Http2Conn.deal, Connection:%v, closed", dc.String())
 			break
 		}
-
-		slog.Debug("Http2Conn.DealOutput, ParseFrameBase, Connection:%v", dc.String())
-		fb, err = ParseFrameBase(buf, hc.DirectConn.Reverse(), false)
 		if err != nil {
-			slog.Error("ProcessTCPPkg error:%v", err)
+			slog.Warn("Http2Conn.deal, Connection:%v, readFrame:%v", dc.String(), err)
 			break
 		}
+		resync = false
+
 		slog.Debug("Connection:%v,  FrameType:%v,  streamID:%v, len(payload):%v",
 			dc.String(), GetFrameType(fb.Type), fb.StreamID, fb.Length)
-
-		// Separate processing according to frame type
-		buf = make([]byte, fb.Length)
-		if fb.Length > 0 {
-			_, err = io.ReadFull(hc.Output.TCPBuffer, buf)
-			if err != nil {
-				slog.Warn("Http2Conn.DealOutput, ReadFull:%v", err)
-				break
-			}
-		}
-		fb.Payload = buf
 		hc.ProcessFrame(fb)
 	}
 }
 
-func (hc *Http2Conn) DealInput() {
-	slog.Debug("[start]Http2Conn.DealInput, Connection:%v", hc.DirectConn.String())
-
+// readFrame reads a complete frame from the buffer.
+// If resync is true, the bytes in front of the next frame boundary are skipped.
+func readFrame(tb *TCPBuffer, dc DirectConn, inputFlag bool, resync bool) (*FrameBase, error) {
+	var buf []byte
 	var err error
-	var fb *FrameBase
-	for {
-		slog.Debug("Http2Conn.DealInput, Connection:%v", hc.DirectConn.String())
-		buf := make([]byte, HeaderSize)
-		_, err = io.ReadFull(hc.Input.TCPBuffer, buf)
+	if resync {
+		buf, err = seekFrameHeader(tb)
+	} else {
+		buf = make([]byte, HeaderSize)
+		_, err = io.ReadFull(tb, buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fb, err := ParseFrameBase(buf, dc, inputFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	// Separate processing according to frame type
+	buf = make([]byte, fb.Length)
+	if fb.Length > 0 {
+		_, err = io.ReadFull(tb, buf)
 		if err != nil {
-			slog.Warn("Http2Conn.DealInput, ReadFull:%v", err)
-			break
+			return nil, err
 		}
+	}
+	fb.Payload = buf
+	return fb, nil
+}
+
+// seekFrameHeader scans the stream byte by byte until it finds something that looks like a frame header
+func seekFrameHeader(r io.Reader) ([]byte, error) {
+	buf := make([]byte, HeaderSize)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
 
-		slog.Debug("Http2Conn.DealInput, ParseFrameBase, Connection:%v", hc.DirectConn.String())
-		fb, err = ParseFrameBase(buf, hc.DirectConn, true)
+	skipped := 0
+	for !isPlausibleFrameHeader(buf) {
+		copy(buf, buf[1:])
+		_, err = io.ReadFull(r, buf[HeaderSize-1:])
 		if err != nil {
-			slog.Error("ProcessTCPPkg error:%v", err)
-			break
+			return nil, err
 		}
-		slog.Debug("Connection:%v,  FrameType:%v,  streamID:%v, len(payload):%v",
-			hc.DirectConn.String(), GetFrameType(fb.Type), fb.StreamID, fb.Length)
+		skipped++
+	}
+	slog.Info("seekFrameHeader, skipped:%v bytes", skipped)
+	return buf, nil
+}
 
-		// Separate processing according to frame type
-		buf = make([]byte, fb.Length)
-		if fb.Length > 0 {
-			_, err = io.ReadFull(hc.Input.TCPBuffer, buf)
-			if err != nil {
-				slog.Warn("Http2Conn.deal, ReadFull:%v", err)
-				break
-			}
-		}
-		fb.Payload = buf
-		hc.ProcessFrame(fb)
+// isPlausibleFrameHeader checks the frame header against the constraints of RFC 7540,
+// random bytes in the middle of a frame rarely satisfy all of them.
+func isPlausibleFrameHeader(b []byte) bool {
+	length := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	frameType := b[3]
+	flags := b[4]
+	streamID := binary.BigEndian.Uint32(b[5:HeaderSize])
+	// the reserved bit must be unset
+	if streamID&0x80000000 != 0 || length > resyncMaxFrameSize {
+		return false
 	}
 
-	slog.Debug("[end]Http2Conn.deal, Connection:%v", hc.DirectConn.String())
+	// all streams of gRPC are initiated by the client
+	clientStream := streamID%2 == 1
+	switch frameType {
+	case FrameTypeData:
+		return clientStream && flags&^0x9 == 0
+	case FrameTypeHeader:
+		return clientStream && flags&^0x2d == 0
+	case FrameTypeContinuation:
+		return clientStream && flags&^0x4 == 0
+	case FrameTypePriority:
+		return streamID != 0 && length == 5
+	case FrameTypeRSTStream:
+		return streamID != 0 && length == 4
+	case FrameTypeSetting:
+		return streamID == 0 && flags&^0x1 == 0 && length%6 == 0
+	case FrameTypePing:
+		return streamID == 0 && flags&^0x1 == 0 && length == 8
+	case FrameTypeGoAway:
+		return streamID == 0 && length >= 8
+	case FrameTypeWindowUpdate:
+		return length == 4
+	}
+	return false
+}
+
+// resetStreams discards the partial data of all streams in one direction
+func (hc *Http2Conn) resetStreams(inputFlag bool) {
+	for _, stream := range hc.Streams {
+		if atomic.LoadUint32(&stream.StreamID) == 0 {
+			continue
+		}
+		if inputFlag {
+			stream.Request.Reset()
+		} else if stream.Response != nil {
+			stream.Response.Reset()
+		}
+	}
 }
 
 func (hc *Http2Conn) ProcessFrame(f *FrameBase) {
@@ -299,11 +405,15 @@ func (hc *Http2Conn) processFrameData(f *FrameBase) {
 
 func (hc *Http2Conn) FinishStream(stream *Stream) {
 	slog.Debug("FinishStream, streamId:%v", stream.StreamID)
-	pMsg, pErr := stream.toMsg(hc.Processor.Finder)
-	if pErr == nil {
-		hc.Processor.OutputChan <- pMsg
+	raw, err := stream.toRawMsg()
+	if err == nil {
+		raw.msg.Meta.Peer = net.JoinHostPort(hc.DirectConn.SrcAddr.IP, strconv.Itoa(int(hc.DirectConn.SrcAddr.Port)))
+		hc.Processor.emit(raw)
 	} else {
-		slog.Warn("stream.toMsg, streamID:%v, error:%v", stream.StreamID, pErr)
+		slog.Warn("stream.toRawMsg, streamID:%v, error:%v", stream.StreamID, err)
+		if !errors.Is(err, errReflectionStream) {
+			metrics.StreamsFailed.WithLabelValues(metrics.MethodUnknown, metrics.ReasonStream).Inc()
+		}
 	}
 	stream.Reset()
 }
@@ -387,6 +497,7 @@ func (hc *Http2Conn) _processFrameHeader(f *FrameBase, parser *MessageParser,
 	slog.Debug("Connection:%v, stream:%v, EndHeader:%v, EndStream:%v",
 		f.DirectConn.String(), f.StreamID, fh.EndHeader, fh.EndStream)
 
+	checkStaleTable(parser, item, fh.HeaderBlockFragment)
 	hdec := parser.HeaderDecoder
 	//hdec.SetMaxStringLength(int(hc.MaxHeaderStringLen))
 	fields, err := hdec.DecodeFull(fh.HeaderBlockFragment)
@@ -426,6 +537,7 @@ func (hc *Http2Conn) _processFrameContinuation(f *FrameBase,
 	slog.Debug("Connection:%v, stream:%v, EndHeader:%v, EndStream:%v",
 		hc.DirectConn.String(), f.StreamID, fc.EndHeader, item.EndStream.Load())
 
+	checkStaleTable(parser, item, fc.HeaderBlockFragment)
 	hdec := parser.HeaderDecoder
 	fields, err := hdec.DecodeFull(fc.HeaderBlockFragment)
 	if err != nil {
@@ -438,9 +550,111 @@ func (hc *Http2Conn) _processFrameContinuation(f *FrameBase,
 	}
 }
 
+// checkStaleTable marks the item if the header block refers to a stale dynamic table,
+// the headers decoded from it may be wrong, e.g. another :path
+func checkStaleTable(parser *MessageParser, item *HTTPItem, block []byte) {
+	if !parser.staleTable {
+		return
+	}
+	cleared, dynamic := scanHeaderBlock(block)
+	if cleared {
+		slog.Info("the dynamic table is emptied, trust it again")
+		parser.staleTable = false
+		return
+	}
+	if dynamic {
+		slog.Warn("the header block refers to a stale dynamic table, drop the stream")
+		item.StaleTable.Store(true)
+	}
+}
+
+// scanHeaderBlock reports whether the header block starts with a dynamic table size update to 0,
+// otherwise whether it refers to an entry of the dynamic table, RFC 7541 section 6.
+// A block which can't be parsed is treated as referring to the dynamic table.
+func scanHeaderBlock(b []byte) (cleared bool, dynamic bool) {
+	first := true
+	for len(b) > 0 {
+		var index uint64
+		var ok bool
+		c := b[0]
+		switch {
+		case c&0x80 != 0:
+			// indexed header field
+			index, b, ok = readHpackInt(b, 7)
+			if !ok || index > hpackStaticTableLen {
+				return false, true
+			}
+			first = false
+			continue
+		case c&0xe0 == 0x20:
+			// dynamic table size update, only at the beginning of a block
+			var size uint64
+			size, b, ok = readHpackInt(b, 5)
+			if !ok {
+				return false, true
+			}
+			if first && size == 0 {
+				return true, false
+			}
+			continue
+		case c&0xc0 == 0x40:
+			// literal header field with incremental indexing
+			index, b, ok = readHpackInt(b, 6)
+		default:
+			// literal header field without indexing or never indexed
+			index, b, ok = readHpackInt(b, 4)
+		}
+		first = false
+		if !ok || index > hpackStaticTableLen {
+			return false, true
+		}
+		if index == 0 {
+			// the name is a literal
+			if b, ok = skipHpackString(b); !ok {
+				return false, true
+			}
+		}
+		if b, ok = skipHpackString(b); !ok {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// readHpackInt reads an integer with an n-bit prefix, RFC 7541 section 5.1
+func readHpackInt(b []byte, n uint) (uint64, []byte, bool) {
+	if len(b) <= 0 {
+		return 0, b, false
+	}
+	limit := uint64(1)<<n - 1
+	value := uint64(b[0]) & limit
+	b = b[1:]
+	if value < limit {
+		return value, b, true
+	}
+	for shift := uint(0); len(b) > 0 && shift < 63; shift += 7 {
+		c := b[0]
+		b = b[1:]
+		value += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return value, b, true
+		}
+	}
+	return 0, b, false
+}
+
+// skipHpackString skips a string literal, RFC 7541 section 5.2
+func skipHpackString(b []byte) ([]byte, bool) {
+	length, b, ok := readHpackInt(b, 7)
+	if !ok || length > uint64(len(b)) {
+		return b, false
+	}
+	return b[length:], true
+}
+
 func (hc *Http2Conn) processFrameGoAway(f *FrameBase) {
 	// remove http2Conn
-	delete(hc.Processor.ConnRepository, hc.DirectConn)
+	hc.Processor.RemoveConn(hc.DirectConn)
 }
 
 func (hc *Http2Conn) processFrameRSTStream(f *FrameBase) {
@@ -493,6 +707,9 @@ type HTTPItem struct {
 	EndHeader atomic.Bool
 	EndStream atomic.Bool
 
+	// the headers refer to a stale dynamic table
+	StaleTable atomic.Bool
+
 	Headers *sync.Map                 `json:"headers"`
 	DataBuf *util.GoroutineSafeBuffer `json:"-"`
 }
@@ -510,6 +727,7 @@ func NewHTTPItem() *HTTPItem {
 func (item *HTTPItem) Reset() {
 	item.EndStream.Store(false)
 	item.EndHeader.Store(false)
+	item.StaleTable.Store(false)
 	item.Headers.Clear()
 	item.DataBuf.Reset()
 }
@@ -525,68 +743,85 @@ func NewStream(recordResponse bool) *Stream {
 	return &s
 }
 
-func (s *Stream) toMsg(finder PBFinder) (*protocol.Message, error) {
+// rawMessage is a message whose request and response haven't been decoded yet,
+// it may wait in the Processor until the descriptors become available
+type rawMessage struct {
+	msg      *protocol.Message
+	request  []byte
+	response []byte
+	// dropped from the pending queue of the Processor
+	dropped bool
+}
+
+func (s *Stream) toRawMsg() (*rawMessage, error) {
+	if s.Request.StaleTable.Load() || (s.Response != nil && s.Response.StaleTable.Load()) {
+		return nil, errStaleTable
+	}
 	method := strings.TrimSpace(getMethod(s.Request.Headers))
 	if len(method) <= 0 {
 		slog.Error("method is empty, this is illegal")
 		return nil, errors.New("method is empty")
 	}
 	if strings.Contains(method, "grpc.reflection") {
-		return nil, errors.New("method is grpc.reflection")
+		return nil, errReflectionStream
 	}
 
 	var msg protocol.Message
-	var err error
-	var dataType *MethodInputOutput
 	id := uuid.Must(uuid.NewUUID())
-	msg.Meta.Version = 2
+	// the peer is set in FinishStream
+	msg.Meta.Version = protocol.VersionPeer
 	msg.Meta.UUID = id.String()
 	msg.Meta.Timestamp = time.Now().UnixNano()
 	msg.Meta.ContainResponse = s.RecordResponse
 	msg.Method = method
 
+	raw := rawMessage{msg: &msg}
 	// 1. ###### request ######
 	msg.Request = &protocol.MsgItem{}
 	msg.Request.Headers = toNormalMap(s.Request.Headers)
-	codecType := getCodecType(msg.Request.Headers)
+	raw.request = s.Request.DataBuf.Bytes()
+	// 2. ###### response ######
+	if s.RecordResponse {
+		msg.Response = &protocol.MsgItem{}
+		msg.Response.Headers = toNormalMap(s.Response.Headers)
+		raw.response = s.Response.DataBuf.Bytes()
+	}
+	return &raw, nil
+}
 
-	if codecType == CodecProtobuf { // Note: Temporarily only handle the case where the encoding method is Protobuf
-		dataType, err = finder.Get(msg.Method)
-		if err != nil {
-			slog.Error("finder.Get, method:%v, error:%v", method, err)
-			return nil, err
-		}
-		msg.Request.Body, err = changeToJsonStr(dataType.InType, s.Request.DataBuf.Bytes())
+// detach copies the data, the buffers of the stream are reused once it finishes
+func (m *rawMessage) detach() {
+	m.request = bytes.Clone(m.request)
+	m.response = bytes.Clone(m.response)
+}
+
+// decode converts the request and response to json
+func (m *rawMessage) decode(finder PBFinder) (*protocol.Message, error) {
+	var err error
+	method := m.msg.Method
+	// Note: Temporarily only handle the case where the encoding method is Protobuf
+	if getCodecType(m.msg.Request.Headers) == CodecProtobuf {
+		m.msg.Request.Body, err = decodeMessage(finder, method, true, m.request)
 		if err != nil {
-			slog.Error("changeToJsonStr, method:%v, error:%v", method, err)
+			slog.Error("decodeMessage, method:%v, error:%v", method, err)
 			return nil, err
 		}
 	} else {
-		msg.Request.Body = s.Request.DataBuf.String()
+		m.msg.Request.Body = string(m.request)
 	}
-	// 2. ###### response ######
-	if s.RecordResponse {
-		msg.Response = &protocol.MsgItem{}
-		msg.Response.Headers = toNormalMap(s.Response.Headers)
-		codecType = getCodecType(msg.Response.Headers)
 
-		if codecType == CodecProtobuf { // Note: Temporarily only handle the case where the encoding method is Protobuf
-			dataType, err = finder.Get(msg.Method)
-			if err != nil {
-				slog.Error("finder.Get, method:%v, error:%v", method, err)
-				return nil, err
-			}
-			msg.Response.Body, err = changeToJsonStr(dataType.OutType, s.Response.DataBuf.Bytes())
+	if m.msg.Response != nil {
+		if getCodecType(m.msg.Response.Headers) == CodecProtobuf {
+			m.msg.Response.Body, err = decodeMessage(finder, method, false, m.response)
 			if err != nil {
-				slog.Error("changeToJsonStr, method:%v, error:%v", method, err)
+				slog.Error("decodeMessage, method:%v, error:%v", method, err)
 				return nil, err
 			}
 		} else {
-			msg.Response.Body = s.Response.DataBuf.String()
+			m.msg.Response.Body = string(m.response)
 		}
 	}
-
-	return &msg, nil
+	return m.msg, nil
 }
 
 func getMethod(m *sync.Map) string {
@@ -611,6 +846,66 @@ func toNormalMap(m *sync.Map) map[string]string {
 	return result
 }
 
+// decodeMessage converts the request(or response) of the method to json.
+// If the descriptors look stale, i.e. the data can't be decoded or contains unknown fields,
+// they are refreshed and the data is decoded again.
+func decodeMessage(finder PBFinder, method string, isRequest bool, data []byte) (string, error) {
+	result, stale, err := decodeWithFinder(finder, method, isRequest, data)
+	if (stale || err != nil && !IsUnavailable(err)) && finder.Refresh(method) {
+		slog.Info("decodeMessage, method:%v, descriptors refreshed, stale:%v, error:%v", method, stale, err)
+		result, _, err = decodeWithFinder(finder, method, isRequest, data)
+	}
+	return result, err
+}
+
+func decodeWithFinder(finder PBFinder, method string, isRequest bool, data []byte) (string, bool, error) {
+	dataType, err := finder.Get(method)
+	if err != nil {
+		slog.Error("finder.Get, method:%v, error:%v", method, err)
+		return "", false, err
+	}
+	pbMsg := dataType.OutType
+	if isRequest {
+		pbMsg = dataType.InType
+	}
+	result, err := changeToJsonStr(pbMsg, data)
+	if err != nil {
+		return "", false, err
+	}
+	return result, hasUnknownFields(pbMsg.ProtoReflect()), nil
+}
+
+// hasUnknownFields reports whether the message or any message nested in it contains fields
+// missing from its descriptor
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+	found := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					found = hasUnknownFields(mv.Message())
+					return !found
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				list := v.List()
+				for i := 0; i < list.Len() && !found; i++ {
+					found = hasUnknownFields(list.Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			found = hasUnknownFields(v.Message())
+		}
+		return !found
+	})
+	return found
+}
+
 func changeToJsonStr(pbMsg proto.Message, data []byte) (string, error) {
 	err := proto.Unmarshal(data, pbMsg)
 	if err != nil {
@@ -0,0 +1,106 @@
+package http2
+
+import (
+	"bytes"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2/hpack"
+	"testing"
+	"time"
+)
+
+// headersFrame encodes a HEADERS frame which ends the stream
+func headersFrame(enc *hpack.Encoder, buf *bytes.Buffer, streamID uint32, path string) []byte {
+	buf.Reset()
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: PseudoHeaderPath, Value: path},
+		{Name: "content-type", Value: "application/grpc"},
+	} {
+		enc.WriteField(field) // nolint: errcheck
+	}
+	block := buf.Bytes()
+	frame := []byte{byte(len(block) >> 16), byte(len(block) >> 8), byte(len(block)),
+		FrameTypeHeader, 0x05, byte(streamID >> 24), byte(streamID >> 16), byte(streamID >> 8), byte(streamID)}
+	return append(frame, block...)
+}
+
+func TestHttp2ConnGapStaleTable(t *testing.T) {
+	p := NewProcessor(make(chan *NetPkg), false, NewFilePBFinder([]string{"./testdata/search.proto"}))
+	defer p.Close()
+
+	var dc DirectConn
+	hc := NewHttp2Conn(dc, http2initialHeaderTableSize, p)
+	defer hc.Close()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	search := headersFrame(enc, &buf, 1, "/SearchService/Search")
+	// lost, it adds /SearchService/CurrentTime to the dynamic table
+	lost := headersFrame(enc, &buf, 3, "/SearchService/CurrentTime")
+	// refers to the entry added by the lost frame, the stale table has /SearchService/Search there
+	stale := headersFrame(enc, &buf, 5, "/SearchService/CurrentTime")
+	// the encoder empties the dynamic table
+	enc.SetMaxDynamicTableSize(0)
+	enc.SetMaxDynamicTableSize(http2initialHeaderTableSize)
+	cleared := headersFrame(enc, &buf, 7, "/SearchService/CurrentTime")
+	trusted := headersFrame(enc, &buf, 9, "/SearchService/CurrentTime")
+
+	tb := hc.Input.TCPBuffer
+	tb.SetExpectedSeq(1000)
+	seq := uint32(1000)
+	add := func(payload []byte) {
+		var tcpPkg layers.TCP
+		tcpPkg.Seq = seq
+		tcpPkg.Payload = payload
+		tb.AddTCP(&tcpPkg)
+		seq += uint32(len(payload))
+	}
+	add(search)
+	seq += uint32(len(lost))
+	add(stale)
+	// the segment has waited long enough
+	tb.List.Front().Value.(*segment).arrival = time.Now().Add(-GapTimeout)
+	add(append(cleared, trusted...))
+	assert.Equal(t, int64(1), tb.GapCount())
+
+	expected := []string{"/SearchService/Search", "/SearchService/CurrentTime", "/SearchService/CurrentTime"}
+	for _, method := range expected {
+		select {
+		case msg := <-p.OutputChan:
+			assert.Equal(t, method, msg.Method)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message is not decoded")
+		}
+	}
+	select {
+	case msg := <-p.OutputChan:
+		t.Fatalf("unexpected message:%v", msg.Method)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestScanHeaderBlock(t *testing.T) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: "x-user", Value: "alice"}) // nolint: errcheck
+	cleared, dynamic := scanHeaderBlock(buf.Bytes())
+	assert.False(t, cleared)
+	assert.False(t, dynamic, "literal name")
+
+	buf.Reset()
+	enc.WriteField(hpack.HeaderField{Name: "x-user", Value: "alice"}) // nolint: errcheck
+	cleared, dynamic = scanHeaderBlock(buf.Bytes())
+	assert.False(t, cleared)
+	assert.True(t, dynamic, "indexed in the dynamic table")
+
+	cleared, dynamic = scanHeaderBlock([]byte{0x40, 0x85})
+	assert.False(t, cleared)
+	assert.True(t, dynamic, "truncated")
+
+	buf.Reset()
+	enc.SetMaxDynamicTableSize(0)
+	enc.WriteField(hpack.HeaderField{Name: "x-user", Value: "alice"}) // nolint: errcheck
+	cleared, _ = scanHeaderBlock(buf.Bytes())
+	assert.True(t, cleared)
+}
@@ -2,22 +2,44 @@ package http2
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/fullstorydev/grpcurl"
-	"github.com/jhump/protoreflect/desc" //nolint: staticcheck
+	"github.com/jhump/protoreflect/desc"            //nolint: staticcheck
+	"github.com/jhump/protoreflect/desc/protoparse" //nolint: staticcheck
 	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/patrickmn/go-cache"
 	"github.com/vearne/grpcreplay/util"
 	slog "github.com/vearne/simplelog"
-	reflectpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/descriptorpb"
 	"google.golang.org/protobuf/types/dynamicpb"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	// Descriptors obtained through reflection are resolved again after DescriptorTTL,
+	// so that a new schema deployed on the server is picked up. 0 means never.
+	DescriptorTTL = 10 * time.Minute
+)
+
+// the descriptors are not refreshed more often than this, even if they keep failing to decode
+const minRefreshInterval = 10 * time.Second
+
 type MethodInputOutput struct {
 	InType  proto.Message
 	OutType proto.Message
@@ -27,18 +49,33 @@ type PBFinder interface {
 	// svcAndMethod looks like"/helloworld.Greeter/SayHello"
 	Get(svcAndMethod string) (*MethodInputOutput, error)
 	GetDescriptorSource() grpcurl.DescriptorSource
+	// Refresh drops the cached descriptors of the method, e.g. when they failed to decode a message.
+	// Returns false if the descriptors can't change or have just been refreshed.
+	Refresh(svcAndMethod string) bool
+}
+
+// DescSourceRefresher is implemented by the descriptor sources whose descriptors may change over time
+type DescSourceRefresher interface {
+	// Refresh discards the downloaded descriptors, returns false if they have just been refreshed
+	Refresh() bool
 }
 
 type PBFinderDelegate struct {
 	ds         grpcurl.DescriptorSource
 	innerCache *cache.Cache
+	// svcAndMethod -> hash of the descriptors, used to detect schema changes
+	hashes sync.Map
 }
 
 // NewPBFinderDelegate creates a new PBFinderDelegate with the given descriptor source and initializes its internal cache.
+// If the descriptor source can be refreshed, the cached descriptors expire after DescriptorTTL.
 func NewPBFinderDelegate(ds grpcurl.DescriptorSource) *PBFinderDelegate {
 	var f PBFinderDelegate
 	f.ds = ds
 	f.innerCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	if _, ok := ds.(DescSourceRefresher); ok && DescriptorTTL > 0 {
+		f.innerCache = cache.New(DescriptorTTL, DescriptorTTL)
+	}
 	return &f
 }
 
@@ -54,16 +91,52 @@ func (f *PBFinderDelegate) Get(svcAndMethod string) (*MethodInputOutput, error)
 		}, nil
 	}
 
+	if _, seen := f.hashes.Load(svcAndMethod); seen {
+		// expired, the source may hold the descriptors as old as the ones just dropped
+		if r, ok := f.ds.(DescSourceRefresher); ok {
+			r.Refresh()
+		}
+	}
+
 	m, err := f.Find(svcAndMethod)
 	if err != nil {
 		slog.Warn("PBFinderDelegate.Get,svcAndMethod:%v, error:%v", svcAndMethod, err)
 		return nil, err
 	}
+	f.checkSchema(svcAndMethod)
 
-	f.innerCache.Set(svcAndMethod, m, cache.NoExpiration)
+	f.innerCache.Set(svcAndMethod, m, cache.DefaultExpiration)
 	return m, nil
 }
 
+func (f *PBFinderDelegate) Refresh(svcAndMethod string) bool {
+	r, ok := f.ds.(DescSourceRefresher)
+	if !ok || !r.Refresh() {
+		return false
+	}
+	slog.Info("PBFinderDelegate.Refresh, svcAndMethod:%v", svcAndMethod)
+	f.innerCache.Delete(svcAndMethod)
+	return true
+}
+
+// checkSchema logs when the descriptors of the method differ from the ones seen last time
+func (f *PBFinderDelegate) checkSchema(svcAndMethod string) {
+	fdSet, err := GetFileDescriptorSet(f.ds, svcAndMethod)
+	if err != nil {
+		return
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(fdSet)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:16])
+	old, loaded := f.hashes.Swap(svcAndMethod, hash)
+	if loaded && old.(string) != hash {
+		slog.Warn("PBFinderDelegate, the descriptors of %v changed, hash:%v -> %v", svcAndMethod, old, hash)
+	}
+}
+
 func (f *PBFinderDelegate) Find(svcAndMethod string) (*MethodInputOutput, error) {
 	slog.Debug("FilePBFinder, svcAndMethod:%v", svcAndMethod)
 	svc, method := parseSymbol(svcAndMethod)
@@ -78,6 +151,9 @@ func (f *PBFinderDelegate) Find(svcAndMethod string) (*MethodInputOutput, error)
 			svc, method, dsc)
 	}
 	mtd := sd.FindMethodByName(method)
+	if mtd == nil {
+		return nil, fmt.Errorf("service %v has no method %v", svc, method)
+	}
 	inType, err := getDataType(mtd.GetInputType())
 	if err != nil {
 		slog.Error("Find, svc:%v, method:%v, error:%v", svc, method, err)
@@ -100,8 +176,11 @@ func (f *PBFinderDelegate) GetDescriptorSource() grpcurl.DescriptorSource {
 }
 
 // NewFilePBFinder creates a PBFinder that resolves protobuf message types using the provided proto files.
-func NewFilePBFinder(protoFiles []string) PBFinder {
-	ds, err := grpcurl.DescriptorSourceFromProtoFiles(nil, protoFiles...)
+// importPaths are used to locate the imported files, if absent, they are inferred from the proto files.
+// The directory of a proto file outside importPaths is used as an import path too.
+func NewFilePBFinder(protoFiles []string, importPaths ...string) PBFinder {
+	importPaths = withProtoFileDirs(importPaths, protoFiles)
+	ds, err := grpcurl.DescriptorSourceFromProtoFiles(importPaths, protoFiles...)
 	if err != nil {
 		slog.Fatal("NewFilePBFinder, %v", err)
 	}
@@ -109,20 +188,241 @@ func NewFilePBFinder(protoFiles []string) PBFinder {
 	return NewPBFinderDelegate(ds)
 }
 
-// NewReflectionPBFinder creates a PBFinder that uses gRPC server reflection to resolve protobuf message types for services at the specified address.
-func NewReflectionPBFinder(addr string) PBFinder {
-	ctx := context.Background()
-	cc, err := grpcurl.BlockingDial(ctx, "tcp", addr, nil)
+// withProtoFileDirs appends the directories of the proto files which don't reside in any of importPaths,
+// they are tried after importPaths
+func withProtoFileDirs(importPaths []string, protoFiles []string) []string {
+	if len(importPaths) <= 0 {
+		return importPaths
+	}
+	result := slices.Clone(importPaths)
+	for _, file := range protoFiles {
+		if _, err := protoparse.ResolveFilenames(result, file); err == nil {
+			continue
+		}
+		dir := filepath.Dir(file)
+		slog.Info("%v is not under any import path, add %v", file, dir)
+		result = append(result, dir)
+	}
+	return result
+}
+
+// NewProtoSetPBFinder creates a PBFinder from files containing an encoded FileDescriptorSet,
+// such as those produced by `buf build -o xxx.binpb` or `protoc --include_imports -o xxx.protoset`.
+func NewProtoSetPBFinder(protoSetFiles []string) PBFinder {
+	ds, err := grpcurl.DescriptorSourceFromProtoSets(protoSetFiles...)
 	if err != nil {
-		slog.Fatal("NewReflectionPBFinder,addr:%v, error:%v, enable grpc reflection service?",
-			addr, err)
+		slog.Fatal("NewProtoSetPBFinder, %v", err)
 	}
-	refClient := grpcreflect.NewClientV1Alpha(ctx, reflectpb.NewServerReflectionClient(cc))
-	ds := grpcurl.DescriptorSourceFromServer(ctx, refClient)
 
 	return NewPBFinderDelegate(ds)
 }
 
+// NewReflectionPBFinder creates a PBFinder that uses gRPC server reflection to resolve protobuf message types for services at the specified address.
+// The connection is established lazily and re-established with backoff, the server may start later than grpcr.
+// It is plaintext unless opts specify the transport credentials.
+func NewReflectionPBFinder(addr string, opts ...grpc.DialOption) PBFinder {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	cc, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		slog.Fatal("NewReflectionPBFinder,addr:%v, error:%v", addr, err)
+	}
+	return NewPBFinderDelegate(NewReflectionDescSource(context.Background(), cc))
+}
+
+// IsUnavailable checks whether the error is caused by a server that can't be reached,
+// the same operation is likely to succeed later
+func IsUnavailable(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.Unavailable
+}
+
+// NewReflectionDescSource creates a DescriptorSource backed by the reflection service of the server.
+// grpc.reflection.v1 is tried first, if the server returns Unimplemented, it falls back to grpc.reflection.v1alpha.
+// The descriptors are downloaded again after DescriptorTTL or when refreshed.
+func NewReflectionDescSource(ctx context.Context, cc grpc.ClientConnInterface) *ReflectionDescSource {
+	var s ReflectionDescSource
+	s.ctx = ctx
+	s.cc = cc
+	s.current.Store(s.newSource())
+	return &s
+}
+
+// ReflectionDescSource is a grpcurl.DescriptorSource backed by the reflection service.
+// The reflection client caches the downloaded files forever, so it is replaced to refresh the descriptors.
+type ReflectionDescSource struct {
+	ctx     context.Context
+	cc      grpc.ClientConnInterface
+	current atomic.Pointer[reflectionSource]
+	mu      sync.Mutex
+}
+
+type reflectionSource struct {
+	client  *grpcreflect.Client
+	ds      grpcurl.DescriptorSource
+	created time.Time
+}
+
+func (s *ReflectionDescSource) newSource() *reflectionSource {
+	client := grpcreflect.NewClientAuto(s.ctx, s.cc)
+	return &reflectionSource{
+		client:  client,
+		ds:      grpcurl.DescriptorSourceFromServer(s.ctx, client),
+		created: time.Now(),
+	}
+}
+
+func (s *ReflectionDescSource) source() grpcurl.DescriptorSource {
+	current := s.current.Load()
+	if DescriptorTTL > 0 && time.Since(current.created) >= DescriptorTTL {
+		s.Refresh()
+		current = s.current.Load()
+	}
+	return current.ds
+}
+
+func (s *ReflectionDescSource) Refresh() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.current.Load()
+	if time.Since(old.created) < minRefreshInterval {
+		return false
+	}
+	s.current.Store(s.newSource())
+	// close the stream of the old client, the descriptors it returned are still valid
+	old.client.Reset()
+	slog.Debug("ReflectionDescSource.Refresh, descriptors downloaded at %v are discarded", old.created)
+	return true
+}
+
+// checkErr replaces the reflection client if the server can't be reached.
+// The client falls back to v1alpha when v1 is unavailable and sticks to it for an hour,
+// a server that supports only v1 would be unusable after it is started.
+func (s *ReflectionDescSource) checkErr(err error) {
+	if IsUnavailable(err) {
+		s.Refresh()
+	}
+}
+
+func (s *ReflectionDescSource) ListServices() ([]string, error) {
+	svcList, err := s.source().ListServices()
+	s.checkErr(err)
+	return svcList, err
+}
+
+func (s *ReflectionDescSource) FindSymbol(fullyQualifiedName string) (desc.Descriptor, error) {
+	d, err := s.source().FindSymbol(fullyQualifiedName)
+	s.checkErr(err)
+	return d, err
+}
+
+func (s *ReflectionDescSource) AllExtensionsForType(typeName string) ([]*desc.FieldDescriptor, error) {
+	fields, err := s.source().AllExtensionsForType(typeName)
+	s.checkErr(err)
+	return fields, err
+}
+
+// CompositePBFinder tries several PBFinders in order,
+// e.g. reflection on several addresses, proto files and descriptor sets.
+type CompositePBFinder struct {
+	finders []PBFinder
+}
+
+// NewCompositePBFinder creates a PBFinder that returns the result of the first finder which knows the method.
+func NewCompositePBFinder(finders ...PBFinder) *CompositePBFinder {
+	var f CompositePBFinder
+	f.finders = finders
+	return &f
+}
+
+func (f *CompositePBFinder) Get(svcAndMethod string) (*MethodInputOutput, error) {
+	errList := make([]error, 0, len(f.finders))
+	for _, finder := range f.finders {
+		m, err := finder.Get(svcAndMethod)
+		if err == nil {
+			return m, nil
+		}
+		errList = append(errList, err)
+	}
+	return nil, fmt.Errorf("CompositePBFinder, svcAndMethod:%v, error:%w", svcAndMethod, errors.Join(errList...))
+}
+
+func (f *CompositePBFinder) Refresh(svcAndMethod string) bool {
+	refreshed := false
+	for _, finder := range f.finders {
+		if finder.Refresh(svcAndMethod) {
+			refreshed = true
+		}
+	}
+	return refreshed
+}
+
+func (f *CompositePBFinder) GetDescriptorSource() grpcurl.DescriptorSource {
+	sources := make([]grpcurl.DescriptorSource, 0, len(f.finders))
+	for _, finder := range f.finders {
+		sources = append(sources, finder.GetDescriptorSource())
+	}
+	return &compositeDescSource{sources: sources}
+}
+
+// compositeDescSource is a grpcurl.DescriptorSource backed by several descriptor sources
+type compositeDescSource struct {
+	sources []grpcurl.DescriptorSource
+}
+
+func (s *compositeDescSource) Refresh() bool {
+	refreshed := false
+	for _, source := range s.sources {
+		if r, ok := source.(DescSourceRefresher); ok && r.Refresh() {
+			refreshed = true
+		}
+	}
+	return refreshed
+}
+
+func (s *compositeDescSource) ListServices() ([]string, error) {
+	set := util.NewStringSet()
+	var lastErr error
+	for _, source := range s.sources {
+		svcList, err := source.ListServices()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		set.AddAll(svcList)
+	}
+	if set.Size() <= 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	svcList := set.ToArray()
+	sort.Strings(svcList)
+	return svcList, nil
+}
+
+func (s *compositeDescSource) FindSymbol(fullyQualifiedName string) (desc.Descriptor, error) {
+	var lastErr error
+	for _, source := range s.sources {
+		d, err := source.FindSymbol(fullyQualifiedName)
+		if err == nil {
+			return d, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *compositeDescSource) AllExtensionsForType(typeName string) ([]*desc.FieldDescriptor, error) {
+	var lastErr error
+	for _, source := range s.sources {
+		fields, err := source.AllExtensionsForType(typeName)
+		if err == nil {
+			return fields, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
 // getDataType converts a desc.MessageDescriptor to a protoreflect.MessageDescriptor, including all dependencies.
 // Returns an error if the conversion fails or the descriptor cannot be found.
 func getDataType(dataType *desc.MessageDescriptor) (protoreflect.MessageDescriptor, error) {
@@ -147,6 +447,34 @@ func getDataType(dataType *desc.MessageDescriptor) (protoreflect.MessageDescript
 	return pfmd, nil
 }
 
+// GetFileDescriptorSet returns the file which defines the service of the method, along with all its dependencies
+func GetFileDescriptorSet(ds grpcurl.DescriptorSource, svcAndMethod string) (*descriptorpb.FileDescriptorSet, error) {
+	fd, err := FindMethodFile(ds, svcAndMethod)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileDescriptorSet(fd), nil
+}
+
+// FindMethodFile returns the file which defines the service of the method.
+// The descriptor source returns the same object until its descriptors are refreshed.
+func FindMethodFile(ds grpcurl.DescriptorSource, svcAndMethod string) (*desc.FileDescriptor, error) {
+	svc, method := parseSymbol(svcAndMethod)
+	dsc, err := ds.FindSymbol(svc)
+	if err != nil {
+		return nil, fmt.Errorf("descSource.FindSymbol,service:%v,method:%v,error:%w", svc, method, err)
+	}
+	return dsc.GetFile(), nil
+}
+
+// NewFileDescriptorSet returns the file along with all its dependencies
+func NewFileDescriptorSet(fd *desc.FileDescriptor) *descriptorpb.FileDescriptorSet {
+	strSet := util.NewStringSet()
+	fdSet := &descriptorpb.FileDescriptorSet{}
+	constructFileDescriptorSet(strSet, fdSet, fd)
+	return fdSet
+}
+
 func parseSymbol(svcAndMethod string) (string, string) {
 	if svcAndMethod[0] == '/' {
 		svcAndMethod = svcAndMethod[1:]
@@ -1,9 +1,13 @@
 package http2
 
 import (
+	"errors"
+	"github.com/fullstorydev/grpcurl"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -23,6 +27,82 @@ func TestFilePBFinder(t *testing.T) {
 
 }
 
+func TestFilePBFinderImportPath(t *testing.T) {
+	finder := NewFilePBFinder([]string{"testdata/search.proto"}, ".")
+	protoMsg, err := finder.Get("/SearchService/Search")
+	assert.Nil(t, err, "get /SearchService/Search")
+	assert.Equal(t, "SearchRequest", string(protoMsg.InType.ProtoReflect().Descriptor().FullName()))
+
+	_, err = finder.Get("/SearchService/NotExist")
+	assert.NotNil(t, err)
+}
+
+func TestFilePBFinderOutsideImportPath(t *testing.T) {
+	importDir, protoDir := t.TempDir(), t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(importDir, "lib"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(importDir, "lib", "common.proto"), []byte(`syntax = "proto3";
+message EchoRequest {
+    string name = 1;
+}
+`), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(protoDir, "echo.proto"), []byte(`syntax = "proto3";
+import "lib/common.proto";
+service EchoService {
+    rpc Echo(EchoRequest) returns (EchoRequest) {}
+}
+`), 0644))
+
+	// echo.proto doesn't reside in the import path
+	finder := NewFilePBFinder([]string{filepath.Join(protoDir, "echo.proto")}, importDir)
+	protoMsg, err := finder.Get("/EchoService/Echo")
+	assert.Nil(t, err)
+	assert.Equal(t, "EchoRequest", string(protoMsg.InType.ProtoReflect().Descriptor().FullName()))
+}
+
+func TestProtoSetPBFinder(t *testing.T) {
+	ds, err := grpcurl.DescriptorSourceFromProtoFiles(nil, "./testdata/search.proto")
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "search.protoset")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	err = grpcurl.WriteProtoset(f, ds, "SearchService")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	finder := NewProtoSetPBFinder([]string{path})
+	protoMsg, err := finder.Get("/SearchService/SendMuchData")
+	assert.Nil(t, err, "get /SearchService/SendMuchData")
+	assert.Equal(t, "MuchResponse", string(protoMsg.OutType.ProtoReflect().Descriptor().FullName()))
+}
+
+type errPBFinder struct{}
+
+func (f *errPBFinder) Get(svcAndMethod string) (*MethodInputOutput, error) {
+	return nil, errors.New("not found")
+}
+
+func (f *errPBFinder) GetDescriptorSource() grpcurl.DescriptorSource {
+	return nil
+}
+
+func (f *errPBFinder) Refresh(svcAndMethod string) bool {
+	return false
+}
+
+func TestCompositePBFinder(t *testing.T) {
+	files := []string{"./testdata/common.proto", "./testdata/search.proto",
+		"./testdata/another/department.proto"}
+	finder := NewCompositePBFinder(&errPBFinder{}, NewFilePBFinder(files))
+	protoMsg, err := finder.Get("/SearchService/CurrentTime")
+	assert.Nil(t, err, "get /SearchService/CurrentTime")
+	assert.Equal(t, "TimeRequest", string(protoMsg.InType.ProtoReflect().Descriptor().FullName()))
+
+	finder = NewCompositePBFinder(&errPBFinder{}, &errPBFinder{})
+	_, err = finder.Get("/SearchService/CurrentTime")
+	assert.NotNil(t, err)
+}
+
 func toJsonStr(pbMsg proto.Message) (string, error) {
 	result, err := protojson.Marshal(pbMsg)
 	if err != nil {
@@ -30,3 +110,55 @@ func toJsonStr(pbMsg proto.Message) (string, error) {
 	}
 	return string(result), nil
 }
+
+// swapDescSource simulates a server which deploys a new schema
+type swapDescSource struct {
+	grpcurl.DescriptorSource
+	next grpcurl.DescriptorSource
+}
+
+func (s *swapDescSource) Refresh() bool {
+	if s.next == nil {
+		return false
+	}
+	s.DescriptorSource, s.next = s.next, nil
+	return true
+}
+
+func TestPBFinderRefresh(t *testing.T) {
+	newSource := func(content string) grpcurl.DescriptorSource {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, "echo.proto"), []byte(content), 0644)
+		assert.Nil(t, err)
+		ds, err := grpcurl.DescriptorSourceFromProtoFiles([]string{dir}, "echo.proto")
+		assert.Nil(t, err)
+		return ds
+	}
+	v1 := newSource(`syntax = "proto3";
+service Echo { rpc Say(Req) returns (Req) {} }
+message Req { string name = 1; }`)
+	v2 := newSource(`syntax = "proto3";
+service Echo { rpc Say(Req) returns (Req) {} }
+message Req { string name = 1; Item item = 2; }
+message Item { int32 age = 1; }`)
+
+	// encoded with the new schema
+	newFinder := NewPBFinderDelegate(v2)
+	protoMsg, err := newFinder.Get("/Echo/Say")
+	assert.Nil(t, err)
+	err = protojson.Unmarshal([]byte(`{"name":"jack","item":{"age":3}}`), protoMsg.InType)
+	assert.Nil(t, err)
+	data, err := proto.Marshal(protoMsg.InType)
+	assert.Nil(t, err)
+
+	finder := NewPBFinderDelegate(&swapDescSource{DescriptorSource: v1, next: v2})
+	_, stale, err := decodeWithFinder(finder, "/Echo/Say", true, data)
+	assert.Nil(t, err)
+	assert.True(t, stale)
+
+	str, err := decodeMessage(finder, "/Echo/Say", true, data)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name":"jack","item":{"age":3}}`, str)
+	// nothing left to refresh
+	assert.False(t, finder.Refresh("/Echo/Say"))
+}
@@ -1,20 +1,73 @@
 package http2
 
 import (
+	"container/list"
 	fsm "github.com/smallnest/gofsm"
+	"github.com/vearne/grpcreplay/metrics"
 	"github.com/vearne/grpcreplay/protocol"
 	slog "github.com/vearne/simplelog"
 	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// connections without any packet for ConnIdleTimeout are considered closed,
+	// in case FIN or RST was not captured
+	ConnIdleTimeout = 10 * time.Minute
+)
+
+const connCleanInterval = 30 * time.Second
+
+// the processors of the RAWInputs, they are inspected when the metrics are scraped
+var processors sync.Map
+
+func init() {
+	metrics.RegisterGaugeFunc("http2_connections", "The live HTTP/2 connections being captured.", func() float64 {
+		var count int
+		processors.Range(func(key, _ any) bool {
+			count += key.(*Processor).ConnCount()
+			return true
+		})
+		return float64(count)
+	})
+	metrics.RegisterGaugeFunc("tcp_buffer_bytes", "The bytes kept in the TCPBuffers of the connections.", func() float64 {
+		var size int64
+		processors.Range(func(key, _ any) bool {
+			size += key.(*Processor).BufferedBytes()
+			return true
+		})
+		return float64(size)
+	})
+}
+
+const (
+	// the maximum number of messages waiting for the descriptors, the oldest are dropped beyond it
+	maxPendingMessages = 10000
+	pendingRetryMin    = time.Second
+	pendingRetryMax    = 30 * time.Second
 )
 
 type Processor struct {
-	ConnStates      map[DirectConn]*TCPConnectionState
+	// only accessed by the goroutine running ProcessTCPPkg
+	ConnStates map[DirectConn]*TCPConnectionState
+	// Http2Conn may remove itself after receiving GOAWAY
+	connMu          sync.RWMutex
 	ConnRepository  map[DirectConn]*Http2Conn
 	InputChan       chan *NetPkg
 	OutputChan      chan *protocol.Message
 	Finder          PBFinder
 	RecordResponse  bool
 	TCPStateMachine *fsm.StateMachine
+
+	// messages waiting for the descriptors, e.g. the reflection service is not started yet
+	pendingMu sync.Mutex
+	pending   *list.List
+	// number of pending messages of each method, the order is kept per method
+	pendingMethods map[string]int
+	retrying       bool
+	closeOnce      sync.Once
+	closeChan      chan struct{}
 }
 
 // NewProcessor creates and initializes a new Processor for handling HTTP/2 packet processing and TCP connection state management.
@@ -27,51 +80,328 @@ func NewProcessor(input chan *NetPkg, recordResponse bool, finder PBFinder) *Pro
 	p.Finder = finder
 	p.RecordResponse = recordResponse
 	p.TCPStateMachine = InitTCPFSM(&TCPEventProcessor{})
+	p.pending = list.New()
+	p.pendingMethods = make(map[string]int)
+	p.closeChan = make(chan struct{})
+	processors.Store(&p, struct{}{})
 	slog.Info("create new Processor")
 	return &p
 }
 
 func (p *Processor) ProcessTCPPkg() {
+	ticker := time.NewTicker(connCleanInterval)
+	defer ticker.Stop()
+
 	// need to handle both inbound and outbound traffic
-	for pkg := range p.InputChan {
-		payload := pkg.TCP.Payload
-		dc := pkg.DirectConn()
-		slog.Debug("Connection:%v, seq:%v, length:%v", dc.String(), pkg.TCP.Seq, len(payload))
+	for {
+		select {
+		case pkg, ok := <-p.InputChan:
+			if !ok {
+				return
+			}
+			p.processTCPPkg(pkg)
+		case <-ticker.C:
+			p.cleanIdleConns()
+		}
+	}
+}
+
+func (p *Processor) processTCPPkg(pkg *NetPkg) {
+	payload := pkg.TCP.Payload
+	dc := pkg.DirectConn()
+	slog.Debug("Connection:%v, seq:%v, length:%v", dc.String(), pkg.TCP.Seq, len(payload))
+
+	if pkg.Direction == DirOutcoming {
+		dc = dc.Reverse()
+	}
+	ts, exist := p.ConnStates[dc]
+	if !exist {
+		p.ConnStates[dc] = NewTCPConnection(dc)
+		ts = p.ConnStates[dc]
+	}
+	ts.LastActive = time.Now()
+	// try to handling connection status
+	err := p.handleConnectionState(ts, pkg)
+	if err != nil {
+		slog.Warn("TCPStateMachine.Trigger, %v", err)
+	}
 
-		if pkg.Direction == DirOutcoming {
-			dc = dc.Reverse()
+	// data
+	if ts.State == StateEstablished && len(payload) > 0 {
+		if pkg.Direction == DirIncoming {
+			p.ProcessIncomingTCPPkg(pkg)
+		} else if p.RecordResponse && pkg.Direction == DirOutcoming {
+			p.ProcessOutComingTCPPkg(pkg)
 		}
-		ts, exist := p.ConnStates[dc]
-		if !exist {
-			p.ConnStates[dc] = NewTCPConnection(dc)
-			ts = p.ConnStates[dc]
+	}
+}
+
+// cleanIdleConns removes the connections whose FIN or RST was missed
+func (p *Processor) cleanIdleConns() {
+	for dc, ts := range p.ConnStates {
+		if time.Since(ts.LastActive) < ConnIdleTimeout {
+			continue
 		}
-		// try to handling connection status
-		err := p.handleConnectionState(ts, pkg)
-		if err != nil {
-			slog.Warn("TCPStateMachine.Trigger, %v", err)
+		slog.Info("connection idle timeout, DirectConn:%v, state:%v", dc.String(), ts.State)
+		delete(p.ConnStates, dc)
+		p.RemoveConn(dc)
+	}
+	slog.Debug("len(ConnStates):%v, live connections:%v", len(p.ConnStates), p.ConnCount())
+}
+
+func (p *Processor) getConn(dc DirectConn) (*Http2Conn, bool) {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+
+	hc, ok := p.ConnRepository[dc]
+	return hc, ok
+}
+
+func (p *Processor) addConn(dc DirectConn, hc *Http2Conn) {
+	p.connMu.Lock()
+	old, ok := p.ConnRepository[dc]
+	p.ConnRepository[dc] = hc
+	p.connMu.Unlock()
+
+	// the 4-tuple has been reused
+	if ok {
+		old.Close()
+	}
+}
+
+// RemoveConn removes the Http2Conn and releases its goroutines and buffers
+func (p *Processor) RemoveConn(dc DirectConn) {
+	p.connMu.Lock()
+	hc, ok := p.ConnRepository[dc]
+	delete(p.ConnRepository, dc)
+	p.connMu.Unlock()
+
+	if ok {
+		hc.Close()
+	}
+}
+
+// ConnCount returns the number of live HTTP/2 connections
+func (p *Processor) ConnCount() int {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+
+	return len(p.ConnRepository)
+}
+
+// BufferedBytes returns the number of bytes in the TCPBuffers of the live connections
+func (p *Processor) BufferedBytes() int64 {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+
+	var size int64
+	for _, hc := range p.ConnRepository {
+		size += hc.Input.TCPBuffer.Size() + hc.Output.TCPBuffer.Size()
+	}
+	return size
+}
+
+// Close closes all HTTP/2 connections
+func (p *Processor) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+		processors.Delete(p)
+	})
+
+	p.connMu.Lock()
+	conns := p.ConnRepository
+	p.ConnRepository = make(map[DirectConn]*Http2Conn)
+	p.connMu.Unlock()
+
+	for _, hc := range conns {
+		hc.Close()
+	}
+}
+
+// emit decodes the message and sends it to OutputChan.
+// If the descriptors are unavailable, the message is kept and decoded again later.
+// The messages of the other methods are not held up.
+func (p *Processor) emit(raw *rawMessage) {
+	p.pendingMu.Lock()
+	if p.pendingMethods[raw.msg.Method] > 0 {
+		// keep the order of the messages of the method
+		p.addPendingLocked(raw)
+		p.pendingMu.Unlock()
+		return
+	}
+	p.pendingMu.Unlock()
+
+	msg, err := raw.decode(p.Finder)
+	if err == nil {
+		metrics.StreamsDecoded.WithLabelValues(msg.Method).Inc()
+		p.OutputChan <- msg
+		return
+	}
+	if !IsUnavailable(err) {
+		slog.Warn("decode, method:%v, error:%v", raw.msg.Method, err)
+		metrics.StreamsFailed.WithLabelValues(p.methodLabel(raw.msg.Method), metrics.ReasonDescriptor).Inc()
+		return
+	}
+
+	p.pendingMu.Lock()
+	p.addPendingLocked(raw)
+	p.pendingMu.Unlock()
+}
+
+// methodLabel returns the method label of StreamsFailed,
+// MethodUnknown if the method is not known to the descriptors
+func (p *Processor) methodLabel(method string) string {
+	if _, err := p.Finder.Get(method); err != nil {
+		return metrics.MethodUnknown
+	}
+	return method
+}
+
+func (p *Processor) addPendingLocked(raw *rawMessage) {
+	if p.pendingMethods[raw.msg.Method] <= 0 {
+		slog.Warn("descriptors of %v are unavailable, messages are kept until they can be obtained",
+			raw.msg.Method)
+	}
+	if p.pending.Len() >= maxPendingMessages {
+		oldest := p.pending.Remove(p.pending.Front()).(*rawMessage)
+		oldest.dropped = true
+		p.removePendingMethodLocked(oldest.msg.Method)
+		slog.Warn("too many messages waiting for the descriptors, drop:%v", oldest.msg.Method)
+		// the descriptors have never known the method
+		metrics.StreamsFailed.WithLabelValues(metrics.MethodUnknown, metrics.ReasonPendingOverflow).Inc()
+	}
+
+	raw.detach()
+	p.pending.PushBack(raw)
+	p.pendingMethods[raw.msg.Method]++
+	if !p.retrying {
+		p.retrying = true
+		go p.retryPending()
+	}
+}
+
+func (p *Processor) removePendingMethodLocked(method string) {
+	p.pendingMethods[method]--
+	if p.pendingMethods[method] <= 0 {
+		delete(p.pendingMethods, method)
+	}
+}
+
+// retryPending decodes the pending messages, it exits when there is none.
+// Once the descriptors of a method are still unavailable,
+// its later messages are skipped in this round to keep their order.
+func (p *Processor) retryPending() {
+	backoff := pendingRetryMin
+	for {
+		p.pendingMu.Lock()
+		if p.pending.Len() <= 0 {
+			p.retrying = false
+			p.pendingMu.Unlock()
+			return
 		}
+		p.pendingMu.Unlock()
 
-		// data
-		if ts.State == StateEstablished && len(payload) > 0 {
-			if pkg.Direction == DirIncoming {
-				p.ProcessIncomingTCPPkg(pkg)
-			} else if p.RecordResponse && pkg.Direction == DirOutcoming {
-				p.ProcessOutComingTCPPkg(pkg)
+		if p.retryPendingRound() {
+			backoff = pendingRetryMin
+		}
+
+		p.pendingMu.Lock()
+		remaining := p.pending.Len()
+		p.pendingMu.Unlock()
+		if remaining <= 0 {
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-p.closeChan:
+			return
+		}
+		backoff = min(backoff*2, pendingRetryMax)
+	}
+}
+
+// retryPendingRound walks through the pending messages once,
+// it reports whether any message has left the queue.
+func (p *Processor) retryPendingRound() bool {
+	progress := false
+	blocked := make(map[string]struct{})
+
+	p.pendingMu.Lock()
+	e := p.pending.Front()
+	p.pendingMu.Unlock()
+	for e != nil {
+		raw := e.Value.(*rawMessage)
+		_, skip := blocked[raw.msg.Method]
+		p.pendingMu.Lock()
+		// a dropped message has been counted as pending_overflow
+		if skip || raw.dropped {
+			e = p.nextPendingLocked(e)
+			p.pendingMu.Unlock()
+			continue
+		}
+		p.pendingMu.Unlock()
+
+		msg, err := raw.decode(p.Finder)
+		if IsUnavailable(err) {
+			blocked[raw.msg.Method] = struct{}{}
+			p.pendingMu.Lock()
+			e = p.nextPendingLocked(e)
+			p.pendingMu.Unlock()
+			continue
+		}
+
+		p.pendingMu.Lock()
+		if raw.dropped {
+			// dropped while it was being decoded
+			e = p.nextPendingLocked(e)
+			p.pendingMu.Unlock()
+			continue
+		}
+		next := e.Next()
+		p.pending.Remove(e)
+		p.pendingMu.Unlock()
+		e = next
+		progress = true
+
+		if err != nil {
+			slog.Warn("decode, method:%v, error:%v", raw.msg.Method, err)
+			metrics.StreamsFailed.WithLabelValues(p.methodLabel(raw.msg.Method), metrics.ReasonDescriptor).Inc()
+		} else {
+			metrics.StreamsDecoded.WithLabelValues(msg.Method).Inc()
+			select {
+			case p.OutputChan <- msg:
+			case <-p.closeChan:
+				return progress
 			}
 		}
+		// the later messages of the method may skip the queue only after this one has been sent
+		p.pendingMu.Lock()
+		p.removePendingMethodLocked(raw.msg.Method)
+		p.pendingMu.Unlock()
+	}
+	return progress
+}
+
+// nextPendingLocked returns the element after e.
+// Next of an element dropped meanwhile is nil, the walk continues from the front of the queue,
+// the messages left in front of it have been tried in this round.
+func (p *Processor) nextPendingLocked(e *list.Element) *list.Element {
+	if e.Value.(*rawMessage).dropped {
+		return p.pending.Front()
 	}
+	return e.Next()
 }
 
 func (p *Processor) ProcessIncomingTCPPkg(pkg *NetPkg) {
 	dc := pkg.DirectConn()
 	payload := pkg.TCP.Payload
 
-	if _, ok := p.ConnRepository[dc]; !ok {
+	hc, ok := p.getConn(dc)
+	if !ok {
 		return
 	}
 
-	hc := p.ConnRepository[dc]
 	payloadSize := uint32(len(payload))
 
 	// connection preface
@@ -90,11 +420,11 @@ func (p *Processor) ProcessOutComingTCPPkg(pkg *NetPkg) {
 	slog.Debug("Connection:%v, seq:%v, length:%v", dc.String(), pkg.TCP.Seq, len(payload))
 
 	rDirect := dc.Reverse()
-	if _, ok := p.ConnRepository[rDirect]; !ok {
+	hc, ok := p.getConn(rDirect)
+	if !ok {
 		return
 	}
 
-	hc := p.ConnRepository[rDirect]
 	slog.Debug("[AddTCP]Connection:%v, seq:%v, length:%v", dc.String(), pkg.TCP.Seq, len(payload))
 	hc.Output.TCPBuffer.AddTCP(pkg.TCP)
 }
@@ -110,6 +440,15 @@ func (p *Processor) handleConnectionState(ts *TCPConnectionState, pkg *NetPkg) e
 	if len(pkg.TCP.Payload) > 0 {
 		return nil
 	}
+	if pkg.TCP.SYN {
+		if shift, ok := windowScale(pkg.TCP); ok {
+			if pkg.Direction == DirIncoming {
+				ts.ClientWindowScale = int(shift)
+			} else {
+				ts.ServerWindowScale = int(shift)
+			}
+		}
+	}
 	if pkg.Direction == DirIncoming && pkg.TCP.SYN {
 		return p.TCPStateMachine.Trigger(ts.State, EventReceiveSYN, ts, pkg, p)
 	} else if pkg.Direction == DirOutcoming && pkg.TCP.SYN && pkg.TCP.ACK {
@@ -0,0 +1,231 @@
+package http2
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/metrics"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessorCleanIdleConns(t *testing.T) {
+	p := NewProcessor(make(chan *NetPkg), false, nil)
+
+	var dc DirectConn
+	dc.SrcAddr.IP = "192.168.1.100"
+	dc.SrcAddr.Port = 51234
+	dc.DstAddr.IP = "192.168.1.101"
+	dc.DstAddr.Port = 35001
+
+	ts := NewTCPConnection(dc)
+	p.ConnStates[dc] = ts
+	// without DealInput and DealOutput
+	hc := &Http2Conn{DirectConn: dc, Processor: p}
+	hc.Input = NewMessageParser(http2initialHeaderTableSize)
+	hc.Output = NewMessageParser(http2initialHeaderTableSize)
+	for i := 0; i < StreamArraySize; i++ {
+		hc.Streams[i] = NewStream(false)
+	}
+	p.addConn(dc, hc)
+	assert.Equal(t, 1, p.ConnCount())
+
+	p.cleanIdleConns()
+	assert.Equal(t, 1, p.ConnCount(), "still active")
+
+	ts.LastActive = time.Now().Add(-ConnIdleTimeout)
+	p.cleanIdleConns()
+	assert.Equal(t, 0, p.ConnCount())
+	assert.Equal(t, 0, len(p.ConnStates))
+
+	_, err := hc.Input.TCPBuffer.Read(make([]byte, HeaderSize))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	// closing twice is harmless
+	hc.Close()
+}
+
+// unavailablePBFinder simulates a reflection service which is not started yet
+type unavailablePBFinder struct {
+	PBFinder
+	available atomic.Bool
+	// if set, only the descriptors of the method are unavailable
+	method string
+}
+
+func (f *unavailablePBFinder) Get(svcAndMethod string) (*MethodInputOutput, error) {
+	if !f.available.Load() && (f.method == "" || f.method == svcAndMethod) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	return f.PBFinder.Get(svcAndMethod)
+}
+
+func TestProcessorPendingMessages(t *testing.T) {
+	finder := &unavailablePBFinder{PBFinder: NewFilePBFinder([]string{"./testdata/search.proto"})}
+	p := NewProcessor(make(chan *NetPkg), false, finder)
+	defer p.Close()
+
+	stream := NewStream(false)
+	for i := 1; i <= 2; i++ {
+		stream.Request.Headers.Store(PseudoHeaderPath, "/SearchService/CurrentTime")
+		stream.Request.DataBuf.Write([]byte{0x08, byte(i)})
+		raw, err := stream.toRawMsg()
+		assert.Nil(t, err)
+		p.emit(raw)
+		// the buffer of the stream is reused
+		stream.Reset()
+	}
+
+	select {
+	case <-p.OutputChan:
+		t.Fatal("descriptors are unavailable")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	finder.available.Store(true)
+	for i := 1; i <= 2; i++ {
+		select {
+		case msg := <-p.OutputChan:
+			assert.JSONEq(t, fmt.Sprintf(`{"requestId":"%v"}`, i), msg.Request.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending messages are not decoded")
+		}
+	}
+}
+
+func TestProcessorPendingMessagesPerMethod(t *testing.T) {
+	finder := &unavailablePBFinder{
+		PBFinder: NewFilePBFinder([]string{"./testdata/search.proto"}),
+		method:   "/SearchService/CurrentTime",
+	}
+	p := NewProcessor(make(chan *NetPkg), false, finder)
+	defer p.Close()
+
+	stream := NewStream(false)
+	emit := func(method string, body []byte) {
+		stream.Request.Headers.Store(PseudoHeaderPath, method)
+		stream.Request.DataBuf.Write(body)
+		raw, err := stream.toRawMsg()
+		assert.Nil(t, err)
+		p.emit(raw)
+		stream.Reset()
+	}
+	receive := func() *protocol.Message {
+		select {
+		case msg := <-p.OutputChan:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not decoded")
+			return nil
+		}
+	}
+
+	emit("/SearchService/CurrentTime", []byte{0x08, 1})
+	// the healthy method is not held up by the pending one
+	emit("/SearchService/Search", []byte{0x0a, 0x01, 'a'})
+	msg := receive()
+	assert.JSONEq(t, `{"staffName":"a"}`, msg.Request.Body)
+	emit("/SearchService/CurrentTime", []byte{0x08, 3})
+	emit("/SearchService/Search", []byte{0x0a, 0x01, 'b'})
+	msg = receive()
+	assert.JSONEq(t, `{"staffName":"b"}`, msg.Request.Body)
+
+	finder.available.Store(true)
+	for _, requestId := range []int{1, 3} {
+		msg = receive()
+		assert.Equal(t, "/SearchService/CurrentTime", msg.Method)
+		assert.JSONEq(t, fmt.Sprintf(`{"requestId":"%v"}`, requestId), msg.Request.Body)
+	}
+}
+
+// gatedPBFinder holds up the first lookup after the descriptors become available
+type gatedPBFinder struct {
+	unavailablePBFinder
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (f *gatedPBFinder) Get(svcAndMethod string) (*MethodInputOutput, error) {
+	if f.available.Load() {
+		f.once.Do(func() {
+			close(f.entered)
+			<-f.release
+		})
+	}
+	return f.unavailablePBFinder.Get(svcAndMethod)
+}
+
+func TestProcessorPendingDroppedWhileDecoding(t *testing.T) {
+	finder := &gatedPBFinder{
+		unavailablePBFinder: unavailablePBFinder{PBFinder: NewFilePBFinder([]string{"./testdata/search.proto"})},
+		entered:             make(chan struct{}),
+		release:             make(chan struct{}),
+	}
+	p := NewProcessor(make(chan *NetPkg), false, finder)
+	defer p.Close()
+
+	stream := NewStream(false)
+	emit := func(requestId byte) {
+		stream.Request.Headers.Store(PseudoHeaderPath, "/SearchService/CurrentTime")
+		stream.Request.DataBuf.Write([]byte{0x08, requestId})
+		raw, err := stream.toRawMsg()
+		assert.Nil(t, err)
+		p.emit(raw)
+		stream.Reset()
+	}
+	emit(1)
+	for i := 1; i < maxPendingMessages; i++ {
+		emit(2)
+	}
+
+	finder.available.Store(true)
+	select {
+	case <-finder.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending messages are not retried")
+	}
+	// the message being decoded is dropped
+	emit(2)
+	close(finder.release)
+
+	timeout := time.After(pendingRetryMin / 2)
+	for i := 0; i < maxPendingMessages; i++ {
+		select {
+		case msg := <-p.OutputChan:
+			assert.JSONEq(t, `{"requestId":"2"}`, msg.Request.Body)
+		case <-timeout:
+			t.Fatalf("the round ends early, %v messages are received", i)
+		}
+	}
+}
+
+func TestProcessorFailedMethodLabel(t *testing.T) {
+	p := NewProcessor(make(chan *NetPkg), false, NewFilePBFinder([]string{"./testdata/search.proto"}))
+	defer p.Close()
+
+	failed := func(method string) float64 {
+		return testutil.ToFloat64(metrics.StreamsFailed.WithLabelValues(method, metrics.ReasonDescriptor))
+	}
+	unknown := failed(metrics.MethodUnknown)
+	search := failed("/SearchService/Search")
+
+	stream := NewStream(false)
+	for _, method := range []string{"/Random/Path", "/SearchService/Search"} {
+		stream.Request.Headers.Store(PseudoHeaderPath, method)
+		// not a valid protobuf message
+		stream.Request.DataBuf.Write([]byte{0xff})
+		raw, err := stream.toRawMsg()
+		assert.Nil(t, err)
+		p.emit(raw)
+		stream.Reset()
+	}
+	assert.Equal(t, unknown+1, failed(metrics.MethodUnknown))
+	assert.Equal(t, search+1, failed("/SearchService/Search"))
+	assert.Equal(t, float64(0), failed("/Random/Path"))
+}
@@ -3,6 +3,7 @@ package http2
 import (
 	"github.com/smallnest/gofsm"
 	slog "github.com/vearne/simplelog"
+	"time"
 )
 
 const (
@@ -38,6 +39,11 @@ type TCPConnectionState struct {
 	dc     DirectConn
 	State  string
 	States []string
+	// window scale options in SYN and SYN+ACK, -1 if absent
+	ClientWindowScale int
+	ServerWindowScale int
+	// the last time a packet of the connection was seen
+	LastActive time.Time
 }
 
 // NewTCPConnection creates a new TCPConnectionState initialized in the LISTEN state with the provided direct connection.
@@ -46,6 +52,9 @@ func NewTCPConnection(dc DirectConn) *TCPConnectionState {
 	t.dc = dc
 	t.State = StateListen
 	t.States = []string{StateListen}
+	t.ClientWindowScale = -1
+	t.ServerWindowScale = -1
+	t.LastActive = time.Now()
 	return &t
 }
 
@@ -83,7 +92,7 @@ func (p *TCPEventProcessor) OnEnter(toState string, args []interface{}) {
 	case StateEstablished:
 		p := args[2].(*Processor)
 		hc := NewHttp2Conn(ts.dc, http2initialHeaderTableSize, p)
-		p.ConnRepository[ts.dc] = hc
+		p.addConn(ts.dc, hc)
 		// set sequence
 		/*
 			    client --> server
@@ -93,12 +102,18 @@ func (p *TCPEventProcessor) OnEnter(toState string, args []interface{}) {
 		pkg := args[1].(*NetPkg)
 		hc.Input.TCPBuffer.SetExpectedSeq(pkg.TCP.Seq + 1)
 		hc.Output.TCPBuffer.SetExpectedSeq(pkg.TCP.Ack)
+		// window scaling is only in effect if both sides sent the option
+		// client -> server is limited by the window of the server, and vice versa
+		if ts.ClientWindowScale >= 0 && ts.ServerWindowScale >= 0 {
+			hc.Input.TCPBuffer.SetWindowScale(uint8(ts.ServerWindowScale))
+			hc.Output.TCPBuffer.SetWindowScale(uint8(ts.ClientWindowScale))
+		}
 
 		slog.Info("TCPEventProcessor connection [ESTABLISHED], DirectConn:%v", ts.dc.String())
 	case StateClosed:
 		p := args[2].(*Processor)
 		delete(p.ConnStates, ts.dc)
-		delete(p.ConnRepository, ts.dc)
+		p.RemoveConn(ts.dc)
 		slog.Info("TCPEventProcessor connection [CLOSED], DirectConn:%v", ts.dc.String())
 	}
 }
@@ -4,33 +4,63 @@ import (
 	"bytes"
 	"github.com/google/gopacket/layers"
 	"github.com/huandu/skiplist"
+	"github.com/vearne/grpcreplay/consts"
 	slog "github.com/vearne/simplelog"
-	"math"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const MaxWindowSize = 65536
 
+// RFC 7323: the shift count must not exceed 14
+const maxWindowScale = 14
+
+var (
+	// If the data in front of an out-of-order segment has not arrived within GapTimeout,
+	// it is considered lost and the buffer skips over the gap
+	GapTimeout = 3 * time.Second
+)
+
+// segment is a piece of TCP payload waiting to be delivered in order
+type segment struct {
+	// position of the first byte, relative to the start of the stream
+	offset  int64
+	payload []byte
+	arrival time.Time
+}
+
 type TCPBuffer struct {
 	//The number of bytes of data currently cached
 	size              atomic.Int64
 	actualCanReadSize atomic.Int64
-	List              *skiplist.SkipList
-	expectedSeq       uint32
+	// out-of-order segments, ordered by offset
+	List        *skiplist.SkipList
+	expectedSeq uint32
+	// offset of expectedSeq, it keeps growing when the sequence number wraps around
+	expectedOffset int64
+	// number of bytes in List
+	pendingSize  int64
+	windowScale  uint8
+	lastProgress time.Time
+	gapCount     atomic.Int64
 	//There is at most one reader to read
+	// a nil slice marks a gap in the stream
 	dataChannel chan []byte
 	closeChan   chan struct{}
+	closeOnce   sync.Once
 	buffer      *bytes.Buffer
 }
 
 // NewTCPBuffer creates and initializes a new TCPBuffer for managing ordered TCP packet delivery.
 func NewTCPBuffer() *TCPBuffer {
 	var sb TCPBuffer
-	sb.List = skiplist.New(skiplist.Uint32)
+	sb.List = skiplist.New(skiplist.Int64)
 	sb.size.Store(0)
 	sb.actualCanReadSize.Store(0)
 	sb.expectedSeq = 0
+	sb.lastProgress = time.Now()
 	sb.dataChannel = make(chan []byte, 100)
 	sb.closeChan = make(chan struct{})
 	sb.buffer = bytes.NewBuffer([]byte{})
@@ -38,11 +68,42 @@ func NewTCPBuffer() *TCPBuffer {
 }
 
 func (sb *TCPBuffer) SetExpectedSeq(expectedSeq uint32) {
+	// keep the offsets of the buffered segments consistent
+	sb.expectedOffset += int64(int32(expectedSeq - sb.expectedSeq))
 	sb.expectedSeq = expectedSeq
+	sb.lastProgress = time.Now()
+	sb.deliver()
+}
+
+// SetWindowScale sets the window scale negotiated in the SYN and SYN+ACK,
+// it determines how far ahead of expectedSeq a segment may be.
+func (sb *TCPBuffer) SetWindowScale(shift uint8) {
+	if shift > maxWindowScale {
+		shift = maxWindowScale
+	}
+	sb.windowScale = shift
+}
+
+func (sb *TCPBuffer) windowSize() uint32 {
+	return uint32(MaxWindowSize) << sb.windowScale
+}
+
+// Size returns the number of bytes kept in the buffer, including the out-of-order ones
+func (sb *TCPBuffer) Size() int64 {
+	return sb.size.Load()
 }
 
+// GapCount returns the number of unrecoverable gaps that have been skipped
+func (sb *TCPBuffer) GapCount() int64 {
+	return sb.gapCount.Load()
+}
+
+// Close marks the end of the stream, the reader still gets the data that has been queued
+// and then net.ErrClosed.
 func (sb *TCPBuffer) Close() {
-	close(sb.closeChan)
+	sb.closeOnce.Do(func() {
+		close(sb.closeChan)
+	})
 }
 
 // may block
@@ -60,14 +121,24 @@ func (sb *TCPBuffer) Read(p []byte) (n int, err error) {
 	}
 
 	// blocking util read success or error occur
+	var data []byte
 	select {
+	case data = <-sb.dataChannel:
 	case <-sb.closeChan:
-		return 0, net.ErrClosed
-	case data := <-sb.dataChannel:
-		if _, writeErr := sb.buffer.Write(data); writeErr != nil {
-			return 0, writeErr
+		// select picks a ready case randomly, drain the queued data before reporting EOF
+		select {
+		case data = <-sb.dataChannel:
+		default:
+			return 0, net.ErrClosed
 		}
 	}
+	if data == nil {
+		// all data before the gap has been read
+		return 0, consts.ErrTCPGap
+	}
+	if _, writeErr := sb.buffer.Write(data); writeErr != nil {
+		return 0, writeErr
+	}
 
 	n, err = sb.buffer.Read(p)
 	sb.updateCounters(n)
@@ -85,59 +156,136 @@ func (sb *TCPBuffer) AddTCP(tcpPkg *layers.TCP) {
 	slog.Debug("[start]SocketBuffer.addTCP, size:%v, actualCanReadSize:%v, expectedSeq:%v",
 		sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq)
 
-	// Discard packets outside the sliding window
-	if !validPackage(sb.expectedSeq, MaxWindowSize, tcpPkg.Seq) {
-		slog.Warn("[end]SocketBuffer.addTCP-discard packets outside the sliding window, "+
-			"size:%v, actualCanReadSize:%v, expectedSeq:%v",
-			sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq)
+	payload := tcpPkg.Payload
+	if len(payload) <= 0 {
 		return
 	}
 
-	// duplicate package
-	if sb.List.Get(tcpPkg.Seq) != nil {
-		slog.Warn("[end]SocketBuffer.addTCP-duplicate package, size:%v, actualCanReadSize:%v, expectedSeq:%v",
-			sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq)
+	// sequence numbers may wrap around
+	distance := int64(int32(tcpPkg.Seq - sb.expectedSeq))
+	if distance < 0 {
+		if distance+int64(len(payload)) <= 0 {
+			// retransmission of data that has been delivered, or a keep-alive probe
+			slog.Debug("[end]SocketBuffer.addTCP-retransmission or keep-alive, seq:%v, expectedSeq:%v",
+				tcpPkg.Seq, sb.expectedSeq)
+			return
+		}
+		// partially overlapping retransmission, only keep the new bytes
+		payload = payload[-distance:]
+		distance = 0
+	}
+
+	// Discard packets outside the sliding window,
+	// unless the stream has been stuck long enough that the missing bytes will never come
+	seq := sb.expectedSeq + uint32(distance)
+	if !validPackage(sb.expectedSeq, sb.windowSize(), seq) && time.Since(sb.lastProgress) < GapTimeout {
+		slog.Warn("[end]SocketBuffer.addTCP-discard packets outside the sliding window, "+
+			"size:%v, actualCanReadSize:%v, expectedSeq:%v, seq:%v",
+			sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq, tcpPkg.Seq)
 		return
 	}
 
-	ele := sb.List.Set(tcpPkg.Seq, tcpPkg)
-	sb.size.Add(int64(len(tcpPkg.Payload)))
-	needRemoveList := make([]*skiplist.Element, 0)
+	sb.insert(sb.expectedOffset+distance, payload)
+	sb.deliver()
+
+	slog.Debug("[end]SocketBuffer.addTCP, size:%v, actualCanReadSize:%v, expectedSeq:%v",
+		sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq)
+}
+
+func (sb *TCPBuffer) insert(offset int64, payload []byte) {
+	if ele := sb.List.Get(offset); ele != nil {
+		old := ele.Value.(*segment)
+		if len(old.payload) >= len(payload) {
+			slog.Debug("SocketBuffer.insert-duplicate package, offset:%v", offset)
+			return
+		}
+		// keep the longer one
+		sb.pendingSize -= int64(len(old.payload))
+		sb.size.Add(int64(-len(old.payload)))
+	}
+	sb.List.Set(offset, &segment{offset: offset, payload: payload, arrival: time.Now()})
+	sb.pendingSize += int64(len(payload))
+	sb.size.Add(int64(len(payload)))
+}
+
+// deliver pushes the segments that are in order to the reader.
+// Segments may overlap each other, the bytes that have already been delivered are trimmed.
+func (sb *TCPBuffer) deliver() {
+	for {
+		ele := sb.List.Front()
+		if ele == nil {
+			return
+		}
+		seg := ele.Value.(*segment)
+		if seg.offset > sb.expectedOffset {
+			if !sb.isGapUnrecoverable(seg) {
+				return
+			}
+			sb.skipGap(seg.offset)
+		}
+
+		sb.List.RemoveElement(ele)
+		sb.pendingSize -= int64(len(seg.payload))
+
+		skip := sb.expectedOffset - seg.offset
+		if skip >= int64(len(seg.payload)) {
+			// covered by the data that has been delivered
+			sb.size.Add(int64(-len(seg.payload)))
+			continue
+		}
+		sb.size.Add(-skip)
+		data := seg.payload[skip:]
 
-	for ele != nil && sb.expectedSeq == tcpPkg.Seq {
 		// expect next sequence number
-		// sequence numbers may wrap around
-		payloadSize := uint32(len(tcpPkg.Payload))
-		sb.actualCanReadSize.Add(int64(payloadSize))
-		sb.expectedSeq = (tcpPkg.Seq + payloadSize) % math.MaxUint32
+		sb.actualCanReadSize.Add(int64(len(data)))
+		sb.expectedOffset += int64(len(data))
+		sb.expectedSeq += uint32(len(data))
+		sb.lastProgress = time.Now()
 
 		// push to channel
-		sb.dataChannel <- tcpPkg.Payload
-		needRemoveList = append(needRemoveList, ele)
-
-		ele = sb.List.Get(sb.expectedSeq)
-		if ele != nil {
-			tcpPkg = ele.Value.(*layers.TCP)
+		select {
+		case sb.dataChannel <- data:
+		case <-sb.closeChan:
+			return
 		}
 	}
+}
+
+// isGapUnrecoverable checks whether the bytes in front of seg will never arrive.
+// The sender can't have more than one window of unacknowledged data,
+// so if more than that is buffered, the missing bytes have been acknowledged and we missed them.
+func (sb *TCPBuffer) isGapUnrecoverable(seg *segment) bool {
+	return sb.pendingSize > int64(sb.windowSize()) || time.Since(seg.arrival) >= GapTimeout
+}
 
-	// remove
-	for _, element := range needRemoveList {
-		sb.List.RemoveElement(element)
+// skipGap gives up on the missing bytes and continues from offset,
+// the reader is notified so that it can resynchronize with the HTTP/2 frames.
+func (sb *TCPBuffer) skipGap(offset int64) {
+	missing := offset - sb.expectedOffset
+	slog.Warn("SocketBuffer-unrecoverable gap, expectedSeq:%v, missing:%v bytes",
+		sb.expectedSeq, missing)
+
+	sb.gapCount.Add(1)
+	sb.expectedOffset = offset
+	sb.expectedSeq += uint32(missing)
+	select {
+	case sb.dataChannel <- nil:
+	case <-sb.closeChan:
 	}
+}
 
-	slog.Debug("[end]SocketBuffer.addTCP, size:%v, actualCanReadSize:%v, expectedSeq:%v",
-		sb.size.Load(), sb.actualCanReadSize.Load(), sb.expectedSeq)
+// windowScale returns the window scale option carried by a SYN or SYN+ACK
+func windowScale(tcpPkg *layers.TCP) (uint8, bool) {
+	for _, opt := range tcpPkg.Options {
+		if opt.OptionType == layers.TCPOptionKindWindowScale && len(opt.OptionData) > 0 {
+			return opt.OptionData[0], true
+		}
+	}
+	return 0, false
 }
 
 // validPackage checks if a packet sequence number falls within the valid window
 // considering 32-bit unsigned integer wrap-around.
 func validPackage(expectedSeq uint32, maxWindowSize uint32, pkgSeq uint32) bool {
-	rightBorder := (expectedSeq + maxWindowSize) % math.MaxUint32
-	// Handle wrap-around case
-	if rightBorder < expectedSeq {
-		return pkgSeq <= rightBorder || pkgSeq >= expectedSeq
-	}
-	// Normal case (no wrap-around)
-	return pkgSeq >= expectedSeq && pkgSeq <= rightBorder
+	return pkgSeq-expectedSeq <= maxWindowSize
 }
@@ -1,11 +1,16 @@
 package http2
 
 import (
+	"bytes"
+	"errors"
 	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/consts"
 	slog "github.com/vearne/simplelog"
 	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestSocketBufferSequence1(t *testing.T) {
@@ -260,3 +265,163 @@ func TestValidPackage(t *testing.T) {
 		assert.Equal(t, testCase.expected, actual, "Not consistent with expectations")
 	}
 }
+
+func TestSocketBufferOverlap(t *testing.T) {
+	slog.SetLevel(slog.DebugLevel)
+	buffer := NewTCPBuffer()
+	buffer.expectedSeq = 1000
+
+	var tcpPkgA layers.TCP
+	tcpPkgA.Seq = 1000
+	tcpPkgA.Payload = []byte("aaaaaaaaaa")
+
+	// retransmission which partially overlaps A
+	var tcpPkgB layers.TCP
+	tcpPkgB.Seq = 1005
+	tcpPkgB.Payload = []byte("aaaaabbbbb")
+
+	// out of order, overlaps B
+	var tcpPkgC layers.TCP
+	tcpPkgC.Seq = 1012
+	tcpPkgC.Payload = []byte("bbbcccccccccc")
+
+	// keep-alive probe
+	var tcpPkgD layers.TCP
+	tcpPkgD.Seq = 999
+	tcpPkgD.Payload = []byte("x")
+
+	buffer.AddTCP(&tcpPkgA)
+	buffer.AddTCP(&tcpPkgC)
+	buffer.AddTCP(&tcpPkgD)
+	buffer.AddTCP(&tcpPkgB)
+	buffer.AddTCP(&tcpPkgA)
+
+	buf := make([]byte, 1024)
+	n, err := io.ReadAtLeast(buffer, buf, 25)
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaaaaaaaabbbbbcccccccccc", string(buf[0:n]), "read data")
+	assert.Equal(t, uint32(1025), buffer.expectedSeq)
+	assert.Equal(t, 0, buffer.List.Len())
+}
+
+func TestSocketBufferGap(t *testing.T) {
+	slog.SetLevel(slog.DebugLevel)
+	buffer := NewTCPBuffer()
+	buffer.expectedSeq = 1000
+
+	var tcpPkgA layers.TCP
+	tcpPkgA.Seq = 1000
+	tcpPkgA.Payload = []byte("aaaaaaaaaa")
+
+	// 1010 ~ 1020 is lost
+	var tcpPkgC layers.TCP
+	tcpPkgC.Seq = 1020
+	tcpPkgC.Payload = []byte("cccccccccc")
+
+	var tcpPkgD layers.TCP
+	tcpPkgD.Seq = 1030
+	tcpPkgD.Payload = []byte("dddddddddd")
+
+	buffer.AddTCP(&tcpPkgA)
+	buffer.AddTCP(&tcpPkgC)
+	assert.Equal(t, int64(0), buffer.GapCount())
+
+	// the segment has waited long enough
+	buffer.List.Front().Value.(*segment).arrival = time.Now().Add(-GapTimeout)
+	buffer.AddTCP(&tcpPkgD)
+	assert.Equal(t, int64(1), buffer.GapCount())
+	assert.Equal(t, uint32(1040), buffer.expectedSeq)
+
+	buf := make([]byte, 10)
+	_, err := io.ReadFull(buffer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaaaaaaaa", string(buf))
+
+	_, err = io.ReadFull(buffer, buf)
+	assert.ErrorIs(t, err, consts.ErrTCPGap)
+
+	for _, str := range []string{"cccccccccc", "dddddddddd"} {
+		_, err = io.ReadFull(buffer, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, str, string(buf))
+	}
+}
+
+func TestSocketBufferClose(t *testing.T) {
+	buffer := NewTCPBuffer()
+	buffer.expectedSeq = 1000
+
+	var expected bytes.Buffer
+	for i := 0; i < 50; i++ {
+		var tcpPkg layers.TCP
+		tcpPkg.Seq = 1000 + uint32(i*10)
+		tcpPkg.Payload = bytes.Repeat([]byte{byte('a' + i%26)}, 10)
+		buffer.AddTCP(&tcpPkg)
+		expected.Write(tcpPkg.Payload)
+	}
+	// the connection is closed before the reader catches up
+	buffer.Close()
+
+	data, err := io.ReadAll(readUntilClosed{buffer})
+	assert.Nil(t, err)
+	assert.Equal(t, expected.String(), string(data))
+
+	_, err = buffer.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+// readUntilClosed turns net.ErrClosed into io.EOF
+type readUntilClosed struct {
+	r io.Reader
+}
+
+func (r readUntilClosed) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if errors.Is(err, net.ErrClosed) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestSocketBufferWindowScale(t *testing.T) {
+	buffer := NewTCPBuffer()
+	buffer.expectedSeq = 1000
+
+	var tcpPkgA layers.TCP
+	tcpPkgA.Seq = 1000 + MaxWindowSize*4
+	tcpPkgA.Payload = []byte("aaaaaaaaaa")
+
+	buffer.AddTCP(&tcpPkgA)
+	assert.Equal(t, 0, buffer.List.Len(), "outside the sliding window")
+
+	buffer.SetWindowScale(7)
+	buffer.AddTCP(&tcpPkgA)
+	assert.Equal(t, 1, buffer.List.Len(), "inside the scaled sliding window")
+}
+
+func TestWindowScale(t *testing.T) {
+	var tcpPkg layers.TCP
+	_, ok := windowScale(&tcpPkg)
+	assert.False(t, ok)
+
+	tcpPkg.Options = []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}
+	shift, ok := windowScale(&tcpPkg)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(7), shift)
+}
+
+func TestSeekFrameHeader(t *testing.T) {
+	// the tail of a DATA frame followed by a HEADERS frame
+	header := []byte{0x00, 0x00, 0x0a, FrameTypeHeader, 0x04, 0x00, 0x00, 0x00, 0x03}
+	data := append([]byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x10, 0xff}, header...)
+
+	buf, err := seekFrameHeader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, header, buf)
+
+	_, err = seekFrameHeader(bytes.NewReader([]byte{0xde, 0xad, 0xbe, 0xef, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/vearne/grpcreplay/balance"
 	"github.com/vearne/grpcreplay/biz"
 	"github.com/vearne/grpcreplay/config"
 	"github.com/vearne/grpcreplay/consts"
 	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/metrics"
 	"github.com/vearne/grpcreplay/util"
 	slog "github.com/vearne/simplelog"
 	"os"
@@ -34,6 +36,8 @@ func init() {
 		"print version")
 
 	flag.DurationVar(&settings.ExitAfter, "exit-after", 0, "exit after specified duration")
+	flag.StringVar(&settings.MetricsAddr, "metrics-addr", "",
+		`serve the Prometheus metrics on the address, e.g. ":9090" -> http://127.0.0.1:9090/metrics`)
 
 	// #################### input ######################
 	flag.Var(&config.MultiStringOption{Params: &settings.InputRAW}, "input-raw",
@@ -52,6 +56,14 @@ func init() {
 		--input-file-replay-speed=2
 	*/
 	flag.Float64Var(&settings.InputFileReplaySpeed, "input-file-replay-speed", 1, "")
+	flag.BoolVar(&settings.InputFileClosedLoop, "input-file-closed-loop", false,
+		`ignore the timestamps and read the messages as fast as the outputs accept them,
+				the capture is replayed over and over again, use it with --output-grpc-concurrency`)
+	flag.StringVar(&settings.InputFileLoadProfile, "input-file-load-profile", "",
+		`Json file of the stages of the replay rate, replaces --input-file-replay-speed.
+				"speed" is a multiple of the recorded rate, "rps" is a fixed rate, "ramp" changes the rate linearly
+				from the previous stage. The capture is replayed again if it runs out before the profile ends:
+				[{"duration":"1m","speed":1,"ramp":true},{"duration":"5m","speed":2},{"duration":"5m","rps":500}]`)
 
 	// input-rocketmq
 	flag.Var(&config.MultiStringOption{Params: &settings.InputRocketMQNameServer},
@@ -77,11 +89,145 @@ func init() {
 	flag.Var(&config.MultiStringOption{Params: &settings.OutputGRPC}, "output-grpc",
 		`Forwards incoming requests to given grpc address.
 			    # Redirect all incoming requests to xxx.com address
-                grpcr --input-raw="0.0.0.0:80" --output-grpc="grpc://xx.xx.xx.xx:35001")`)
+                grpcr --input-raw="0.0.0.0:80" --output-grpc="grpc://xx.xx.xx.xx:35001")
+			    # TLS, options: ca, cert, key, server-name, insecure-skip-verify, token-file, oauth-*
+                grpcr --input-raw="0.0.0.0:80" --output-grpc="grpcs://xx.com:443?ca=./ca.pem")`)
 
 	flag.IntVar(&settings.OutputGRPCWorkerNumber, "output-grpc-worker-number", 5,
 		"multiple workers call services concurrently")
 
+	flag.BoolVar(&settings.OutputGRPCResults, "output-grpc-results", false,
+		`Send the results of --output-grpc to the other outputs, e.g. --output-file-directory,
+				each result contains the request, the recorded response, the new response, the status and the latency`)
+
+	flag.Float64Var(&settings.OutputGRPCTimeoutScale, "output-grpc-timeout-scale", 1,
+		"the recorded grpc-timeout of a request is multiplied by it to get the deadline of the replayed call")
+	flag.DurationVar(&settings.OutputGRPCDefaultTimeout, "output-grpc-default-timeout", 30*time.Second,
+		"the deadline of the requests without grpc-timeout, so that a hung target doesn't hold a worker forever, 0 means no deadline")
+	flag.DurationVar(&settings.OutputGRPCMaxTimeout, "output-grpc-max-timeout", 0,
+		"the upper limit of the deadlines of the replayed calls, 0 means no limit")
+
+	flag.IntVar(&settings.OutputGRPCRetryMaxAttempts, "output-grpc-retry-max-attempts", 1,
+		"the calls failed with --output-grpc-retry-codes are retried, including the first call, no retry if it is less than 2")
+	flag.StringVar(&settings.OutputGRPCRetryCodes, "output-grpc-retry-codes", "UNAVAILABLE",
+		"comma separated status codes which are retried, e.g. UNAVAILABLE,RESOURCE_EXHAUSTED")
+	flag.DurationVar(&settings.OutputGRPCRetryBackoff, "output-grpc-retry-backoff", 100*time.Millisecond,
+		"the backoff before the first retry, doubled for each retry")
+	flag.DurationVar(&settings.OutputGRPCRetryMaxBackoff, "output-grpc-retry-max-backoff", 5*time.Second,
+		"the upper limit of the backoff")
+	flag.IntVar(&settings.OutputGRPCBreakerThreshold, "output-grpc-breaker-threshold", 0,
+		`the replay to a target is paused after the consecutive failed calls(UNAVAILABLE, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED),
+				0 means the circuit breaker is disabled`)
+	flag.DurationVar(&settings.OutputGRPCBreakerOpenTime, "output-grpc-breaker-open-time", 10*time.Second,
+		"how long the replay is paused before a probe call is sent to the target")
+	flag.StringVar(&settings.OutputGRPCDeadLetter, "output-grpc-dead-letter", "",
+		"the messages which fail to be replayed are written to the directory, they can be replayed again with --input-file-directory")
+
+	flag.StringVar(&settings.OutputGRPCOrderBy, "output-grpc-order-by", "",
+		`keep the order of the messages with the same key, the partitions are still sent concurrently.
+				"connection": the original connection of the client, "header:<name>": a request header,
+				"field:<path>": a field of the request body, e.g. field:account.id`)
+
+	flag.BoolVar(&settings.OutputGRPCNative, "output-grpc-native", false,
+		`send the unary calls with the cached descriptors and marshalled requests instead of grpcurl, for high throughput.
+				The responses are not printed to stdout, use --output-grpc-results with --output-stdout if needed`)
+
+	flag.IntVar(&settings.OutputGRPCConcurrency, "output-grpc-concurrency", 0,
+		"closed-loop replay, the number of calls in flight of each --output-grpc, replaces --output-grpc-worker-number")
+	flag.IntVar(&settings.OutputGRPCMaxConcurrency, "output-grpc-max-concurrency", 0,
+		`the concurrency is increased by --output-grpc-concurrency-step after each --output-grpc-concurrency-interval,
+				until the error rate or the latency crosses the threshold, to find the maximum sustainable throughput`)
+	flag.IntVar(&settings.OutputGRPCConcurrencyStep, "output-grpc-concurrency-step", 10, "")
+	flag.DurationVar(&settings.OutputGRPCConcurrencyInterval, "output-grpc-concurrency-interval", 10*time.Second,
+		"the throughput is measured over the interval")
+	flag.Float64Var(&settings.OutputGRPCMaxErrorRate, "output-grpc-max-error-rate", 1,
+		"the threshold of the error rate in percent")
+	flag.DurationVar(&settings.OutputGRPCMaxLatency, "output-grpc-max-latency", 0,
+		"the threshold of the 99th percentile latency, 0 means no limit")
+	flag.StringVar(&settings.OutputGRPCCapacityReport, "output-grpc-capacity-report", "",
+		`the throughput, error rate and latency of each concurrency are written to the json file,
+				the index of the output is appended to the name if there are several gRPC outputs`)
+	flag.StringVar(&settings.OutputGRPCReport, "output-grpc-report", "",
+		`the latency histograms, percentiles, throughput and status codes of each method are written on exit,
+				to the files with the prefix, e.g. "./report" -> ./report.txt, ./report.json, ./report.html`)
+	flag.DurationVar(&settings.OutputGRPCReportInterval, "output-grpc-report-interval", 0,
+		"a summary of the calls is printed at the interval, 0 means never")
+
+	flag.StringVar(&settings.OutputGRPCHeaderRules, "output-grpc-header-rules", "",
+		`Json file of the rules rewriting the request headers before replay, actions: add, set, remove, replace.
+				Values may reference ${peer}, ${uuid}, ${method} and ${env:NAME}:
+                [{"action":"set","header":"x-forwarded-for","value":"${peer}"},{"action":"remove","header":"authorization"}]`)
+
+	flag.StringVar(&settings.OutputGRPCRoutes, "output-grpc-routes", "",
+		`Json file of the routing table of --output-grpc, the first route whose method(regular expression) matches is used.
+				"target" sends the method to another server, "rewrite" renames it:
+                [{"method":"^/v1\\.SearchService/(.*)$","rewrite":"/v2.SearchService/$1","target":"grpc://xx.xx.xx.xx:35002"}]`)
+
+	flag.StringVar(&settings.OutputSampleRules, "output-sample-rules", "",
+		`Json file of the sampling rules of the outputs, "output" is an output flag, optionally with its value.
+				"key"(header:<name> or field:<path>) samples by its hash, so a given user is always in or out:
+                [{"output":"output-grpc=grpc://xx.xx.xx.xx:35001","percent":5,"key":"header:x-user-id"},
+                 {"output":"output-rocketmq-topic","percent":1,"methods":[{"method":"Search$","percent":10}]}]`)
+
+	flag.Var(&config.MultiStringOption{Params: &settings.OutputGRPCLBTargets}, "output-grpc-lb-target",
+		`The backends of an output among which the requests are balanced, host names are resolved to all their addresses.
+				The options of grpcs:// are taken from the first one, "weight" sets the weight of a backend:
+                grpcr --input-raw="0.0.0.0:80" --output-grpc-lb-target="grpc://pool.staging.svc:35001" --output-grpc-lb-target="grpc://xx.xx.xx.xx:35001?weight=3"`)
+
+	flag.StringVar(&settings.OutputGRPCLBPolicy, "output-grpc-lb-policy", "round_robin",
+		`Policy of --output-grpc-lb-target: round_robin | weighted | hash`)
+
+	flag.StringVar(&settings.OutputGRPCLBHashKey, "output-grpc-lb-hash-key", "",
+		`Key of the hash policy, so that the requests with the same key go to the same backend:
+                --output-grpc-lb-hash-key="header:x-user-id" or --output-grpc-lb-hash-key="field:user.id"`)
+
+	flag.DurationVar(&settings.OutputGRPCLBDNSRefresh, "output-grpc-lb-dns-refresh", 30*time.Second,
+		"The host names of --output-grpc-lb-target are resolved again after this duration")
+
+	flag.IntVar(&settings.OutputGRPCLBMaxFailures, "output-grpc-lb-max-failures", 5,
+		"A backend is ejected after this many consecutive failed calls, 0 means never")
+
+	flag.DurationVar(&settings.OutputGRPCLBEjectTime, "output-grpc-lb-eject-time", 30*time.Second,
+		"An ejected backend is not used for this duration, unless all backends are ejected")
+
+	flag.StringVar(&settings.OutputGRPCDiffFile, "output-grpc-diff-file", "",
+		`Compare the responses of --output-grpc with the recorded ones(see --record-response),
+				and append a diff record per call to the file:
+                grpcr --input-file-directory="/tmp/mycapture" --output-grpc="grpc://xx.xx.xx.xx:35001" --output-grpc-diff-file="./diff.log"`)
+
+	flag.Var(&config.MultiStringOption{Params: &settings.DiffIgnorePaths}, "diff-ignore-path",
+		`Fields that are not compared, "*" matches one element of the path and "**" any number of them:
+                --diff-ignore-path="header.requestId" --diff-ignore-path="items.*.updateTime"`)
+
+	flag.Float64Var(&settings.DiffFloatTolerance, "diff-float-tolerance", 0,
+		"Numbers are considered equal if they differ by no more than this")
+
+	flag.Var(&config.MultiStringOption{Params: &settings.DiffUnorderedPaths}, "diff-unordered-path",
+		`Repeated fields whose order doesn't matter, "**" for all of them`)
+
+	flag.StringVar(&settings.OutputShadowPrimary, "output-shadow-primary", "",
+		`Send each request to the primary(current build) and the candidate, and compare their responses:
+                grpcr --input-raw="0.0.0.0:80" --output-shadow-primary="grpc://xx.xx.xx.xx:35001" \
+                    --output-shadow-secondary="grpc://xx.xx.xx.xx:35002" --output-shadow-candidate="grpc://xx.xx.xx.xx:35003"`)
+
+	flag.StringVar(&settings.OutputShadowCandidate, "output-shadow-candidate", "",
+		"The build under test, see --output-shadow-primary")
+
+	flag.StringVar(&settings.OutputShadowSecondary, "output-shadow-secondary", "",
+		`(optional) Another instance of the current build,
+				the fields on which it differs from the primary are noise`)
+
+	flag.StringVar(&settings.OutputShadowReport, "output-shadow-report", "shadow-report.json",
+		"The mismatch rates of each method and field are written to the file periodically")
+
+	flag.Float64Var(&settings.OutputShadowRelativeThreshold, "output-shadow-relative-threshold", 20,
+		`A field is noisy unless the candidate differs from the primary on it
+				more often than the secondary by this percent of the differences`)
+
+	flag.Float64Var(&settings.OutputShadowAbsoluteThreshold, "output-shadow-absolute-threshold", 0.03,
+		`A field is noisy unless the candidate differs from the primary on it
+				more often than the secondary by this percent of the requests`)
+
 	flag.Var(&config.MultiStringOption{Params: &settings.OutputFileDir},
 		"output-file-directory",
 		`Write incoming requests to file:
@@ -106,6 +252,12 @@ func init() {
 	flag.IntVar(&settings.RateLimitQPS, "rate-limit-qps", -1,
 		`the capture rate per second limit for Query`)
 
+	// transform
+	flag.StringVar(&settings.TransformRules, "transform-rules", "",
+		`Json file of the rules editing the request bodies before they are sent to the outputs,
+				actions: set, delete, map(values from a mapping file), shift(time fields):
+                [{"path":"user_id","action":"map","mappingFile":"./users.json"},{"path":"items.*.expire_time","action":"shift"}]`)
+
 	// rocketmq
 	flag.Var(&config.MultiStringOption{Params: &settings.OutputRocketMQNameServer},
 		"output-rocketmq-name-server",
@@ -126,10 +278,32 @@ func init() {
 	flag.StringVar(&settings.ProtoFileStr, "proto", "",
 		"(optional) proto source file or the directory containing the proto file.")
 
+	flag.Var(&config.MultiStringOption{Params: &settings.ProtoImportPaths}, "proto-import-path",
+		`(optional) the path to a directory from which proto imports can be resolved,
+				it can be specified multiple times. The directory of a --proto file outside the import paths is added`)
+
+	flag.Var(&config.MultiStringOption{Params: &settings.ProtoSetFiles}, "protoset",
+		`(optional) a file containing an encoded FileDescriptorSet, it can be specified multiple times:
+				buf build -o image.binpb
+				protoc --include_imports -o service.protoset xxx.proto`)
+
+	flag.Var(&config.MultiStringOption{Params: &settings.ReflectionAddr}, "reflection-addr",
+		`(optional) additional gRPC reflection services used to find the definition of methods,
+				useful when several services are captured or replayed:
+				--reflection-addr="127.0.0.1:35002" --reflection-addr="127.0.0.1:35003"`)
+
 	flag.DurationVar(&settings.WaitDefaultDuration, "wait-timeout", time.Second,
 		`If the output has been processed, the maximum time to wait for the input to be processed
 				--wait-timeout=3s			
 	`)
+
+	flag.DurationVar(&settings.ConnIdleTimeout, "conn-idle-timeout", 10*time.Minute,
+		`Connections without any packet for this duration are considered closed,
+				in case their FIN or RST was not captured`)
+
+	flag.DurationVar(&settings.DescriptorTTL, "descriptor-ttl", 10*time.Minute,
+		`Descriptors obtained through reflection are resolved again after this duration,
+				so that schema changes on the server are picked up. 0 means never`)
 }
 
 // main is the entry point for the grpcreplay command-line tool, initializing configuration, setting up components, and running the main event loop until termination or timeout.
@@ -153,14 +327,18 @@ func main() {
 
 	parseSettings(&settings)
 	printSettings(&settings)
+	if len(settings.MetricsAddr) > 0 {
+		metrics.Serve(settings.MetricsAddr)
+	}
 
 	filterChain, err := biz.NewFilterChain(&settings)
 	if err != nil {
 		slog.Fatal("create FilterChain error:%v", err)
 	}
 	limiter := biz.NewRateLimit(&settings)
-	emitter := biz.NewEmitter(filterChain, limiter)
 	plugins := biz.NewPlugins(&settings)
+	transformer := biz.NewTransformer(&settings, plugins)
+	emitter := biz.NewEmitter(filterChain, limiter, transformer)
 
 	slog.Info("plugins:%v", plugins)
 
@@ -185,13 +363,21 @@ func main() {
 		exit = 0
 	}
 	//emitter.Close()
+	plugins.WriteReports()
 	os.Exit(exit)
 }
 
-// parseSettings processes the proto file path in the application settings, populates the list of proto files, and sets the default HTTP/2 wait timeout.
+// parseSettings processes the proto file path in the application settings, populates the list of proto files, and sets the HTTP/2 wait and idle timeouts.
 // If the proto file path is a directory, all files within it are added; if it is a file, only that file is used.
 // Terminates the application with a fatal log if the specified path does not exist or cannot be accessed.
 func parseSettings(settings *config.AppSettings) {
+	http2.WaitDefaultDuration = settings.WaitDefaultDuration
+	http2.ConnIdleTimeout = settings.ConnIdleTimeout
+	http2.DescriptorTTL = settings.DescriptorTTL
+	balance.DNSRefreshInterval = settings.OutputGRPCLBDNSRefresh
+	balance.MaxFailures = settings.OutputGRPCLBMaxFailures
+	balance.EjectTime = settings.OutputGRPCLBEjectTime
+
 	settings.ProtoFileStr = strings.TrimSpace(settings.ProtoFileStr)
 	if len(settings.ProtoFileStr) <= 0 {
 		return
@@ -216,15 +402,16 @@ func parseSettings(settings *config.AppSettings) {
 	} else {
 		settings.ProtoFiles = []string{settings.ProtoFileStr}
 	}
-
-	http2.WaitDefaultDuration = settings.WaitDefaultDuration
 }
 
 // printSettings logs the current application configuration settings for input, output, proto files, and wait timeout.
 func printSettings(settings *config.AppSettings) {
+	slog.Info("metrics-addr, %v", settings.MetricsAddr)
 	slog.Info("input-raw, %v", settings.InputRAW)
 	slog.Info("input-file-directory, %v", settings.InputFileDir)
 	slog.Info("input-file-replay-speed, %v", settings.InputFileReplaySpeed)
+	slog.Info("input-file-load-profile, %v", settings.InputFileLoadProfile)
+	slog.Info("input-file-closed-loop, %v", settings.InputFileClosedLoop)
 
 	slog.Info("input-rocketmq-name-server, %v", settings.InputRocketMQNameServer)
 	slog.Info("input-rocketmq-topic, %v", settings.InputRocketMQTopic)
@@ -232,15 +419,72 @@ func printSettings(settings *config.AppSettings) {
 	slog.Info("output-stdout, %v", settings.OutputStdout)
 	slog.Info("output-file-directory, %v", settings.OutputFileDir)
 	slog.Info("output-grpc, %v", settings.OutputGRPC)
+	slog.Info("output-grpc-results, %v", settings.OutputGRPCResults)
+	slog.Info("output-grpc-timeout-scale, %v", settings.OutputGRPCTimeoutScale)
+	slog.Info("output-grpc-default-timeout, %v", settings.OutputGRPCDefaultTimeout)
+	slog.Info("output-grpc-max-timeout, %v", settings.OutputGRPCMaxTimeout)
+	slog.Info("output-grpc-retry-max-attempts, %v", settings.OutputGRPCRetryMaxAttempts)
+	if settings.OutputGRPCRetryMaxAttempts > 1 {
+		slog.Info("output-grpc-retry-codes, %v", settings.OutputGRPCRetryCodes)
+		slog.Info("output-grpc-retry-backoff, %v", settings.OutputGRPCRetryBackoff)
+		slog.Info("output-grpc-retry-max-backoff, %v", settings.OutputGRPCRetryMaxBackoff)
+	}
+	slog.Info("output-grpc-breaker-threshold, %v", settings.OutputGRPCBreakerThreshold)
+	if settings.OutputGRPCBreakerThreshold > 0 {
+		slog.Info("output-grpc-breaker-open-time, %v", settings.OutputGRPCBreakerOpenTime)
+	}
+	slog.Info("output-grpc-dead-letter, %v", settings.OutputGRPCDeadLetter)
+	slog.Info("output-grpc-order-by, %v", settings.OutputGRPCOrderBy)
+	slog.Info("output-grpc-native, %v", settings.OutputGRPCNative)
+	slog.Info("output-grpc-concurrency, %v", settings.OutputGRPCConcurrency)
+	if settings.OutputGRPCConcurrency > 0 {
+		slog.Info("output-grpc-max-concurrency, %v", settings.OutputGRPCMaxConcurrency)
+		slog.Info("output-grpc-concurrency-step, %v", settings.OutputGRPCConcurrencyStep)
+		slog.Info("output-grpc-concurrency-interval, %v", settings.OutputGRPCConcurrencyInterval)
+		slog.Info("output-grpc-max-error-rate, %v", settings.OutputGRPCMaxErrorRate)
+		slog.Info("output-grpc-max-latency, %v", settings.OutputGRPCMaxLatency)
+		slog.Info("output-grpc-capacity-report, %v", settings.OutputGRPCCapacityReport)
+	}
+	slog.Info("output-grpc-report, %v", settings.OutputGRPCReport)
+	slog.Info("output-grpc-report-interval, %v", settings.OutputGRPCReportInterval)
+	slog.Info("output-grpc-header-rules, %v", settings.OutputGRPCHeaderRules)
+	slog.Info("output-grpc-routes, %v", settings.OutputGRPCRoutes)
+	slog.Info("output-sample-rules, %v", settings.OutputSampleRules)
+	if len(settings.OutputGRPCLBTargets) > 0 {
+		slog.Info("output-grpc-lb-target, %v", settings.OutputGRPCLBTargets)
+		slog.Info("output-grpc-lb-policy, %v", settings.OutputGRPCLBPolicy)
+		slog.Info("output-grpc-lb-hash-key, %v", settings.OutputGRPCLBHashKey)
+		slog.Info("output-grpc-lb-dns-refresh, %v", settings.OutputGRPCLBDNSRefresh)
+		slog.Info("output-grpc-lb-max-failures, %v", settings.OutputGRPCLBMaxFailures)
+		slog.Info("output-grpc-lb-eject-time, %v", settings.OutputGRPCLBEjectTime)
+	}
+	if len(settings.OutputGRPCDiffFile) > 0 {
+		slog.Info("output-grpc-diff-file, %v", settings.OutputGRPCDiffFile)
+		slog.Info("diff-ignore-path, %v", settings.DiffIgnorePaths)
+		slog.Info("diff-float-tolerance, %v", settings.DiffFloatTolerance)
+		slog.Info("diff-unordered-path, %v", settings.DiffUnorderedPaths)
+	}
+	if len(settings.OutputShadowPrimary) > 0 {
+		slog.Info("output-shadow-primary, %v", settings.OutputShadowPrimary)
+		slog.Info("output-shadow-candidate, %v", settings.OutputShadowCandidate)
+		slog.Info("output-shadow-secondary, %v", settings.OutputShadowSecondary)
+		slog.Info("output-shadow-report, %v", settings.OutputShadowReport)
+	}
 	slog.Info("output-rocketmq-name-server, %v", settings.OutputRocketMQNameServer)
 	slog.Info("output-rocketmq-topic, %v", settings.OutputRocketMQTopic)
 
 	slog.Info("record-response, %v", settings.RecordResponse)
+	slog.Info("transform-rules, %v", settings.TransformRules)
 
 	if len(settings.ProtoFileStr) > 0 {
 		slog.Info("ProtoFileStr, %v", settings.ProtoFileStr)
 		slog.Info("ProtoFiles, %v", settings.ProtoFiles)
 	}
+	slog.Info("proto-import-path, %v", settings.ProtoImportPaths)
+	slog.Info("protoset, %v", settings.ProtoSetFiles)
+	slog.Info("reflection-addr, %v", settings.ReflectionAddr)
 
 	slog.Info("wait-timeout, %v", settings.WaitDefaultDuration)
+	slog.Info("conn-idle-timeout, %v", settings.ConnIdleTimeout)
+	slog.Info("descriptor-ttl, %v", settings.DescriptorTTL)
 }
@@ -0,0 +1,132 @@
+// Package metrics exposes the runtime metrics of grpcr in the Prometheus format
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	slog "github.com/vearne/simplelog"
+	"net/http"
+	"time"
+)
+
+const namespace = "grpcr"
+
+// the reasons of PacketsDropped
+const (
+	// the packet can't be parsed
+	ReasonDecode = "decode"
+	// dropped by the kernel or the interface, reported by libpcap
+	ReasonKernel = "kernel"
+)
+
+// MethodUnknown is the method label of the streams which fail before the method is known to be valid,
+// their :path may be anything and would make the number of series unbounded
+const MethodUnknown = "unknown"
+
+// the reasons of StreamsFailed
+const (
+	// the HTTP/2 stream can't be converted to a message, the method is MethodUnknown
+	ReasonStream = "stream"
+	// the message can't be decoded with the descriptors,
+	// the method is MethodUnknown if the descriptors don't have it
+	ReasonDescriptor = "descriptor"
+	// too many messages are waiting for the descriptors, the method is MethodUnknown
+	ReasonPendingOverflow = "pending_overflow"
+)
+
+// the reasons of MessagesDropped
+const (
+	ReasonFilter      = "filter"
+	ReasonLimiter     = "limiter"
+	ReasonTransformer = "transformer"
+)
+
+var (
+	PacketsCaptured = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "capture_packets_total",
+		Help:      "The packets captured on the device.",
+	}, []string{"device"})
+	PacketsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "capture_packets_dropped_total",
+		Help:      "The packets dropped before they are processed.",
+	}, []string{"device", "reason"})
+	LastPacket = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "capture_last_packet_timestamp_seconds",
+		Help:      "The unix time of the last packet captured on the device.",
+	}, []string{"device"})
+
+	StreamsDecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streams_decoded_total",
+		Help:      "The gRPC streams decoded into messages.",
+	}, []string{"method"})
+	StreamsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streams_failed_total",
+		Help:      "The gRPC streams which can't be decoded.",
+	}, []string{"method", "reason"})
+
+	MessagesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emitter_messages_total",
+		Help:      "The messages read from the inputs.",
+	})
+	MessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emitter_messages_dropped_total",
+		Help:      "The messages which are not written to the outputs.",
+	}, []string{"reason"})
+
+	OutputWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "output_write_duration_seconds",
+		Help:      "The latency of writing a message to the output.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"output"})
+	OutputWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_write_errors_total",
+		Help:      "The messages which fail to be written to the output, or to be replayed.",
+	}, []string{"output"})
+)
+
+func init() {
+	prometheus.MustRegister(PacketsCaptured, PacketsDropped, LastPacket, StreamsDecoded, StreamsFailed,
+		MessagesRead, MessagesDropped, OutputWriteDuration, OutputWriteErrors)
+}
+
+// RegisterGaugeFunc registers a gauge which calls f on each scrape,
+// e.g. for the values which are kept by the connections
+func RegisterGaugeFunc(name string, help string, f func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+// ObserveWrite records the result of writing a message to the output
+func ObserveWrite(output string, start time.Time, err error) {
+	OutputWriteDuration.WithLabelValues(output).Observe(time.Since(start).Seconds())
+	if err != nil {
+		OutputWriteErrors.WithLabelValues(output).Inc()
+	}
+}
+
+// Serve serves /metrics on addr in the background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		slog.Info("serve metrics on %v/metrics", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Fatal("metrics server:%v", err)
+		}
+	}()
+}
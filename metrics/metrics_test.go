@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	assert.Nil(t, l.Close())
+
+	ObserveWrite("StdOutput", time.Now(), nil)
+	ObserveWrite("StdOutput", time.Now(), errors.New("closed"))
+	RegisterGaugeFunc("test_gauge", "A gauge of the test.", func() float64 { return 3 })
+	Serve(addr)
+
+	var body []byte
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err = io.ReadAll(resp.Body)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, string(body), `grpcr_output_write_errors_total{output="StdOutput"} 1`)
+	assert.Contains(t, string(body), `grpcr_output_write_duration_seconds_count{output="StdOutput"} 2`)
+	assert.Contains(t, string(body), "grpcr_test_gauge 3")
+}
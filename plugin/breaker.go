@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/codes"
+	"sync"
+	"time"
+)
+
+// BreakerConfig is the config of the circuit breakers of the targets
+type BreakerConfig struct {
+	// the breaker opens after Threshold consecutive failed calls
+	Threshold int
+	// the replay is paused for OpenTime, then a probe call is sent to the target
+	OpenTime time.Duration
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	// a probe call is in flight
+	breakerHalfOpen
+)
+
+// the breakers are shared by the outputs sending to the same target
+var breakers sync.Map
+
+// getBreaker returns the circuit breaker of the target, nil if cf is nil
+func getBreaker(addr string, cf *BreakerConfig) *CircuitBreaker {
+	if cf == nil || cf.Threshold <= 0 {
+		return nil
+	}
+	v, _ := breakers.LoadOrStore(addr, &CircuitBreaker{addr: addr, cf: cf})
+	return v.(*CircuitBreaker)
+}
+
+// CircuitBreaker pauses the calls to a target while it is unhealthy
+type CircuitBreaker struct {
+	sync.Mutex
+	addr      string
+	cf        *BreakerConfig
+	state     int
+	failures  int
+	openUntil time.Time
+}
+
+// Wait blocks while the breaker is open.
+// After OpenTime, only one caller goes through to probe the target, the others wait for its result.
+func (b *CircuitBreaker) Wait() {
+	if b == nil {
+		return
+	}
+	for {
+		b.Lock()
+		now := time.Now()
+		if b.state == breakerClosed {
+			b.Unlock()
+			return
+		}
+		if b.state == breakerOpen && !now.Before(b.openUntil) {
+			b.state = breakerHalfOpen
+			b.Unlock()
+			return
+		}
+		wait := 100 * time.Millisecond
+		if b.state == breakerOpen {
+			wait = min(wait, b.openUntil.Sub(now))
+		}
+		b.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Done records the status code of a call
+func (b *CircuitBreaker) Done(code codes.Code) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if !isTargetFailure(code) {
+		if b.state != breakerClosed {
+			slog.Info("circuit breaker of %v closed", b.addr)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.cf.Threshold) {
+		slog.Warn("circuit breaker of %v opened for %v after %v consecutive failures, code:%v",
+			b.addr, b.cf.OpenTime, b.failures, code)
+		b.state = breakerOpen
+		b.openUntil = time.Now().Add(b.cf.OpenTime)
+	}
+}
+
+// Skip is called instead of Done if the call didn't reach the target, e.g. the request is invalid.
+// If it was the probe, another caller may probe the target.
+func (b *CircuitBreaker) Skip() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openUntil = time.Now()
+	}
+}
+
+// isTargetFailure tells whether the code indicates the target is unhealthy, rather than the request is bad
+func isTargetFailure(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
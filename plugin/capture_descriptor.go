@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jhump/protoreflect/desc" //nolint: staticcheck
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/util"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The descriptors of the captured methods are saved next to capture.log,
+one file per distinct FileDescriptorSet, named by the hash of its content.
+If several files define the same .proto file, e.g. the descriptors changed between restarts,
+the most recently saved file wins on replay.
+-rw-r--r--  1 root  wheel     2391 10 14 13:50 descriptor-5d41402abc4b2a76b9719d911017c592.protoset
+-rw-r--r--  1 root  wheel  7333254 10 14 13:50 capture.log
+*/
+const (
+	descriptorFilePrefix = "descriptor-"
+	descriptorFileSuffix = ".protoset"
+)
+
+var (
+	// the descriptors of a method that failed to be saved are not tried again within this interval
+	DescriptorRetryInterval = 30 * time.Second
+)
+
+// DescriptorWriter saves the descriptors of the captured methods in the capture directory,
+// so that the capture can be decoded and replayed without the original server.
+type DescriptorWriter struct {
+	sync.Mutex
+	dir    string
+	finder http2.PBFinder
+	// the file each method was last checked with, it changes when the descriptors are refreshed
+	files map[string]*desc.FileDescriptor
+	// method -> content hash of the descriptors it was last saved with
+	saved map[string]string
+	// content hash of the descriptor files in dir
+	hashes *util.StringSet
+	// methods whose descriptors failed to be saved, and when to try again
+	failures map[string]time.Time
+}
+
+func NewDescriptorWriter(dir string, finder http2.PBFinder) *DescriptorWriter {
+	var w DescriptorWriter
+	w.dir = dir
+	w.finder = finder
+	w.files = make(map[string]*desc.FileDescriptor)
+	w.saved = make(map[string]string)
+	w.hashes = util.NewStringSet()
+	w.failures = make(map[string]time.Time)
+
+	files, err := getDescriptorFiles(dir)
+	if err != nil {
+		slog.Warn("DescriptorWriter, scan directory:%v", err)
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		w.hashes.Add(strings.TrimSuffix(strings.TrimPrefix(name, descriptorFilePrefix), descriptorFileSuffix))
+	}
+	return &w
+}
+
+// Save writes the descriptors of the method if they are seen for the first time.
+// After a failure, it returns nil without trying again until DescriptorRetryInterval has passed.
+func (w *DescriptorWriter) Save(method string) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if retryAt, ok := w.failures[method]; ok && time.Now().Before(retryAt) {
+		return nil
+	}
+
+	err := w.save(method)
+	if err != nil {
+		w.failures[method] = time.Now().Add(DescriptorRetryInterval)
+		return err
+	}
+	delete(w.failures, method)
+	return nil
+}
+
+func (w *DescriptorWriter) save(method string) error {
+	fd, err := http2.FindMethodFile(w.finder.GetDescriptorSource(), method)
+	if err != nil {
+		return err
+	}
+	if w.files[method] == fd {
+		return nil
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(http2.NewFileDescriptorSet(fd))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:16])
+	if w.saved[method] != hash {
+		path := filepath.Join(w.dir, descriptorFilePrefix+hash+descriptorFileSuffix)
+		if w.hashes.Has(hash) {
+			// the file becomes the most recent one, e.g. the descriptors changed back
+			now := time.Now()
+			err = os.Chtimes(path, now, now)
+		} else {
+			err = writeDescriptorFile(path, data)
+		}
+		if err != nil {
+			return err
+		}
+		w.hashes.Add(hash)
+		w.saved[method] = hash
+		slog.Info("DescriptorWriter, method:%v, save descriptors:%v", method, path)
+	}
+
+	w.files[method] = fd
+	return nil
+}
+
+// writeDescriptorFile writes to a temporary file first, readers never see a partial file
+func writeDescriptorFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// NewCaptureDescFinder creates a PBFinder from the descriptors saved in the capture directory.
+// The files are loaded from the oldest to the newest, a .proto file defined in several of them
+// is taken from the newest one. Returns nil if there is no descriptor file.
+func NewCaptureDescFinder(dir string) http2.PBFinder {
+	files, err := getDescriptorFiles(dir)
+	if err != nil {
+		slog.Fatal("NewCaptureDescFinder, scan directory:%v", err)
+	}
+	if len(files) <= 0 {
+		return nil
+	}
+	slog.Info("NewCaptureDescFinder, dir:%v, files:%v", dir, files)
+	return http2.NewProtoSetPBFinder(files)
+}
+
+func getDescriptorFiles(dir string) ([]string, error) {
+	fileInfoList, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %v, error:%w", dir, err)
+	}
+
+	type descriptorFile struct {
+		path    string
+		modTime time.Time
+	}
+	descFiles := make([]descriptorFile, 0)
+	for _, fi := range fileInfoList {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, descriptorFilePrefix) ||
+			!strings.HasSuffix(name, descriptorFileSuffix) {
+			continue
+		}
+		info, err := fi.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat %v, error:%w", name, err)
+		}
+		descFiles = append(descFiles, descriptorFile{path: filepath.Join(dir, name), modTime: info.ModTime()})
+	}
+
+	// the oldest first, the name breaks ties so that the order is deterministic
+	sort.Slice(descFiles, func(i, j int) bool {
+		if !descFiles[i].modTime.Equal(descFiles[j].modTime) {
+			return descFiles[i].modTime.Before(descFiles[j].modTime)
+		}
+		return descFiles[i].path < descFiles[j].path
+	})
+	files := make([]string, 0, len(descFiles))
+	for _, f := range descFiles {
+		files = append(files, f.path)
+	}
+	return files, nil
+}
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/http2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDescriptorWriter(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, NewCaptureDescFinder(dir))
+
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	w := NewDescriptorWriter(dir, finder)
+	assert.Nil(t, w.Save("/SearchService/Search"))
+	// same file, no new descriptor file
+	assert.Nil(t, w.Save("/SearchService/CurrentTime"))
+	files, err := getDescriptorFiles(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// a restarted writer recognizes the existing file
+	assert.Nil(t, NewDescriptorWriter(dir, finder).Save("/SearchService/Search"))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	captureFinder := NewCaptureDescFinder(dir)
+	protoMsg, err := captureFinder.Get("/SearchService/Search")
+	assert.Nil(t, err)
+	assert.Equal(t, "SearchRequest", string(protoMsg.InType.ProtoReflect().Descriptor().FullName()))
+}
+
+func TestDescriptorWriterRefresh(t *testing.T) {
+	dir := t.TempDir()
+	protoDirA, protoDirB := t.TempDir(), t.TempDir()
+	writeProto := func(protoDir string, field string) {
+		content := `syntax = "proto3";
+service EchoService {
+    rpc Echo(EchoRequest) returns (EchoRequest) {}
+}
+message EchoRequest {
+    string ` + field + ` = 1;
+}
+`
+		assert.Nil(t, os.WriteFile(filepath.Join(protoDir, "echo.proto"), []byte(content), 0644))
+	}
+	writeProto(protoDirA, "name")
+	writeProto(protoDirB, "title")
+
+	w := NewDescriptorWriter(dir, http2.NewFilePBFinder([]string{"echo.proto"}, protoDirA))
+	assert.Nil(t, w.Save("/EchoService/Echo"))
+	// the descriptors have been refreshed
+	w.finder = http2.NewFilePBFinder([]string{"echo.proto"}, protoDirB)
+	assert.Nil(t, w.Save("/EchoService/Echo"))
+	files, err := getDescriptorFiles(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	fieldName := func(finder http2.PBFinder) string {
+		protoMsg, err := finder.Get("/EchoService/Echo")
+		assert.Nil(t, err)
+		return string(protoMsg.InType.ProtoReflect().Descriptor().Fields().Get(0).Name())
+	}
+	byField := make(map[string]string)
+	for _, file := range files {
+		byField[fieldName(http2.NewProtoSetPBFinder([]string{file}))] = file
+	}
+
+	// the most recently saved file wins, whatever its name
+	older, newer := time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(byField["name"], newer, newer))
+	assert.Nil(t, os.Chtimes(byField["title"], older, older))
+	assert.Equal(t, "name", fieldName(NewCaptureDescFinder(dir)))
+	assert.Nil(t, os.Chtimes(byField["name"], older, older))
+	assert.Nil(t, os.Chtimes(byField["title"], newer, newer))
+	assert.Equal(t, "title", fieldName(NewCaptureDescFinder(dir)))
+
+	// the descriptors changed back, the existing file becomes the newest
+	w.finder = http2.NewFilePBFinder([]string{"echo.proto"}, protoDirA)
+	assert.Nil(t, w.Save("/EchoService/Echo"))
+	assert.Equal(t, "name", fieldName(NewCaptureDescFinder(dir)))
+}
+
+func TestDescriptorWriterFailure(t *testing.T) {
+	defer func(interval time.Duration) {
+		DescriptorRetryInterval = interval
+	}(DescriptorRetryInterval)
+
+	dir := t.TempDir()
+	w := NewDescriptorWriter(dir, http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2"))
+	assert.NotNil(t, w.Save("/UnknownService/Search"))
+	// not tried again within DescriptorRetryInterval
+	assert.Nil(t, w.Save("/UnknownService/Search"))
+
+	DescriptorRetryInterval = 0
+	w.failures["/UnknownService/Search"] = time.Now()
+	assert.NotNil(t, w.Save("/UnknownService/Search"))
+}
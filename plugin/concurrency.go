@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"encoding/json"
+	slog "github.com/vearne/simplelog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig keeps a number of calls in flight, instead of the rate of the input.
+// If Max is greater than Concurrency, the number is increased by Step after each Interval,
+// until the error rate or the latency crosses the threshold.
+type ConcurrencyConfig struct {
+	Concurrency int
+	// (optional) the upper limit of the concurrency
+	Max  int
+	Step int
+	// the throughput is measured over Interval
+	Interval time.Duration
+	// in percent, the calls returning an error count
+	MaxErrorRate float64
+	// (optional) the threshold of the 99th percentile latency, 0 means no limit
+	MaxLatency time.Duration
+	// (optional) the measurements are written to the file
+	ReportFile string
+}
+
+func (cf *ConcurrencyConfig) maxConcurrency() int {
+	return max(cf.Concurrency, cf.Max)
+}
+
+// StepReport is the measurement of a concurrency
+type StepReport struct {
+	Concurrency int `json:"concurrency"`
+	// calls per second
+	Throughput float64 `json:"throughput"`
+	// in percent
+	ErrorRate float64 `json:"errorRate"`
+	// Millisecond
+	LatencyP99 float64 `json:"latencyP99"`
+}
+
+// CapacityReport is written to ConcurrencyConfig.ReportFile
+type CapacityReport struct {
+	// the address of the output
+	Target string        `json:"target"`
+	Steps  []*StepReport `json:"steps"`
+	// the step with the maximum throughput whose error rate and latency are below the thresholds
+	Max *StepReport `json:"max"`
+	// the concurrency stops increasing
+	Finished bool `json:"finished"`
+}
+
+// concurrencyControl limits the calls in flight of the workers of an output, and measures them
+type concurrencyControl struct {
+	cf   *ConcurrencyConfig
+	mu   sync.Mutex
+	cond *sync.Cond
+	// the calls in flight can't exceed it
+	limit    int
+	inFlight int
+
+	// the calls of the current interval
+	calls     int
+	errors    int
+	latencies []time.Duration
+
+	report CapacityReport
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func newConcurrencyControl(cf *ConcurrencyConfig, addr string) *concurrencyControl {
+	if cf == nil {
+		return nil
+	}
+	c := &concurrencyControl{cf: cf, limit: max(cf.Concurrency, 1)}
+	c.cond = sync.NewCond(&c.mu)
+	c.report.Target = addr
+	c.closeChan = make(chan struct{})
+	go c.run()
+	return c
+}
+
+// close stops the measurements, the report is no longer written
+func (c *concurrencyControl) close() {
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+}
+
+// acquire blocks until a call can be sent
+func (c *concurrencyControl) acquire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.inFlight >= c.limit {
+		c.cond.Wait()
+	}
+	c.inFlight++
+}
+
+// done records a call sent after acquire
+func (c *concurrencyControl) done(latency time.Duration, failed bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.calls++
+	if failed {
+		c.errors++
+	}
+	c.latencies = append(c.latencies, latency)
+	c.cond.Signal()
+}
+
+func (c *concurrencyControl) run() {
+	ticker := time.NewTicker(c.cf.Interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			step := c.measure(now.Sub(last))
+			last = now
+			c.adjust(step)
+			c.writeReport()
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// measure returns the report of the interval, and starts a new one
+func (c *concurrencyControl) measure(interval time.Duration) *StepReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	step := &StepReport{Concurrency: c.limit, Throughput: float64(c.calls) / interval.Seconds()}
+	if c.calls > 0 {
+		step.ErrorRate = float64(c.errors) * 100 / float64(c.calls)
+		slices.Sort(c.latencies)
+		p99 := c.latencies[(len(c.latencies)*99-1)/100]
+		step.LatencyP99 = float64(p99) / float64(time.Millisecond)
+	}
+	c.calls = 0
+	c.errors = 0
+	c.latencies = c.latencies[:0]
+	return step
+}
+
+func (c *concurrencyControl) healthy(step *StepReport) bool {
+	if step.ErrorRate > c.cf.MaxErrorRate {
+		return false
+	}
+	return c.cf.MaxLatency <= 0 || step.LatencyP99 <= float64(c.cf.MaxLatency)/float64(time.Millisecond)
+}
+
+// adjust increases the concurrency after a healthy step, or goes back to the best one
+func (c *concurrencyControl) adjust(step *StepReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	slog.Info("concurrency:%v, throughput:%.1f/s, error rate:%.2f%%, p99:%.1fms",
+		step.Concurrency, step.Throughput, step.ErrorRate, step.LatencyP99)
+	// no call is done, e.g. the connections are dialed or the descriptors are loaded, the step is skipped
+	if step.Throughput <= 0 {
+		return
+	}
+	c.report.Steps = append(c.report.Steps, step)
+	healthy := c.healthy(step)
+	if healthy && (c.report.Max == nil || step.Throughput > c.report.Max.Throughput) {
+		c.report.Max = step
+	}
+	if c.report.Finished || c.cf.Max <= c.cf.Concurrency {
+		return
+	}
+
+	if healthy && c.limit < c.cf.Max {
+		c.limit = min(c.limit+max(c.cf.Step, 1), c.cf.Max)
+		c.cond.Broadcast()
+		return
+	}
+	c.report.Finished = true
+	if c.report.Max != nil {
+		c.limit = c.report.Max.Concurrency
+		slog.Info("maximum sustainable throughput:%.1f/s, concurrency:%v, error rate:%.2f%%, p99:%.1fms",
+			c.report.Max.Throughput, c.report.Max.Concurrency, c.report.Max.ErrorRate, c.report.Max.LatencyP99)
+	} else {
+		slog.Warn("no concurrency meets the thresholds, error rate:%v%%, p99:%v",
+			c.cf.MaxErrorRate, c.cf.MaxLatency)
+	}
+}
+
+func (c *concurrencyControl) writeReport() {
+	if len(c.cf.ReportFile) <= 0 {
+		return
+	}
+	c.mu.Lock()
+	data, err := json.MarshalIndent(&c.report, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		slog.Error("capacity report:%v", err)
+		return
+	}
+	err = os.WriteFile(c.cf.ReportFile, data, 0644)
+	if err != nil {
+		slog.Error("write capacity report %v:%v", c.cf.ReportFile, err)
+	}
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyControlAdjust(t *testing.T) {
+	c := &concurrencyControl{
+		cf:    &ConcurrencyConfig{Concurrency: 10, Max: 30, Step: 10, MaxErrorRate: 1, MaxLatency: 50 * time.Millisecond},
+		limit: 10,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	// warm-up, no call is done
+	c.adjust(c.measure(time.Second))
+	assert.False(t, c.report.Finished)
+	assert.Equal(t, 10, c.limit)
+	assert.Len(t, c.report.Steps, 0)
+
+	for i := 0; i < 100; i++ {
+		c.calls++
+		c.latencies = append(c.latencies, time.Duration(i)*time.Millisecond/5)
+	}
+	c.errors = 1
+	step := c.measure(time.Second)
+	assert.Equal(t, 10, step.Concurrency)
+	assert.Equal(t, float64(100), step.Throughput)
+	assert.Equal(t, float64(1), step.ErrorRate)
+	assert.InDelta(t, 19.6, step.LatencyP99, 0.01)
+	assert.Equal(t, 0, c.calls)
+
+	c.adjust(step)
+	assert.Equal(t, 20, c.limit)
+	c.adjust(&StepReport{Concurrency: 20, Throughput: 180})
+	assert.Equal(t, 30, c.limit)
+
+	// the latency crosses the threshold, back to the best concurrency
+	c.adjust(&StepReport{Concurrency: 30, Throughput: 200, LatencyP99: 80})
+	assert.True(t, c.report.Finished)
+	assert.Equal(t, 20, c.limit)
+	assert.Equal(t, 20, c.report.Max.Concurrency)
+	assert.Len(t, c.report.Steps, 3)
+
+	c.adjust(&StepReport{Concurrency: 20, Throughput: 190})
+	assert.Equal(t, 20, c.limit)
+}
+
+func TestConcurrencyControlClose(t *testing.T) {
+	reportFile := filepath.Join(t.TempDir(), "capacity.json")
+	c := newConcurrencyControl(&ConcurrencyConfig{Concurrency: 1, Interval: 10 * time.Millisecond,
+		ReportFile: reportFile}, "127.0.0.1:35001")
+	c.acquire()
+	c.done(time.Millisecond, false)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(reportFile)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	c.close()
+	// closing twice is harmless
+	c.close()
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, os.Remove(reportFile))
+	time.Sleep(50 * time.Millisecond)
+	_, err := os.Stat(reportFile)
+	assert.True(t, os.IsNotExist(err), "the report is no longer written")
+}
+
+func TestReplayClosedLoop(t *testing.T) {
+	path := writeCapture(t, 0, int64(time.Second), int64(2*time.Second))
+	source := newLoopSource([]string{path}, protocol.GetCodec("simple"))
+	defer source.Close() // nolint: errcheck
+
+	msgChan := make(chan *protocol.Message)
+	go replayClosedLoop(source, msgChan)
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		<-msgChan
+	}
+	// the timestamps are ignored
+	assert.Less(t, time.Since(start), time.Second)
+}
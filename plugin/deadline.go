@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/vearne/grpcreplay/protocol"
+	"strconv"
+	"time"
+)
+
+const headerGRPCTimeout = "grpc-timeout"
+
+// Deadline turns the recorded grpc-timeout of a request into the deadline of the replayed call
+type Deadline struct {
+	// the recorded timeout is multiplied by it, e.g. 2 for a slower test environment, 0 is the same as 1
+	Scale float64
+	// (optional) used if the request has no grpc-timeout, 0 means no deadline
+	Default time.Duration
+	// (optional) the upper limit of the timeout, 0 means no limit
+	Max time.Duration
+}
+
+// Timeout returns the timeout of the replayed call, 0 means no deadline
+func (d *Deadline) Timeout(msg *protocol.Message) time.Duration {
+	if d == nil {
+		return 0
+	}
+
+	timeout := d.Default
+	if value, ok := msg.Request.Headers[headerGRPCTimeout]; ok {
+		recorded, err := ParseGRPCTimeout(value)
+		if err == nil {
+			timeout = recorded
+			if d.Scale > 0 {
+				timeout = time.Duration(float64(recorded) * d.Scale)
+			}
+		}
+	}
+	if d.Max > 0 && (timeout <= 0 || timeout > d.Max) {
+		timeout = d.Max
+	}
+	return timeout
+}
+
+// ParseGRPCTimeout parses the value of the grpc-timeout header, e.g. "100m" is 100 milliseconds
+func ParseGRPCTimeout(s string) (time.Duration, error) {
+	// at most 8 digits followed by the unit
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout:%q", s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("invalid grpc-timeout:%q", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout:%q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
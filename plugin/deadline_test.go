@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        2 * time.Minute,
+		"3S":        3 * time.Second,
+		"100m":      100 * time.Millisecond,
+		"5u":        5 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+	}
+	for s, want := range cases {
+		got, err := ParseGRPCTimeout(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{"", "m", "100", "10x", "-1S", "123456789S"} {
+		_, err := ParseGRPCTimeout(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDeadlineTimeout(t *testing.T) {
+	withTimeout := &protocol.Message{Request: &protocol.MsgItem{
+		Headers: map[string]string{"grpc-timeout": "100m"}}}
+	without := &protocol.Message{Request: &protocol.MsgItem{Headers: map[string]string{}}}
+
+	var d *Deadline
+	assert.Equal(t, time.Duration(0), d.Timeout(withTimeout))
+
+	d = &Deadline{Scale: 2.5}
+	assert.Equal(t, 250*time.Millisecond, d.Timeout(withTimeout))
+	assert.Equal(t, time.Duration(0), d.Timeout(without))
+
+	d = &Deadline{Scale: 1, Default: time.Second, Max: 200 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, d.Timeout(withTimeout))
+	assert.Equal(t, 200*time.Millisecond, d.Timeout(without))
+
+	d.Scale = 10
+	assert.Equal(t, 200*time.Millisecond, d.Timeout(withTimeout))
+}
+
+func TestGrpcWorkerHeadersWithoutTimeout(t *testing.T) {
+	w := &GrpcWorker{}
+	msg := &protocol.Message{Request: &protocol.MsgItem{Headers: map[string]string{
+		":path": "/SearchService/Search", "grpc-timeout": "100m", "x-user-id": "1"}}}
+	assert.Equal(t, []string{"x-user-id:1"}, w.headers(msg))
+}
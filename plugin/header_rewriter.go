@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	HeaderActionAdd     = "add"
+	HeaderActionSet     = "set"
+	HeaderActionRemove  = "remove"
+	HeaderActionReplace = "replace"
+)
+
+// HeaderRule changes a request header before the request is replayed.
+// Value is a template, it may reference
+//
+//	${peer}      address of the client which sent the original request
+//	${uuid}      uuid of the message
+//	${method}    method of the message
+//	${env:NAME}  environment variable NAME
+type HeaderRule struct {
+	// regular expression of the methods the rule applies to, all methods if empty
+	Method string `json:"method"`
+	// add, set, remove or replace
+	Action string `json:"action"`
+	Header string `json:"header"`
+	// for add, set and replace, the replacement of replace may also reference the groups of Pattern, e.g. $1
+	Value string `json:"value"`
+	// for replace, regular expression matched against the values of the header
+	Pattern string `json:"pattern"`
+
+	methodRegexp  *regexp.Regexp
+	patternRegexp *regexp.Regexp
+}
+
+var templatePattern = regexp.MustCompile(`\$\{(peer|uuid|method|env:[^}]+)\}`)
+
+// HeaderRewriter applies the rules in order to the request headers
+type HeaderRewriter struct {
+	rules []*HeaderRule
+}
+
+// NewHeaderRewriter loads the rules from a json file containing an array of HeaderRule
+func NewHeaderRewriter(path string) *HeaderRewriter {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Fatal("NewHeaderRewriter, read %v, error:%v", path, err)
+	}
+	var rules []*HeaderRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		slog.Fatal("NewHeaderRewriter, parse %v, error:%v", path, err)
+	}
+	r, err := newHeaderRewriter(rules)
+	if err != nil {
+		slog.Fatal("NewHeaderRewriter, %v, error:%v", path, err)
+	}
+	slog.Info("create header rewriter, %v rules", len(rules))
+	return r
+}
+
+func newHeaderRewriter(rules []*HeaderRule) (*HeaderRewriter, error) {
+	for i, rule := range rules {
+		// gRPC metadata keys are lowercase
+		rule.Header = strings.ToLower(strings.TrimSpace(rule.Header))
+		if len(rule.Header) <= 0 {
+			return nil, fmt.Errorf("rule %v: header is empty", i)
+		}
+		if IsPseudo(rule.Header) {
+			return nil, fmt.Errorf("rule %v: pseudo header %v can't be changed", i, rule.Header)
+		}
+		switch rule.Action {
+		case HeaderActionAdd, HeaderActionSet, HeaderActionRemove:
+		case HeaderActionReplace:
+			var err error
+			rule.patternRegexp, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v: pattern:%w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("rule %v: unknown action:%v", i, rule.Action)
+		}
+		if len(rule.Method) > 0 {
+			var err error
+			rule.methodRegexp, err = regexp.Compile(rule.Method)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v: method:%w", i, err)
+			}
+		}
+	}
+	return &HeaderRewriter{rules: rules}, nil
+}
+
+type header struct {
+	key   string
+	value string
+}
+
+// Rewrite returns the headers to send, in the form of "key:value"
+func (r *HeaderRewriter) Rewrite(msg *protocol.Message) []string {
+	headers := make([]header, 0, len(msg.Request.Headers))
+	for key, value := range msg.Request.Headers {
+		if !IsPseudo(key) {
+			headers = append(headers, header{key: key, value: value})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].key < headers[j].key
+	})
+
+	for _, rule := range r.rules {
+		if rule.methodRegexp != nil && !rule.methodRegexp.MatchString(msg.Method) {
+			continue
+		}
+		headers = rule.apply(headers, msg)
+	}
+
+	result := make([]string, 0, len(headers))
+	for _, h := range headers {
+		result = append(result, h.key+":"+h.value)
+	}
+	return result
+}
+
+func (rule *HeaderRule) apply(headers []header, msg *protocol.Message) []header {
+	switch rule.Action {
+	case HeaderActionAdd:
+		return append(headers, header{key: rule.Header, value: expandTemplate(rule.Value, msg, false)})
+	case HeaderActionSet:
+		headers = removeHeader(headers, rule.Header)
+		return append(headers, header{key: rule.Header, value: expandTemplate(rule.Value, msg, false)})
+	case HeaderActionRemove:
+		return removeHeader(headers, rule.Header)
+	case HeaderActionReplace:
+		// $ in the values of the references is not a group of Pattern
+		replacement := expandTemplate(rule.Value, msg, true)
+		for i := range headers {
+			if headers[i].key == rule.Header {
+				headers[i].value = rule.patternRegexp.ReplaceAllString(headers[i].value, replacement)
+			}
+		}
+	}
+	return headers
+}
+
+func removeHeader(headers []header, key string) []header {
+	result := headers[:0]
+	for _, h := range headers {
+		if h.key != key {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+// expandTemplate replaces the references in the template, see HeaderRule.
+// If escape is true, $ in the values is escaped for the replacement of Regexp.ReplaceAllString.
+func expandTemplate(template string, msg *protocol.Message, escape bool) string {
+	return templatePattern.ReplaceAllStringFunc(template, func(ref string) string {
+		var value string
+		name := ref[2 : len(ref)-1]
+		switch name {
+		case "peer":
+			value = msg.Meta.Peer
+		case "uuid":
+			value = msg.Meta.UUID
+		case "method":
+			value = msg.Method
+		default:
+			value = os.Getenv(strings.TrimPrefix(name, "env:"))
+		}
+		if escape {
+			value = strings.ReplaceAll(value, "$", "$$")
+		}
+		return value
+	})
+}
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"testing"
+)
+
+func TestHeaderRewriter(t *testing.T) {
+	t.Setenv("GRPCR_TEST_ENV", "staging")
+	rules := []*HeaderRule{
+		{Action: HeaderActionSet, Header: "X-Forwarded-For", Value: "${peer}"},
+		{Action: HeaderActionRemove, Header: "authorization"},
+		{Action: HeaderActionAdd, Header: "x-env", Value: "${env:GRPCR_TEST_ENV}"},
+		{Action: HeaderActionReplace, Header: "tenant", Pattern: `^prod-(\w+)$`, Value: "test-$1"},
+		{Method: "Search$", Action: HeaderActionSet, Header: "x-request-id", Value: "${uuid}${method}"},
+	}
+	r, err := newHeaderRewriter(rules)
+	assert.Nil(t, err)
+
+	msg := &protocol.Message{
+		Meta:    protocol.Meta{UUID: "uuid-1", Peer: "10.0.0.1:5000"},
+		Method:  "/proto.SearchService/Search",
+		Request: &protocol.MsgItem{},
+	}
+	msg.Request.Headers = map[string]string{
+		":path":           msg.Method,
+		"authorization":   "Bearer xxx",
+		"tenant":          "prod-a1",
+		"x-forwarded-for": "127.0.0.1",
+	}
+	assert.ElementsMatch(t, []string{
+		"x-forwarded-for:10.0.0.1:5000",
+		"x-env:staging",
+		"tenant:test-a1",
+		"x-request-id:uuid-1/proto.SearchService/Search",
+	}, r.Rewrite(msg))
+
+	msg.Method = "/proto.SearchService/CurrentTime"
+	assert.NotContains(t, r.Rewrite(msg), "x-request-id:uuid-1/proto.SearchService/CurrentTime")
+
+	_, err = newHeaderRewriter([]*HeaderRule{{Action: "rename", Header: "a"}})
+	assert.NotNil(t, err)
+	_, err = newHeaderRewriter([]*HeaderRule{{Action: HeaderActionSet, Header: ":authority"}})
+	assert.NotNil(t, err)
+}
+
+func TestHeaderRewriterReplaceDollar(t *testing.T) {
+	t.Setenv("GRPCR_TEST_TOKEN", "p$1ss$$")
+	r, err := newHeaderRewriter([]*HeaderRule{
+		{Action: HeaderActionReplace, Header: "authorization", Pattern: `^(Bearer) \S+$`,
+			Value: "$1 ${env:GRPCR_TEST_TOKEN}"},
+	})
+	assert.Nil(t, err)
+
+	msg := &protocol.Message{Method: "/proto.SearchService/Search", Request: &protocol.MsgItem{}}
+	msg.Request.Headers = map[string]string{"authorization": "Bearer xxx"}
+	// $ in the value of the environment variable is kept as is
+	assert.Equal(t, []string{"authorization:Bearer p$1ss$$"}, r.Rewrite(msg))
+}
@@ -3,6 +3,8 @@ package plugin
 import (
 	"bufio"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"github.com/vearne/grpcreplay/buffpool"
 	"github.com/vearne/grpcreplay/protocol"
 	"github.com/vearne/gtimer"
@@ -25,16 +27,43 @@ type FileDirInput struct {
 	// smallest timestamp
 	benchmarkTimestamp int64
 	reader             *ReinforcedReader
+	// (optional) replaces replaySpeed
+	profile    *LoadProfile
+	closedLoop bool
+	// used instead of reader with profile or closedLoop
+	source *loopSource
 }
 
-func NewFileDirInput(codec string, path string, readDepth int, speed float64) *FileDirInput {
+type FileDirInputConfig struct {
+	ReadDepth int
+	// the recorded rate is multiplied by it
+	ReplaySpeed float64
+	// (optional) replaces ReplaySpeed
+	Profile *LoadProfile
+	// ignore the timestamps and read the messages as fast as the outputs accept them,
+	// the capture is replayed over and over again
+	ClosedLoop bool
+	// keep the order of the messages, e.g. for --output-grpc-order-by,
+	// they are sent by a single timer goroutine instead of several
+	Ordered bool
+}
+
+// NewFileDirInput replays the capture in path at the recorded rate multiplied by the speed,
+// according to the profile, or as fast as possible in the closed loop
+func NewFileDirInput(codec string, path string, cf *FileDirInputConfig) *FileDirInput {
 	var in FileDirInput
 	in.codec = protocol.GetCodec(codec)
 	in.msgChan = make(chan *protocol.Message, 100)
-	in.timer = gtimer.NewSuperTimer(3)
+	if cf.Ordered {
+		in.timer = gtimer.NewSuperTimer(1)
+	} else {
+		in.timer = gtimer.NewSuperTimer(3)
+	}
 	in.path = path
-	in.readDepth = readDepth
-	in.replaySpeed = speed
+	in.readDepth = cf.ReadDepth
+	in.replaySpeed = cf.ReplaySpeed
+	in.profile = cf.Profile
+	in.closedLoop = cf.ClosedLoop
 	in.benchmarkTimestamp = 0
 
 	in.init()
@@ -47,6 +76,20 @@ func (in *FileDirInput) init() {
 	if err != nil {
 		slog.Fatal("FileDirInput-scan directory:%v", err)
 	}
+	if in.profile != nil {
+		in.source = newLoopSource(files, in.codec)
+		go replayProfile(in.profile, in.source, func(msg *protocol.Message) {
+			in.msgChan <- msg
+		})
+		return
+	}
+	if in.closedLoop {
+		// blocked by the outputs
+		in.msgChan = make(chan *protocol.Message)
+		in.source = newLoopSource(files, in.codec)
+		go replayClosedLoop(in.source, in.msgChan)
+		return
+	}
 	in.reader = NewReinforcedReader(files, in.codec)
 	msgList := make([]*protocol.Message, 0, in.readDepth)
 
@@ -107,6 +150,9 @@ func (in *FileDirInput) Read() (msg *protocol.Message, err error) {
 }
 
 func (in *FileDirInput) Close() error {
+	if in.source != nil {
+		return in.source.Close()
+	}
 	return in.reader.Close()
 }
 
@@ -118,8 +164,12 @@ type ReinforcedReader struct {
 	filepaths []string
 	index     int
 	EOF       bool
+	// the number of records which can't be decoded
+	Skipped int
 }
 
+var errBadRecord = errors.New("bad record")
+
 func NewReinforcedReader(filepaths []string, codec protocol.Codec) *ReinforcedReader {
 	var r ReinforcedReader
 	r.index = 0
@@ -190,10 +240,22 @@ func (r *ReinforcedReader) NextFile() error {
 	return io.EOF
 }
 
+// ReadMessage returns the next message, the records which can't be decoded are skipped
 func (r *ReinforcedReader) ReadMessage() (*protocol.Message, error) {
 	r.Lock()
 	defer r.Unlock()
 
+	for {
+		msg, err := r.readMessage()
+		if !errors.Is(err, errBadRecord) {
+			return msg, err
+		}
+		r.Skipped++
+		slog.Error("ReinforcedReader, file:%v, skipped:%v, %v", r.filepaths[r.index], r.Skipped, err)
+	}
+}
+
+func (r *ReinforcedReader) readMessage() (*protocol.Message, error) {
 	if r.EOF {
 		return nil, io.EOF
 	}
@@ -210,17 +272,20 @@ func (r *ReinforcedReader) ReadMessage() (*protocol.Message, error) {
 		// line contains delimiter
 		line, err = r.reader.ReadBytes('\n')
 		if err != nil {
-			if err == io.EOF {
-				// switch to next file
-				err = r.NextFile()
-				if err == nil {
-					// 完成了切换
-					first = true
-					continue
-				} else {
-					slog.Debug("[end]ReinforcedReader.ReadMessage()")
-					return nil, err
-				}
+			if err != io.EOF {
+				// e.g. a gzip file cut short when grpcr was killed, the same error would be returned again
+				slog.Error("ReinforcedReader, file:%v, skip the rest of the file, %v", r.filepaths[r.index], err)
+				bf.Reset()
+			}
+			// switch to next file
+			err = r.NextFile()
+			if err == nil {
+				// 完成了切换
+				first = true
+				continue
+			} else {
+				slog.Debug("[end]ReinforcedReader.ReadMessage()")
+				return nil, err
 			}
 		}
 
@@ -233,13 +298,16 @@ func (r *ReinforcedReader) ReadMessage() (*protocol.Message, error) {
 	data := bf.Bytes()
 	slog.Debug("error:%v, file:%v, filepaths:%v, len(data):%v, content:%v",
 		err, r.filepaths[r.index], r.filepaths, len(data), string(data))
+	if len(data) <= 0 {
+		return nil, fmt.Errorf("%w:empty record", errBadRecord)
+	}
 	data = data[0 : len(data)-1]
 
 	var msg protocol.Message
 
 	err = r.codec.Unmarshal(data, &msg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w:%v", errBadRecord, err)
 	}
 
 	slog.Debug("[end]ReinforcedReader.ReadMessage()")
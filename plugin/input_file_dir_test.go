@@ -0,0 +1,25 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDirInputOrdered(t *testing.T) {
+	start := time.Now().UnixNano()
+	timestamps := make([]int64, 300)
+	for i := range timestamps {
+		timestamps[i] = start + int64(i)*int64(time.Microsecond)
+	}
+	path := writeCapture(t, timestamps...)
+
+	in := NewFileDirInput("simple", filepath.Dir(path), &FileDirInputConfig{ReadDepth: 100, ReplaySpeed: 1, Ordered: true})
+	defer in.Close() // nolint: errcheck
+	for _, ts := range timestamps {
+		msg, err := in.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, ts, msg.Meta.Timestamp)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/google/gopacket/pcap"
 	psnet "github.com/shirou/gopsutil/v3/net"
 	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/metrics"
 	"github.com/vearne/grpcreplay/protocol"
 	"github.com/vearne/grpcreplay/util"
 	slog "github.com/vearne/simplelog"
@@ -22,6 +23,8 @@ const (
 	promiscuous bool          = false
 	timeout     time.Duration = 5 * time.Second
 	RSTNum                    = 3
+	// the packets dropped by the kernel are read from libpcap at the interval
+	pcapStatsInterval = 10 * time.Second
 )
 
 type DeviceListener struct {
@@ -57,11 +60,20 @@ func (l *DeviceListener) listen() error {
 	if err != nil {
 		return err
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go l.collectStats(done)
+
+	captured := metrics.PacketsCaptured.WithLabelValues(l.device)
+	lastPacket := metrics.LastPacket.WithLabelValues(l.device)
 	packetSource := gopacket.NewPacketSource(l.handle, l.handle.LinkType())
 	for packet := range packetSource.Packets() {
+		captured.Inc()
+		lastPacket.SetToCurrentTime()
 		netPkg, err := http2.ProcessPacket(packet, l.rawInput.ipSet, l.port)
 		if err != nil {
 			slog.Error("netPkg error:%v", err)
+			metrics.PacketsDropped.WithLabelValues(l.device, metrics.ReasonDecode).Inc()
 			continue
 		}
 		conn := netPkg.DirectConn()
@@ -107,6 +119,32 @@ func (l *DeviceListener) listen() error {
 	return nil
 }
 
+// collectStats adds the packets dropped by the kernel or the interface to the metrics, until done is closed
+func (l *DeviceListener) collectStats(done chan struct{}) {
+	ticker := time.NewTicker(pcapStatsInterval)
+	defer ticker.Stop()
+
+	dropped := metrics.PacketsDropped.WithLabelValues(l.device, metrics.ReasonKernel)
+	var last int
+	for {
+		select {
+		case <-ticker.C:
+			stats, err := l.handle.Stats()
+			if err != nil {
+				slog.Debug("listener:%v, pcap stats:%v", l, err)
+				continue
+			}
+			total := stats.PacketsDropped + stats.PacketsIfDropped
+			if total > last {
+				dropped.Add(float64(total - last))
+			}
+			last = total
+		case <-done:
+			return
+		}
+	}
+}
+
 func (l *DeviceListener) Close() {
 	l.handle.Close()
 }
@@ -250,9 +288,15 @@ func (i *RAWInput) Close() error {
 	for _, listener := range i.listenerList {
 		listener.Close()
 	}
+	i.Processor.Close()
 	return nil
 }
 
+// ConnCount returns the number of live HTTP/2 connections being captured
+func (i *RAWInput) ConnCount() int {
+	return i.Processor.ConnCount()
+}
+
 func listAllConns(port int) ([]http2.DirectConn, error) {
 	itemList, err := psnet.Connections("tcp4")
 	if err != nil {
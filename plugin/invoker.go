@@ -0,0 +1,199 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/fullstorydev/grpcurl"
+	"github.com/patrickmn/go-cache"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the marshalled requests of a method which are kept, the same bodies are usually replayed many times
+const maxRequestTemplates = 1024
+
+// rawCodec sends and receives the marshalled messages as they are
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec, unexpected type:%T", v)
+	}
+	return data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec, unexpected type:%T", v)
+	}
+	// the buffer may be reused by grpc
+	*p = slices.Clone(data)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// nativeMethod is a unary method invoked without grpcurl
+type nativeMethod struct {
+	// e.g. /proto.SearchService/Search
+	fullName string
+	in       protoreflect.MessageDescriptor
+	out      protoreflect.MessageDescriptor
+	// resolves the types of google.protobuf.Any
+	types *dynamicpb.Types
+
+	mu sync.Mutex
+	// json body -> marshalled request
+	requests map[string][]byte
+}
+
+func newNativeMethod(ds grpcurl.DescriptorSource, method string) (*nativeMethod, error) {
+	fdSet, err := http2.GetFileDescriptorSet(ds, method)
+	if err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(fdSet)
+	if err != nil {
+		return nil, fmt.Errorf("method:%v, error:%w", method, err)
+	}
+
+	// /proto.SearchService/Search -> proto.SearchService, Search
+	svc, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	d, err := files.FindDescriptorByName(protoreflect.FullName(svc))
+	if err != nil {
+		return nil, fmt.Errorf("method:%v, error:%w", method, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("method:%v, %v is a %T", method, svc, d)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("service %v has no method %v", svc, name)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		// sent by grpcurl
+		return nil, nil
+	}
+	return &nativeMethod{
+		fullName: "/" + svc + "/" + name,
+		in:       md.Input(),
+		out:      md.Output(),
+		types:    dynamicpb.NewTypes(files),
+		requests: make(map[string][]byte),
+	}, nil
+}
+
+// request returns the marshalled request of the json body
+func (m *nativeMethod) request(body string) ([]byte, error) {
+	m.mu.Lock()
+	data, ok := m.requests[body]
+	m.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	msg := dynamicpb.NewMessage(m.in)
+	err := protojson.UnmarshalOptions{Resolver: m.types}.Unmarshal([]byte(body), msg)
+	if err != nil {
+		return nil, fmt.Errorf("request doesn't match the input type %v:%w", m.in.FullName(), err)
+	}
+	data, err = proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if len(m.requests) < maxRequestTemplates {
+		m.requests[body] = data
+	}
+	m.mu.Unlock()
+	return data, nil
+}
+
+// response converts the marshalled response to json
+func (m *nativeMethod) response(data []byte) (string, error) {
+	msg := dynamicpb.NewMessage(m.out)
+	err := proto.UnmarshalOptions{Resolver: m.types}.Unmarshal(data, msg)
+	if err != nil {
+		return "", err
+	}
+	body, err := protojson.MarshalOptions{Resolver: m.types}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// nativeMethod returns the method, nil if it is a streaming one.
+// It is dropped with the other cached descriptors when they are refreshed.
+func (s *DescSrcWrapper) nativeMethod(method string) (*nativeMethod, error) {
+	key := "nativeMethod:" + method
+	if value, exist := s.innerCache.Get(key); exist {
+		return value.(*nativeMethod), nil
+	}
+
+	m, err := newNativeMethod(s, method)
+	if err != nil {
+		return nil, err
+	}
+	s.innerCache.Set(key, m, cache.DefaultExpiration)
+	return m, nil
+}
+
+// invokeNative sends a unary call with grpc.ClientConn.Invoke, the request is marshalled from the json body directly.
+// The response is only decoded if keepResponse is true.
+func (w *GrpcWorker) invokeNative(ctx context.Context, m *nativeMethod, msg *protocol.Message,
+	headers []string, keepResponse bool) (*Response, error) {
+	req, err := m.request(msg.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var header, trailer metadata.MD
+	var reply []byte
+	ctx = metadata.NewOutgoingContext(ctx, grpcurl.MetadataFromHeaders(headers))
+	start := time.Now()
+	err = w.cc.Invoke(ctx, m.fullName, req, &reply,
+		grpc.ForceCodec(rawCodec{}), grpc.Header(&header), grpc.Trailer(&trailer))
+	resp := &Response{Status: status.New(codes.OK, ""), Latency: time.Since(start)}
+	if err != nil {
+		resp.Status = status.Convert(err)
+	}
+	if !keepResponse {
+		return resp, nil
+	}
+
+	resp.Headers = make(map[string]string, len(header)+len(trailer))
+	for _, md := range []metadata.MD{header, trailer} {
+		for key, values := range md {
+			if len(values) > 0 {
+				resp.Headers[key] = values[0]
+			}
+		}
+	}
+	if err == nil {
+		resp.Body, err = m.response(reply)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	pb "github.com/vearne/grpcreplay/example/service_proto"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type searchServer struct {
+	pb.UnimplementedSearchServiceServer
+}
+
+func (s *searchServer) Search(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get("x-fail")) > 0 {
+		return nil, status.Error(codes.NotFound, "staff not found")
+	}
+	return &pb.SearchResponse{StaffID: 100, StaffName: in.StaffName}, nil
+}
+
+func TestGrpcWorkerNative(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	pb.RegisterSearchServiceServer(server, &searchServer{})
+	go server.Serve(lis) // nolint: errcheck
+	defer server.Stop()
+
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	w := NewGrpcWorker(lis.Addr().String(), nil, NewDescSrcWrapper(finder.GetDescriptorSource()),
+		&GRPCOutputConfig{Native: true})
+	defer w.cc.Close()
+
+	msg := &protocol.Message{
+		Method:  "/SearchService/Search",
+		Request: &protocol.MsgItem{Body: `{"staffName":"alice"}`, Headers: map[string]string{}},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := w.Fetch(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, codes.OK, resp.Status.Code())
+		assert.JSONEq(t, `{"staffID":"100","staffName":"alice"}`, resp.Body)
+	}
+	m, err := w.descSource.nativeMethod(msg.Method)
+	assert.Nil(t, err)
+	assert.Len(t, m.requests, 1)
+
+	msg.Request.Headers["x-fail"] = "1"
+	resp, err := w.Fetch(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, codes.NotFound, resp.Status.Code())
+	assert.Equal(t, "staff not found", resp.Status.Message())
+
+	// the same as grpcurl
+	w.native = false
+	resp, err = w.Fetch(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, codes.NotFound, resp.Status.Code())
+
+	msg.Request.Body = `{"unknown":1}`
+	w.native = true
+	_, err = w.Fetch(msg)
+	assert.ErrorContains(t, err, "doesn't match the input type")
+}
+
+type unavailableServer struct {
+	pb.UnimplementedSearchServiceServer
+}
+
+func (s *unavailableServer) Search(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	return nil, status.Error(codes.Unavailable, "overloaded")
+}
+
+func TestGrpcWorkerReportExcludesBackoff(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	pb.RegisterSearchServiceServer(server, &unavailableServer{})
+	go server.Serve(lis) // nolint: errcheck
+	defer server.Stop()
+
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	report := NewReplayReport(&ReportConfig{})
+	w := NewGrpcWorker(lis.Addr().String(), nil, NewDescSrcWrapper(finder.GetDescriptorSource()),
+		&GRPCOutputConfig{Native: true, Report: report, Retry: &RetryPolicy{MaxAttempts: 3,
+			Codes: []codes.Code{codes.Unavailable}, InitialBackoff: 200 * time.Millisecond, MaxBackoff: time.Second}})
+	defer w.cc.Close()
+
+	msg := &protocol.Message{
+		Method:  "/SearchService/Search",
+		Request: &protocol.MsgItem{Body: `{"staffName":"alice"}`, Headers: map[string]string{}},
+	}
+	assert.NotNil(t, w.Call(msg))
+	s := report.Summary()
+	assert.Equal(t, int64(3), s.Calls)
+	assert.Equal(t, int64(3), s.Codes["Unavailable"])
+	assert.Less(t, s.Latency.Max, float64(200))
+}
+
+// authServer records the authorization headers of the last call
+type authServer struct {
+	pb.UnimplementedSearchServiceServer
+	mu            sync.Mutex
+	authorization []string
+}
+
+func (s *authServer) Search(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	s.authorization = md.Get("authorization")
+	s.mu.Unlock()
+	return &pb.SearchResponse{StaffName: in.StaffName}, nil
+}
+
+func (s *authServer) lastAuthorization() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorization
+}
+
+// tokenCredentials sends a fixed bearer token, without TLS
+type tokenCredentials string
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(c)}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func TestGrpcWorkerPerRPCCredentials(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer()
+	auth := &authServer{}
+	pb.RegisterSearchServiceServer(server, auth)
+	go server.Serve(lis) // nolint: errcheck
+	defer server.Stop()
+
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	w := NewGrpcWorker(lis.Addr().String(), nil, NewDescSrcWrapper(finder.GetDescriptorSource()),
+		&GRPCOutputConfig{DialOptions: []grpc.DialOption{grpc.WithPerRPCCredentials(tokenCredentials("new"))},
+			PerRPCCredentials: true})
+	defer w.cc.Close()
+
+	msg := &protocol.Message{
+		Method: "/SearchService/Search",
+		Request: &protocol.MsgItem{Body: `{"staffName":"alice"}`,
+			Headers: map[string]string{"authorization": "Bearer recorded"}},
+	}
+	for _, native := range []bool{true, false} {
+		w.native = native
+		resp, err := w.Fetch(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, codes.OK, resp.Status.Code())
+		// the recorded token is replaced, not sent along with the new one
+		assert.Equal(t, []string{"Bearer new"}, auth.lastAuthorization(), "native:%v", native)
+	}
+}
@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// the messages are released at this interval
+const profileTick = 5 * time.Millisecond
+
+// Stage is a period of a LoadProfile, the rate is a multiple of the recorded rate(Speed) or a fixed RPS
+type Stage struct {
+	Duration time.Duration
+	Speed    float64
+	RPS      float64
+	// the rate changes linearly from that of the previous stage to that of this stage,
+	// from 0 if the previous stage has the other kind of rate or this is the first stage
+	Ramp bool
+}
+
+// LoadProfile controls the rate of FileDirInput over time, the capture is replayed again if it runs out
+type LoadProfile struct {
+	Stages []*Stage
+}
+
+type stageJSON struct {
+	// e.g. "5m"
+	Duration string  `json:"duration"`
+	Speed    float64 `json:"speed"`
+	RPS      float64 `json:"rps"`
+	Ramp     bool    `json:"ramp"`
+}
+
+// LoadProfileFromFile reads a profile like
+//
+//	[{"duration":"1m","speed":1,"ramp":true},{"duration":"5m","speed":2},{"duration":"5m","rps":500}]
+func LoadProfileFromFile(path string) (*LoadProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []stageJSON
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("load profile %v:%w", path, err)
+	}
+
+	var p LoadProfile
+	for i, item := range list {
+		d, err := time.ParseDuration(item.Duration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("stage %v, invalid duration:%q", i, item.Duration)
+		}
+		if (item.Speed > 0) == (item.RPS > 0) || item.Speed < 0 || item.RPS < 0 {
+			return nil, fmt.Errorf("stage %v, exactly one of speed and rps should be positive", i)
+		}
+		p.Stages = append(p.Stages, &Stage{Duration: d, Speed: item.Speed, RPS: item.RPS, Ramp: item.Ramp})
+	}
+	if len(p.Stages) <= 0 {
+		return nil, fmt.Errorf("load profile %v has no stage", path)
+	}
+	return &p, nil
+}
+
+// Duration returns the total duration of the stages
+func (p *LoadProfile) Duration() time.Duration {
+	var total time.Duration
+	for _, s := range p.Stages {
+		total += s.Duration
+	}
+	return total
+}
+
+// rate returns the stage at elapsed, and its speed or rps at that moment, -1 if the profile ends
+func (p *LoadProfile) rate(elapsed time.Duration) (int, float64) {
+	for i, s := range p.Stages {
+		if elapsed >= s.Duration {
+			elapsed -= s.Duration
+			continue
+		}
+		value := s.Speed + s.RPS
+		if !s.Ramp {
+			return i, value
+		}
+		var from float64
+		if i > 0 {
+			prev := p.Stages[i-1]
+			if (prev.Speed > 0) == (s.Speed > 0) {
+				from = prev.Speed + prev.RPS
+			}
+		}
+		return i, from + (value-from)*float64(elapsed)/float64(s.Duration)
+	}
+	return -1, 0
+}
+
+// loopSource reads the capture in order, over and over again
+type loopSource struct {
+	sync.Mutex
+	files  []string
+	codec  protocol.Codec
+	reader *ReinforcedReader
+	// timestamps of the capture
+	first int64
+	last  int64
+	// added to the offsets of the messages, it grows by the span of the capture in each loop
+	loopOffset int64
+	next       *protocol.Message
+}
+
+func newLoopSource(files []string, codec protocol.Codec) *loopSource {
+	return &loopSource{files: files, codec: codec, reader: NewReinforcedReader(files, codec), first: -1}
+}
+
+// peek returns the next message and its offset from the start of the replay in recorded time,
+// nil if the capture has no message or can't be read
+func (s *loopSource) peek() (*protocol.Message, int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	for s.next == nil {
+		msg, err := s.reader.ReadMessage()
+		if err == io.EOF && s.first >= 0 {
+			s.reader.Close() // nolint: errcheck
+			s.reader = NewReinforcedReader(s.files, s.codec)
+			s.loopOffset += s.last - s.first + 1
+			slog.Info("FileDirInput, replay the capture again")
+			continue
+		}
+		if err != nil {
+			slog.Error("FileDirInput, stop the load profile, error:%v", err)
+			return nil, 0
+		}
+		if s.first < 0 {
+			s.first = msg.Meta.Timestamp
+		}
+		s.last = max(s.last, msg.Meta.Timestamp)
+		s.next = msg
+	}
+	return s.next, s.next.Meta.Timestamp - s.first + s.loopOffset
+}
+
+func (s *loopSource) pop() {
+	s.Lock()
+	defer s.Unlock()
+	s.next = nil
+}
+
+func (s *loopSource) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.reader.Close()
+}
+
+// replayProfile releases the messages of source according to the profile, until it ends
+func replayProfile(profile *LoadProfile, source *loopSource, emit func(msg *protocol.Message)) {
+	ticker := time.NewTicker(profileTick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	last := start
+	stage := -1
+	// the recorded time replayed in the stages with speed
+	var position int64
+	// the messages which should have been sent in the stages with rps
+	var credits float64
+	for now := range ticker.C {
+		i, value := profile.rate(now.Sub(start))
+		if i < 0 {
+			slog.Info("FileDirInput, the load profile ends after %v", profile.Duration())
+			return
+		}
+		if i != stage {
+			slog.Info("FileDirInput, load profile stage %v, %+v", i, *profile.Stages[i])
+			// continue from the next message, whatever the time spent in the stages with rps
+			if profile.Stages[i].Speed > 0 && (stage < 0 || profile.Stages[stage].Speed <= 0) {
+				if _, offset := source.peek(); offset > position {
+					position = offset
+				}
+			}
+			stage = i
+		}
+		dt := now.Sub(last)
+		last = now
+
+		if profile.Stages[i].Speed > 0 {
+			position += int64(value * float64(dt))
+			for {
+				msg, offset := source.peek()
+				if msg == nil {
+					return
+				}
+				if offset > position {
+					break
+				}
+				source.pop()
+				emit(msg)
+			}
+			continue
+		}
+
+		// a blocked output doesn't cause a burst afterwards
+		credits = min(credits+value*dt.Seconds(), max(value, 1))
+		for ; credits >= 1; credits-- {
+			msg, _ := source.peek()
+			if msg == nil {
+				return
+			}
+			source.pop()
+			emit(msg)
+		}
+	}
+}
+
+// replayClosedLoop sends the messages of source one after another, ignoring the timestamps
+func replayClosedLoop(source *loopSource, msgChan chan *protocol.Message) {
+	for {
+		msg, _ := source.peek()
+		if msg == nil {
+			return
+		}
+		source.pop()
+		msgChan <- msg
+	}
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadProfileFromFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profile.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"duration":"10s","speed":2,"ramp":true},
+		{"duration":"10s","speed":4,"ramp":true},{"duration":"5s","rps":100}]`), 0644))
+	p, err := LoadProfileFromFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 25*time.Second, p.Duration())
+
+	i, value := p.rate(5 * time.Second)
+	assert.Equal(t, 0, i)
+	assert.InDelta(t, 1, value, 0.001)
+	i, value = p.rate(15 * time.Second)
+	assert.Equal(t, 1, i)
+	assert.InDelta(t, 3, value, 0.001)
+	i, value = p.rate(21 * time.Second)
+	assert.Equal(t, 2, i)
+	assert.InDelta(t, 100, value, 0.001)
+	i, _ = p.rate(25 * time.Second)
+	assert.Equal(t, -1, i)
+
+	for _, content := range []string{`[]`, `[{"duration":"1s"}]`, `[{"duration":"1s","speed":1,"rps":1}]`,
+		`[{"duration":"x","speed":1}]`} {
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+		_, err = LoadProfileFromFile(path)
+		assert.NotNil(t, err, content)
+	}
+}
+
+func writeCapture(t *testing.T, timestamps ...int64) string {
+	codec := protocol.GetCodec("simple")
+	var content []byte
+	for _, ts := range timestamps {
+		data, err := codec.Marshal(&protocol.Message{Meta: protocol.Meta{Version: 2, Timestamp: ts},
+			Method: "/SearchService/Search", Request: &protocol.MsgItem{Body: "{}"}})
+		assert.Nil(t, err)
+		content = append(content, data...)
+		content = append(content, '\n', '\n')
+	}
+	path := filepath.Join(t.TempDir(), "capture.log")
+	assert.Nil(t, os.WriteFile(path, content, 0644))
+	return path
+}
+
+func TestReplayProfile(t *testing.T) {
+	path := writeCapture(t, 0, int64(10*time.Millisecond), int64(20*time.Millisecond), int64(time.Second))
+
+	// recorded rate, only the first 3 messages are due
+	source := newLoopSource([]string{path}, protocol.GetCodec("simple"))
+	count := 0
+	replayProfile(&LoadProfile{Stages: []*Stage{{Duration: 200 * time.Millisecond, Speed: 1}}}, source,
+		func(msg *protocol.Message) { count++ })
+	assert.Equal(t, 3, count)
+	assert.Nil(t, source.Close())
+
+	// fixed rate, the capture is replayed again
+	source = newLoopSource([]string{path}, protocol.GetCodec("simple"))
+	count = 0
+	replayProfile(&LoadProfile{Stages: []*Stage{{Duration: 200 * time.Millisecond, RPS: 100}}}, source,
+		func(msg *protocol.Message) { count++ })
+	assert.InDelta(t, 20, count, 6)
+	assert.Nil(t, source.Close())
+}
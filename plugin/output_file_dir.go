@@ -2,7 +2,9 @@ package plugin
 
 import (
 	"github.com/pkg/errors"
+	"github.com/vearne/grpcreplay/http2"
 	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
 	"path/filepath"
@@ -27,16 +29,22 @@ type FileDirOutputConfig struct {
 	// MaxAge is the maximum number of days to retain old log files based on the
 	// timestamp encoded in their filename.
 	MaxAge int `json:"maxAge"`
+	// (optional) used to save the descriptors of the captured methods
+	Finder http2.PBFinder `json:"-"`
 }
 
 type FileDirOutput struct {
 	codec  protocol.Codec
+	path   string
 	logger *lumberjack.Logger
+	// nil if the descriptors are unknown
+	descWriter *DescriptorWriter
 }
 
 func NewFileDirOutput(codec string, path string, cf *FileDirOutputConfig) *FileDirOutput {
 	var ouput FileDirOutput
 	ouput.codec = protocol.GetCodec(codec)
+	ouput.path = path
 	ouput.logger = &lumberjack.Logger{
 		Filename:   filepath.Join(path, "capture.log"),
 		MaxSize:    cf.MaxSize, // megabytes
@@ -44,9 +52,17 @@ func NewFileDirOutput(codec string, path string, cf *FileDirOutputConfig) *FileD
 		MaxAge:     cf.MaxAge, //days
 		Compress:   true,      // disabled by default
 	}
+	if cf.Finder != nil {
+		ouput.descWriter = NewDescriptorWriter(path, cf.Finder)
+	}
 	return &ouput
 }
 
+// String distinguishes the outputs of several --output-file-directory in the metrics
+func (o *FileDirOutput) String() string {
+	return "FileDirOutput:" + o.path
+}
+
 func (o *FileDirOutput) Close() error {
 	return o.logger.Close()
 }
@@ -56,14 +72,18 @@ func (o *FileDirOutput) Write(msg *protocol.Message) (err error) {
 		data []byte
 	)
 
-	data, err = o.codec.Marshal(msg)
-	if err != nil {
-		return err
+	if o.descWriter != nil {
+		// the capture can still be decoded with --proto or reflection
+		if descErr := o.descWriter.Save(msg.Method); descErr != nil {
+			slog.Warn("FileDirOutput, save descriptors, method:%v, error:%v", msg.Method, descErr)
+		}
 	}
-	_, err = o.logger.Write(data)
+
+	data, err = o.codec.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	_, err = o.logger.Write([]byte{'\n', '\n'})
+	// a single Write, the records of concurrent writers don't interleave
+	_, err = o.logger.Write(append(data, '\n', '\n'))
 	return err
 }
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileDirOutputConcurrentWrite(t *testing.T) {
+	dir := t.TempDir()
+	o := NewFileDirOutput("simple", dir, &FileDirOutputConfig{MaxSize: 100})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				msg := &protocol.Message{Meta: protocol.Meta{Version: 2, UUID: strconv.Itoa(i*1000 + j)},
+					Method:  "/SearchService/Search",
+					Request: &protocol.MsgItem{Body: `{"staffName":"` + strings.Repeat("x", 1000) + `"}`}}
+				assert.Nil(t, o.Write(msg))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, o.Close())
+
+	reader := NewReinforcedReader([]string{filepath.Join(dir, "capture.log")}, protocol.GetCodec("simple"))
+	defer reader.Close() // nolint: errcheck
+	uuids := make(map[string]bool)
+	for {
+		msg, err := reader.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		uuids[msg.Meta.UUID] = true
+	}
+	assert.Equal(t, 4000, len(uuids))
+	assert.Equal(t, 0, reader.Skipped)
+}
@@ -4,14 +4,24 @@ import (
 	"context"
 	"fmt"
 	"github.com/fullstorydev/grpcurl"
-	"github.com/jhump/protoreflect/desc" // nolint: staticcheck
+	protoV1 "github.com/golang/protobuf/proto" // nolint: staticcheck
+	"github.com/jhump/protoreflect/desc"       // nolint: staticcheck
 	"github.com/patrickmn/go-cache"
+	"github.com/vearne/grpcreplay/balance"
 	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/metrics"
 	"github.com/vearne/grpcreplay/protocol"
 	slog "github.com/vearne/simplelog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type DescSrcWrapper struct {
@@ -19,13 +29,27 @@ type DescSrcWrapper struct {
 	innerCache *cache.Cache
 }
 
+// NewDescSrcWrapper caches the descriptors of descSource.
+// If descSource can be refreshed, the cached descriptors expire after http2.DescriptorTTL.
 func NewDescSrcWrapper(descSource grpcurl.DescriptorSource) *DescSrcWrapper {
 	var s DescSrcWrapper
 	s.descSource = descSource
 	s.innerCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	if _, ok := descSource.(http2.DescSourceRefresher); ok && http2.DescriptorTTL > 0 {
+		s.innerCache = cache.New(http2.DescriptorTTL, http2.DescriptorTTL)
+	}
 	return &s
 }
 
+func (s *DescSrcWrapper) Refresh() bool {
+	r, ok := s.descSource.(http2.DescSourceRefresher)
+	if !ok || !r.Refresh() {
+		return false
+	}
+	s.innerCache.Flush()
+	return true
+}
+
 func (s *DescSrcWrapper) ListServices() ([]string, error) {
 	if value, exist := s.innerCache.Get("ListServices"); exist {
 		return (value).([]string), nil
@@ -36,7 +60,7 @@ func (s *DescSrcWrapper) ListServices() ([]string, error) {
 		return nil, err
 	}
 
-	s.innerCache.Set("ListServices", itemList, cache.NoExpiration)
+	s.innerCache.Set("ListServices", itemList, cache.DefaultExpiration)
 	return itemList, nil
 }
 
@@ -52,7 +76,7 @@ func (s *DescSrcWrapper) FindSymbol(fullyQualifiedName string) (desc.Descriptor,
 		return nil, err
 	}
 
-	s.innerCache.Set(key, descriptor, cache.NoExpiration)
+	s.innerCache.Set(key, descriptor, cache.DefaultExpiration)
 	return descriptor, nil
 }
 
@@ -68,31 +92,114 @@ func (s *DescSrcWrapper) AllExtensionsForType(typeName string) ([]*desc.FieldDes
 		return nil, err
 	}
 
-	s.innerCache.Set(key, descriptors, cache.NoExpiration)
+	s.innerCache.Set(key, descriptors, cache.DefaultExpiration)
 	return descriptors, nil
 }
 
+// OutputTarget is a server the requests are sent to, besides the address of GRPCOutput
+type OutputTarget struct {
+	Addr   string
+	Finder http2.PBFinder
+	// (optional) transport and per-call credentials, plaintext by default
+	DialOptions []grpc.DialOption
+	// DialOptions contain per-call credentials, the recorded authorization header is not sent
+	PerRPCCredentials bool
+}
+
+type GRPCOutputConfig struct {
+	WorkerNum int
+	// (optional) transport and per-call credentials, plaintext by default
+	DialOptions []grpc.DialOption
+	// DialOptions contain per-call credentials, the recorded authorization header is not sent
+	PerRPCCredentials bool
+	// (optional) compare the responses with the recorded ones
+	Comparator *ResponseComparator
+	// (optional) rewrite the request headers before sending
+	HeaderRewriter *HeaderRewriter
+	// (optional) send the methods to other targets or rename them, the first matching route is used
+	Routes []*Route
+	// the routes are shared with another output which sends the messages to their targets,
+	// the messages matching a route with a target are skipped, so that each is sent once
+	SkipRouteTargets bool
+	// (optional) the key of balance.PolicyHash
+	HashKey *balance.HashKey
+	// (optional) produce a message with the result of each call, which is returned by Read
+	Results bool
+	// (optional) the deadlines of the calls, no deadline if nil
+	Deadline *Deadline
+	// (optional) retry the failed calls
+	Retry *RetryPolicy
+	// (optional) pause the calls to the target while it is unhealthy
+	Breaker *BreakerConfig
+	// (optional) the messages which fail to be replayed are written to it
+	DeadLetter MessageWriter
+	// (optional) keep the order of the messages in each partition, no order if nil
+	Partition *Partition
+	// (optional) send the unary calls with grpc.ClientConn.Invoke instead of grpcurl,
+	// the responses are not printed to stdout
+	Native bool
+	// (optional) closed-loop replay, WorkerNum is ignored
+	Concurrency *ConcurrencyConfig
+	// (optional) collects the latencies and the status codes of the calls,
+	// each retry is recorded as a call, the waits of the circuit breaker and the backoffs are not included
+	Report *ReplayReport
+}
+
+// MessageWriter is the output of the messages
+type MessageWriter interface {
+	Write(msg *protocol.Message) error
+}
+
 type GRPCOutput struct {
-	descSource grpcurl.DescriptorSource
-	cc         *grpc.ClientConn
-	msgChannel chan *protocol.Message
+	descSource *DescSrcWrapper
+	// one channel shared by the workers, or one channel per worker if partition isn't nil
+	msgChannels []chan *protocol.Message
+	partition   *Partition
+	// the channel of the next message without partition key
+	next atomic.Uint32
+	// nil if GRPCOutputConfig.Results is false
+	results chan *protocol.Message
+	addr    string
+	// the number of messages which fail to be replayed
+	failed *atomic.Int64
+	// nil if GRPCOutputConfig.Concurrency is nil
+	control *concurrencyControl
 }
 
-func NewGRPCOutput(addr string, workerNum int, finder http2.PBFinder) *GRPCOutput {
-	var err error
+// NewGRPCOutput creates an output sending messages to addr
+func NewGRPCOutput(addr string, finder http2.PBFinder, cf *GRPCOutputConfig) *GRPCOutput {
 	var o GRPCOutput
 
-	ctx := context.Background()
-	o.cc, err = grpcurl.BlockingDial(ctx, "tcp", addr, nil)
-	if err != nil {
-		slog.Fatal("grpcurl.BlockingDial :%v", err)
-	}
 	// 通过反射获取接口定义
 	o.descSource = NewDescSrcWrapper(finder.GetDescriptorSource())
-	o.msgChannel = make(chan *protocol.Message, 100)
+	o.partition = cf.Partition
+	workerNum := cf.WorkerNum
+	// the input is blocked while the calls are in flight
+	size := 100
+	if cf.Concurrency != nil {
+		workerNum = cf.Concurrency.maxConcurrency()
+		size = 0
+	}
+	o.msgChannels = []chan *protocol.Message{make(chan *protocol.Message, size)}
+	if o.partition != nil {
+		for i := 1; i < workerNum; i++ {
+			o.msgChannels = append(o.msgChannels, make(chan *protocol.Message, size))
+		}
+	}
+	o.control = newConcurrencyControl(cf.Concurrency, addr)
+	o.addr = addr
+	o.failed = &atomic.Int64{}
+	if cf.Results {
+		o.results = make(chan *protocol.Message, 100)
+	}
 
+	routeDescSources := newRouteDescSources(cf.Routes)
 	for i := 0; i < workerNum; i++ {
-		worker := NewGrpcWorker(addr, o.msgChannel, o.descSource)
+		worker := NewGrpcWorker(addr, o.msgChannels[i%len(o.msgChannels)], o.descSource, cf)
+		worker.results = o.results
+		worker.failed = o.failed
+		worker.control = o.control
+		worker.routes = newWorkerRoutes(worker, finder, routeDescSources, cf)
 		go worker.execute()
 	}
 
@@ -100,16 +207,79 @@ func NewGRPCOutput(addr string, workerNum int, finder http2.PBFinder) *GRPCOutpu
 	return &o
 }
 
+// Close stops the workers, they close their connections after the messages in the channel are sent
 func (o *GRPCOutput) Close() error {
-	close(o.msgChannel)
-	return o.cc.Close()
+	for _, ch := range o.msgChannels {
+		close(ch)
+	}
+	o.control.close()
+	slog.Info("close grpc output, addr:%v, failed messages:%v", o.addr, o.Failed())
+	return nil
+}
+
+func (o *GRPCOutput) String() string {
+	return grpcOutputName(o.addr)
+}
+
+func grpcOutputName(addr string) string {
+	return "GRPCOutput:" + addr
+}
+
+// Failed returns the number of messages which fail to be replayed
+func (o *GRPCOutput) Failed() int64 {
+	return o.failed.Load()
 }
 
 func (o *GRPCOutput) Write(msg *protocol.Message) (err error) {
-	o.msgChannel <- msg
+	// the results of the outputs are not replayed again
+	if msg.Replay != nil {
+		return nil
+	}
+	o.channel(msg) <- msg
 	return nil
 }
 
+// channel returns the channel of the worker sending the message
+func (o *GRPCOutput) channel(msg *protocol.Message) chan *protocol.Message {
+	n := uint64(len(o.msgChannels))
+	if n == 1 {
+		return o.msgChannels[0]
+	}
+	key := o.partition.Value(msg)
+	if len(key) <= 0 {
+		return o.msgChannels[uint64(o.next.Add(1))%n]
+	}
+	return o.msgChannels[balance.Hash64(key)%n]
+}
+
+// Results returns the reader of the results of the calls, nil if GRPCOutputConfig.Results is false
+func (o *GRPCOutput) Results() *GRPCResults {
+	if o.results == nil {
+		return nil
+	}
+	return &GRPCResults{results: o.results, addr: o.addr}
+}
+
+// GRPCResults reads the results of the calls of a GRPCOutput, see GRPCOutputConfig.Results
+type GRPCResults struct {
+	results chan *protocol.Message
+	addr    string
+}
+
+func (r *GRPCResults) Read() (*protocol.Message, error) {
+	msg := <-r.results
+	return msg, nil
+}
+
+// Close does nothing, the results are sent by the workers of the GRPCOutput
+func (r *GRPCResults) Close() error {
+	return nil
+}
+
+func (r *GRPCResults) String() string {
+	return "GRPCResults:" + r.addr
+}
+
 func convertHeader(msg *protocol.Message) (headers []string) {
 	headers = make([]string, 0, len(msg.Request.Headers))
 	for key, value := range msg.Request.Headers {
@@ -120,48 +290,282 @@ func convertHeader(msg *protocol.Message) (headers []string) {
 	return headers
 }
 
+const headerAuthorization = "authorization"
+
 func IsPseudo(key string) bool {
 	return strings.HasPrefix(key, ":")
 }
 
+const (
+	resolveRetryMin = time.Second
+	resolveRetryMax = 30 * time.Second
+)
+
 type GrpcWorker struct {
+	addr       string
 	msgChannel chan *protocol.Message
-	descSource grpcurl.DescriptorSource
+	descSource *DescSrcWrapper
 	cc         *grpc.ClientConn
+	comparator *ResponseComparator
+	rewriter   *HeaderRewriter
+	routes     []*workerRoute
+	hashKey    *balance.HashKey
+	// (optional) the results of the calls are sent to it
+	results  chan *protocol.Message
+	deadline *Deadline
+	retry    *RetryPolicy
+	breaker  *CircuitBreaker
+	// (optional) counts the messages which fail to be replayed
+	failed     *atomic.Int64
+	deadLetter MessageWriter
+	native     bool
+	// the authorization header is sent by the per-call credentials instead
+	dropAuthorization bool
+	// (optional) shared by the workers of the output
+	control *concurrencyControl
+	report  *ReplayReport
 }
 
-func NewGrpcWorker(addr string, msgChannel chan *protocol.Message, descSource grpcurl.DescriptorSource) *GrpcWorker {
+// NewGrpcWorker creates a worker sending messages to addr.
+// The connection is established lazily and re-established after the target restarts,
+// the calls wait until it is ready.
+func NewGrpcWorker(addr string, msgChannel chan *protocol.Message, descSource *DescSrcWrapper,
+	cf *GRPCOutputConfig) *GrpcWorker {
 	var err error
 	var w GrpcWorker
+	w.addr = addr
 	w.msgChannel = msgChannel
 	w.descSource = descSource
-
-	w.cc, err = grpcurl.BlockingDial(context.Background(), "tcp", addr, nil)
+	w.comparator = cf.Comparator
+	w.rewriter = cf.HeaderRewriter
+	w.hashKey = cf.HashKey
+	w.deadline = cf.Deadline
+	w.retry = cf.Retry
+	w.breaker = getBreaker(addr, cf.Breaker)
+	w.deadLetter = cf.DeadLetter
+	w.native = cf.Native
+	w.report = cf.Report
+	w.dropAuthorization = cf.PerRPCCredentials
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.WaitForReady(true))}
+	w.cc, err = grpc.NewClient(addr, append(opts, cf.DialOptions...)...)
 	if err != nil {
-		slog.Fatal("grpcurl.BlockingDial :%v", err)
+		slog.Fatal("grpc.NewClient, addr:%v, error:%v", addr, err)
 	}
 
 	return &w
 }
 
 func (w *GrpcWorker) execute() {
+	defer w.cc.Close()
+	for _, route := range w.routes {
+		if route.worker != nil && route.worker != w {
+			defer route.worker.cc.Close()
+		}
+	}
+
 	for msg := range w.msgChannel {
-		err := w.Call(msg)
+		w.control.acquire()
+		start := time.Now()
+		err := w.dispatch(msg)
+		w.control.done(time.Since(start), err != nil)
 		if err != nil {
 			slog.Error("Call, message:%v, error:%v", msg.Method, err)
+			w.fail(msg)
 		}
 	}
 }
 
-func (w *GrpcWorker) Call(msg *protocol.Message) (err error) {
+// fail counts the message and writes it to the dead letter output
+func (w *GrpcWorker) fail(msg *protocol.Message) {
+	if w.failed != nil {
+		w.failed.Add(1)
+		metrics.OutputWriteErrors.WithLabelValues(grpcOutputName(w.addr)).Inc()
+	}
+	if w.deadLetter != nil {
+		if err := w.deadLetter.Write(msg); err != nil {
+			slog.Error("dead letter, message:%v, error:%v", msg.Method, err)
+		}
+	}
+}
+
+// waitForDescriptors blocks until the descriptors of the method can be obtained,
+// e.g. the reflection service has not been started yet
+func (w *GrpcWorker) waitForDescriptors(method string) error {
+	// /proto.SearchService/Search  ->  proto.SearchService
+	svc := strings.TrimPrefix(method, "/")
+	if pos := strings.LastIndex(svc, "/"); pos >= 0 {
+		svc = svc[:pos]
+	}
+
+	backoff := resolveRetryMin
+	for {
+		_, err := w.descSource.FindSymbol(svc)
+		if err == nil || !http2.IsUnavailable(err) {
+			return err
+		}
+		slog.Warn("addr:%v, descriptors of %v are unavailable, retry after %v, error:%v",
+			w.addr, method, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, resolveRetryMax)
+	}
+}
+
+func (w *GrpcWorker) headers(msg *protocol.Message) []string {
+	var headers []string
+	if w.rewriter != nil {
+		headers = w.rewriter.Rewrite(msg)
+	} else {
+		headers = convertHeader(msg)
+	}
+	// the deadline of the call is sent instead, and the token of the per-call credentials
+	return slices.DeleteFunc(headers, func(header string) bool {
+		key, _, _ := strings.Cut(header, ":")
+		return key == headerGRPCTimeout || (w.dropAuthorization && strings.EqualFold(key, headerAuthorization))
+	})
+}
+
+// Call sends the message, an error is returned if the message can't be sent or the target is unhealthy
+func (w *GrpcWorker) Call(msg *protocol.Message) error {
+	compare := w.comparator != nil && msg.Response != nil
+
+	start := time.Now()
+	resp, err := w.sendWithRetry(msg, compare || w.results != nil)
+	if w.results != nil {
+		result := newResultMessage(w.addr, msg, start, resp, err)
+		result.Replay.Timeout = w.deadline.Timeout(msg).Nanoseconds()
+		w.results <- result
+	}
+	if err != nil {
+		return err
+	}
+	if compare {
+		record := w.comparator.Compare(w.addr, msg, resp.Status, resp.Body)
+		if !record.Match {
+			slog.Debug("response mismatch, method:%v, uuid:%v", msg.Method, msg.Meta.UUID)
+		}
+	}
+	if code := resp.Status.Code(); isTargetFailure(code) || w.retry.retryable(code) {
+		return resp.Status.Err()
+	}
+	return nil
+}
+
+// Response is the result of a call
+type Response struct {
+	Status *status.Status
+	// json, empty if the call failed
+	Body string
+	// response headers and trailers, the first value of each key
+	Headers map[string]string
+	Latency time.Duration
+}
+
+// newResultMessage copies msg with the result of sending it to target
+func newResultMessage(target string, msg *protocol.Message, start time.Time,
+	resp *Response, err error) *protocol.Message {
+	result := *msg
+	result.Replay = &protocol.ReplayResult{Target: target, Timestamp: start.UnixNano()}
+	if err != nil {
+		// not a status error if the call failed in grpcr, e.g. the request doesn't match the descriptors
+		st := status.Convert(err)
+		result.Replay.Code = int(st.Code())
+		result.Replay.Message = st.Message()
+		return &result
+	}
+	result.Replay.Code = int(resp.Status.Code())
+	result.Replay.Message = resp.Status.Message()
+	result.Replay.Latency = resp.Latency.Nanoseconds()
+	result.Replay.Response = &protocol.MsgItem{Headers: resp.Headers, Body: resp.Body}
+	return &result
+}
+
+// Fetch sends the message and returns the response instead of printing it
+func (w *GrpcWorker) Fetch(msg *protocol.Message) (*Response, error) {
+	return w.sendWithRetry(msg, true)
+}
+
+// sendWithRetry waits while the circuit breaker is open, and retries the call according to the retry policy
+func (w *GrpcWorker) sendWithRetry(msg *protocol.Message, keepResponse bool) (*Response, error) {
+	for attempt := 1; ; attempt++ {
+		w.breaker.Wait()
+		sent := time.Now()
+		resp, err := w.send(msg, keepResponse)
+		var code codes.Code
+		if err != nil {
+			code = status.Code(err)
+			w.report.record(w.addr, msg.Method, time.Since(sent), code)
+		} else {
+			code = resp.Status.Code()
+			w.report.record(w.addr, msg.Method, resp.Latency, code)
+		}
+		if _, ok := status.FromError(err); ok {
+			w.breaker.Done(code)
+		} else {
+			// the errors of grpcr itself say nothing about the health of the target
+			w.breaker.Skip()
+		}
+
+		// the errors of grpcr itself are not retried, e.g. the request doesn't match the descriptors
+		if err != nil || !w.retry.retryable(code) || attempt >= w.retry.MaxAttempts {
+			return resp, err
+		}
+		backoff := w.retry.backoff(attempt)
+		slog.Warn("Call, method:%v, attempt:%v, code:%v, retry after %v", msg.Method, attempt, code, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+func (w *GrpcWorker) send(msg *protocol.Message, keepResponse bool) (*Response, error) {
 	if len(msg.Method) <= 0 {
 		slog.Error("invalid msg:%v", msg)
-		return fmt.Errorf("invalid msg:%v", msg)
+		return nil, fmt.Errorf("invalid msg:%v", msg)
 	}
 
-	in := strings.NewReader(msg.Request.Body)
+	err := w.waitForDescriptors(msg.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.invoke(msg, keepResponse)
+	// an error without status comes from grpcr itself, e.g. the request has fields unknown to the descriptors
+	if _, ok := status.FromError(err); !ok && w.descSource.Refresh() {
+		slog.Info("Call, method:%v, descriptors refreshed, error:%v", msg.Method, err)
+		resp, err = w.invoke(msg, keepResponse)
+	}
+	return resp, err
+}
 
+// invoke prints the response to stdout, or returns it if keepResponse is true.
+// The status of the call is always returned.
+func (w *GrpcWorker) invoke(msg *protocol.Message, keepResponse bool) (*Response, error) {
 	slog.Debug("Request:%v", msg.Request.Body)
+	headers := w.headers(msg)
+	ctx := context.Background()
+	if w.hashKey != nil {
+		if key := w.hashKey.Value(msg); len(key) > 0 {
+			ctx = balance.WithHashKey(ctx, key)
+		}
+	}
+	if timeout := w.deadline.Timeout(msg); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if w.native {
+		m, err := w.descSource.nativeMethod(msg.Method)
+		if err != nil {
+			return nil, err
+		}
+		// the streaming methods are sent by grpcurl
+		if m != nil {
+			return w.invokeNative(ctx, m, msg, headers, keepResponse)
+		}
+	}
+
+	in := strings.NewReader(msg.Request.Body)
 	// if not verbose output, then also include record delimiters
 	// between each message, so output could potentially be piped
 	// to another grpcurl process
@@ -172,13 +576,7 @@ func (w *GrpcWorker) Call(msg *protocol.Message) (err error) {
 	}
 	rf, formatter, err := grpcurl.RequestParserAndFormatter(grpcurl.FormatJSON, w.descSource, in, options)
 	if err != nil {
-		slog.Fatal("grpcurl.RequestParserAndFormatter :%v", err)
-	}
-
-	h := &grpcurl.DefaultEventHandler{
-		Out:            os.Stdout,
-		Formatter:      formatter,
-		VerbosityLevel: 0,
+		return nil, fmt.Errorf("grpcurl.RequestParserAndFormatter:%w", err)
 	}
 
 	symbol := msg.Method
@@ -187,7 +585,63 @@ func (w *GrpcWorker) Call(msg *protocol.Message) (err error) {
 		symbol = symbol[1:]
 	}
 
-	headers := convertHeader(msg)
-	err = grpcurl.InvokeRPC(context.Background(), w.descSource, w.cc, symbol, headers, h, rf.Next)
-	return err
+	if !keepResponse {
+		h := &grpcurl.DefaultEventHandler{
+			Out:            os.Stdout,
+			Formatter:      formatter,
+			VerbosityLevel: 0,
+		}
+		start := time.Now()
+		err = grpcurl.InvokeRPC(ctx, w.descSource, w.cc, symbol, headers, h, rf.Next)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Status: h.Status, Latency: time.Since(start)}, nil
+	}
+
+	h := &responseRecorder{formatter: formatter, headers: make(map[string]string)}
+	start := time.Now()
+	err = grpcurl.InvokeRPC(ctx, w.descSource, w.cc, symbol, headers, h, rf.Next)
+	latency := time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if h.err != nil {
+		return nil, h.err
+	}
+	return &Response{Status: h.status, Body: h.body, Headers: h.headers, Latency: latency}, nil
+}
+
+// responseRecorder is a grpcurl.InvocationEventHandler which keeps the response instead of printing it
+type responseRecorder struct {
+	formatter grpcurl.Formatter
+	body      string
+	status    *status.Status
+	headers   map[string]string
+	err       error
+}
+
+func (r *responseRecorder) OnResolveMethod(*desc.MethodDescriptor) {}
+
+func (r *responseRecorder) OnSendHeaders(metadata.MD) {}
+
+func (r *responseRecorder) OnReceiveHeaders(md metadata.MD) {
+	r.addHeaders(md)
+}
+
+func (r *responseRecorder) OnReceiveResponse(resp protoV1.Message) {
+	r.body, r.err = r.formatter(resp)
+}
+
+func (r *responseRecorder) OnReceiveTrailers(st *status.Status, md metadata.MD) {
+	r.status = st
+	r.addHeaders(md)
+}
+
+func (r *responseRecorder) addHeaders(md metadata.MD) {
+	for key, values := range md {
+		if len(values) > 0 {
+			r.headers[key] = values[0]
+		}
+	}
 }
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/protobuf/encoding/protojson"
+	"regexp"
+)
+
+// Route sends the methods matching Method to Target, and renames them if Rewrite is specified
+type Route struct {
+	Method *regexp.Regexp
+	// (optional) the new method, may reference the groups of Method,
+	// e.g. Method "^/v1\.SearchService/(.*)$" and Rewrite "/v2.SearchService/$1"
+	Rewrite string
+	// (optional) the address of GRPCOutput if nil
+	Target *OutputTarget
+}
+
+// workerRoute is a Route bound to the worker sending to its target
+type workerRoute struct {
+	*Route
+	// nil if the target is handled by another output
+	worker *GrpcWorker
+	// checks the renamed requests
+	finder http2.PBFinder
+}
+
+// newWorkerRoutes creates a worker for each route with its own target,
+// descSources are shared by the workers of the output
+func newWorkerRoutes(output *GrpcWorker, finder http2.PBFinder, descSources []*DescSrcWrapper,
+	cf *GRPCOutputConfig) []*workerRoute {
+	routes := make([]*workerRoute, 0, len(cf.Routes))
+	for i, route := range cf.Routes {
+		wr := &workerRoute{Route: route, worker: output, finder: finder}
+		if route.Target != nil && cf.SkipRouteTargets {
+			wr.worker = nil
+		} else if route.Target != nil {
+			wr.worker = NewGrpcWorker(route.Target.Addr, nil, descSources[i], &GRPCOutputConfig{
+				DialOptions:       route.Target.DialOptions,
+				PerRPCCredentials: route.Target.PerRPCCredentials,
+				Comparator:        cf.Comparator,
+				HeaderRewriter:    cf.HeaderRewriter,
+				Deadline:          cf.Deadline,
+				Retry:             cf.Retry,
+				Breaker:           cf.Breaker,
+				Native:            cf.Native,
+				Report:            cf.Report,
+			})
+			wr.worker.results = output.results
+			wr.finder = route.Target.Finder
+		}
+		routes = append(routes, wr)
+	}
+	return routes
+}
+
+func newRouteDescSources(routes []*Route) []*DescSrcWrapper {
+	descSources := make([]*DescSrcWrapper, len(routes))
+	for i, route := range routes {
+		if route.Target != nil {
+			descSources[i] = NewDescSrcWrapper(route.Target.Finder.GetDescriptorSource())
+		}
+	}
+	return descSources
+}
+
+// dispatch sends the message with the worker of the first matching route, w if none matches
+func (w *GrpcWorker) dispatch(msg *protocol.Message) error {
+	for _, route := range w.routes {
+		if !route.Method.MatchString(msg.Method) {
+			continue
+		}
+		if route.worker == nil {
+			// sent by another output
+			return nil
+		}
+		if len(route.Rewrite) > 0 {
+			// the message is shared with the other outputs
+			renamed := *msg
+			renamed.Method = route.Method.ReplaceAllString(msg.Method, route.Rewrite)
+			err := route.worker.checkRequest(route.finder, &renamed)
+			if err != nil {
+				return fmt.Errorf("%v renamed to %v, %w", msg.Method, renamed.Method, err)
+			}
+			msg = &renamed
+		}
+		return route.worker.Call(msg)
+	}
+	return w.Call(msg)
+}
+
+// checkRequest makes sure the request body is valid for the input type of the method
+func (w *GrpcWorker) checkRequest(finder http2.PBFinder, msg *protocol.Message) error {
+	err := w.waitForDescriptors(msg.Method)
+	if err != nil {
+		return err
+	}
+	mio, err := finder.Get(msg.Method)
+	if err != nil {
+		return err
+	}
+	err = protojson.Unmarshal([]byte(msg.Request.Body), mio.InType)
+	if err != nil {
+		return fmt.Errorf("request doesn't match the input type %v:%w",
+			mio.InType.ProtoReflect().Descriptor().FullName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	pb "github.com/vearne/grpcreplay/example/service_proto"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc"
+	"net"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGrpcWorkerRoute(t *testing.T) {
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	cf := &GRPCOutputConfig{Routes: []*Route{{
+		Method:  regexp.MustCompile(`^/SearchService/Search$`),
+		Rewrite: "/SearchService/SendMuchData",
+	}}}
+	w := NewGrpcWorker("127.0.0.1:35001", nil, NewDescSrcWrapper(finder.GetDescriptorSource()), cf)
+	defer w.cc.Close()
+	w.routes = newWorkerRoutes(w, finder, newRouteDescSources(cf.Routes), cf)
+
+	// SearchRequest has no field books
+	msg := &protocol.Message{
+		Method:  "/SearchService/Search",
+		Request: &protocol.MsgItem{Body: `{"staffName":"x"}`},
+	}
+	err := w.dispatch(msg)
+	assert.ErrorContains(t, err, "renamed to /SearchService/SendMuchData")
+	assert.Equal(t, "/SearchService/Search", msg.Method)
+
+	msg.Request.Body = `{"requestId":"1","books":[{"name":"a"}]}`
+	assert.Nil(t, w.checkRequest(finder, &protocol.Message{Method: "/SearchService/SendMuchData",
+		Request: msg.Request}))
+}
+
+type countingServer struct {
+	pb.UnimplementedSearchServiceServer
+	calls atomic.Int64
+}
+
+func (s *countingServer) Search(ctx context.Context, in *pb.SearchRequest) (*pb.SearchResponse, error) {
+	s.calls.Add(1)
+	return &pb.SearchResponse{StaffID: 100, StaffName: in.StaffName}, nil
+}
+
+func startCountingServer(t *testing.T) (*countingServer, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &countingServer{}
+	server := grpc.NewServer()
+	pb.RegisterSearchServiceServer(server, s)
+	go server.Serve(lis) // nolint: errcheck
+	t.Cleanup(server.Stop)
+	return s, lis.Addr().String()
+}
+
+func TestGRPCOutputsShareRouteTarget(t *testing.T) {
+	finder := http2.NewFilePBFinder([]string{"testdata/search.proto"}, "../http2")
+	routed, routedAddr := startCountingServer(t)
+	first, firstAddr := startCountingServer(t)
+	second, secondAddr := startCountingServer(t)
+
+	routes := []*Route{{
+		Method: regexp.MustCompile(`^/SearchService/Search$`),
+		Target: &OutputTarget{Addr: routedAddr, Finder: finder},
+	}}
+	outputs := []*GRPCOutput{
+		NewGRPCOutput(firstAddr, finder, &GRPCOutputConfig{WorkerNum: 1, Routes: routes}),
+		NewGRPCOutput(secondAddr, finder, &GRPCOutputConfig{WorkerNum: 1, Routes: routes, SkipRouteTargets: true}),
+	}
+	msg := &protocol.Message{
+		Method:  "/SearchService/Search",
+		Request: &protocol.MsgItem{Body: `{"staffName":"x"}`, Headers: map[string]string{}},
+	}
+	for _, o := range outputs {
+		assert.Nil(t, o.Write(msg))
+	}
+	assert.Eventually(t, func() bool { return routed.calls.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	for _, o := range outputs {
+		assert.Nil(t, o.Close())
+	}
+	assert.Equal(t, int64(1), routed.calls.Load())
+	assert.Equal(t, int64(0), first.calls.Load())
+	assert.Equal(t, int64(0), second.calls.Load())
+}
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestNewResultMessage(t *testing.T) {
+	msg := &protocol.Message{
+		Meta:     protocol.Meta{UUID: "uuid-1", ContainResponse: true},
+		Method:   "/SearchService/Search",
+		Request:  &protocol.MsgItem{Body: `{"staffName":"x"}`},
+		Response: &protocol.MsgItem{Body: `{"staffID":"100"}`},
+	}
+	start := time.Now()
+
+	result := newResultMessage("127.0.0.1:35001", msg, start, &Response{
+		Status:  status.New(codes.OK, ""),
+		Body:    `{"staffID":"101"}`,
+		Headers: map[string]string{"grpc-status": "0"},
+		Latency: 2 * time.Millisecond,
+	}, nil)
+	assert.Nil(t, msg.Replay)
+	assert.Equal(t, "uuid-1", result.Meta.UUID)
+	assert.Equal(t, msg.Response, result.Response)
+	assert.Equal(t, "127.0.0.1:35001", result.Replay.Target)
+	assert.Equal(t, start.UnixNano(), result.Replay.Timestamp)
+	assert.Equal(t, int64(2*time.Millisecond), result.Replay.Latency)
+	assert.Equal(t, int(codes.OK), result.Replay.Code)
+	assert.Equal(t, `{"staffID":"101"}`, result.Replay.Response.Body)
+
+	result = newResultMessage("127.0.0.1:35001", msg, start, nil, errors.New("unknown field"))
+	assert.Equal(t, int(codes.Unknown), result.Replay.Code)
+	assert.Equal(t, "unknown field", result.Replay.Message)
+	assert.Nil(t, result.Replay.Response)
+
+	// the results are not replayed again
+	o := &GRPCOutput{msgChannels: []chan *protocol.Message{make(chan *protocol.Message, 1)}}
+	assert.Nil(t, o.Write(result))
+	assert.Len(t, o.msgChannels[0], 0)
+}
+
+func TestGRPCOutputResults(t *testing.T) {
+	// no reader without GRPCOutputConfig.Results
+	o := &GRPCOutput{addr: "127.0.0.1:35001"}
+	assert.Nil(t, o.Results())
+
+	o.results = make(chan *protocol.Message, 1)
+	r := o.Results()
+	assert.Equal(t, "GRPCResults:127.0.0.1:35001", r.String())
+	o.results <- &protocol.Message{Meta: protocol.Meta{UUID: "uuid-1"}}
+	msg, err := r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "uuid-1", msg.Meta.UUID)
+}
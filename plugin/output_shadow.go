@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"github.com/vearne/grpcreplay/diff"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/codes"
+	"sync"
+	"time"
+)
+
+const shadowReportInterval = 30 * time.Second
+
+type ShadowOutputConfig struct {
+	WorkerNum int
+	// the current build
+	Primary *OutputTarget
+	// (optional) another instance of the current build, used to detect the noisy fields
+	Secondary *OutputTarget
+	// the build under test
+	Candidate   *OutputTarget
+	DiffOptions *diff.Options
+	// the report is written to the file periodically
+	ReportFile string
+	// in percent, see ShadowReport
+	RelativeThreshold float64
+	AbsoluteThreshold float64
+	// (optional) rewrite the request headers before sending, applied to all targets
+	HeaderRewriter *HeaderRewriter
+	// (optional) the deadlines of the calls, no deadline if nil
+	Deadline *Deadline
+}
+
+// ShadowOutput sends each request to the primary and candidate, and compares their responses.
+// If the secondary is specified, the fields on which the primary and secondary differ are noise.
+type ShadowOutput struct {
+	msgChannel chan *protocol.Message
+	report     *ShadowReport
+	reportFile string
+	wg         sync.WaitGroup
+	closeChan  chan struct{}
+}
+
+func NewShadowOutput(cf *ShadowOutputConfig) *ShadowOutput {
+	var o ShadowOutput
+	o.msgChannel = make(chan *protocol.Message, 100)
+	o.report = NewShadowReport(cf.RelativeThreshold, cf.AbsoluteThreshold)
+	o.reportFile = cf.ReportFile
+	o.closeChan = make(chan struct{})
+
+	primarySrc := newShadowDescSource(cf.Primary)
+	candidateSrc := newShadowDescSource(cf.Candidate)
+	secondarySrc := newShadowDescSource(cf.Secondary)
+	for i := 0; i < cf.WorkerNum; i++ {
+		var w shadowWorker
+		w.primary = newShadowWorker(cf.Primary, primarySrc, cf)
+		w.candidate = newShadowWorker(cf.Candidate, candidateSrc, cf)
+		w.secondary = newShadowWorker(cf.Secondary, secondarySrc, cf)
+		w.diffOptions = cf.DiffOptions
+		w.report = o.report
+		o.wg.Add(1)
+		go func() {
+			defer o.wg.Done()
+			w.execute(o.msgChannel)
+		}()
+	}
+	go o.writeReport()
+
+	slog.Info("create shadow output, primary:%v, candidate:%v", cf.Primary.Addr, cf.Candidate.Addr)
+	return &o
+}
+
+func newShadowDescSource(target *OutputTarget) *DescSrcWrapper {
+	if target == nil {
+		return nil
+	}
+	return NewDescSrcWrapper(target.Finder.GetDescriptorSource())
+}
+
+func newShadowWorker(target *OutputTarget, descSource *DescSrcWrapper, cf *ShadowOutputConfig) *GrpcWorker {
+	if target == nil {
+		return nil
+	}
+	return NewGrpcWorker(target.Addr, nil, descSource, &GRPCOutputConfig{
+		DialOptions:       target.DialOptions,
+		PerRPCCredentials: target.PerRPCCredentials,
+		HeaderRewriter:    cf.HeaderRewriter,
+		Deadline:          cf.Deadline,
+	})
+}
+
+func (o *ShadowOutput) Write(msg *protocol.Message) error {
+	// the results of the gRPC outputs are not replayed again
+	if msg.Replay != nil {
+		return nil
+	}
+	o.msgChannel <- msg
+	return nil
+}
+
+// Close waits for the requests in the channel, and writes the final report
+func (o *ShadowOutput) Close() error {
+	close(o.msgChannel)
+	o.wg.Wait()
+	close(o.closeChan)
+	return o.WriteReport()
+}
+
+// WriteReport prints the mismatch rates and writes the report of the comparisons so far,
+// it is called before exit, the requests still in the channel are not included
+func (o *ShadowOutput) WriteReport() error {
+	for _, mr := range o.report.Snapshot() {
+		slog.Info("shadow, method:%v, requests:%v, mismatches:%v, mismatch rate:%.2f%%",
+			mr.Method, mr.Requests, mr.Mismatches, mr.MismatchRate*100)
+	}
+	return o.report.WriteFile(o.reportFile)
+}
+
+func (o *ShadowOutput) writeReport() {
+	ticker := time.NewTicker(shadowReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.report.WriteFile(o.reportFile); err != nil {
+				slog.Error("ShadowOutput, write report:%v", err)
+			}
+		case <-o.closeChan:
+			return
+		}
+	}
+}
+
+type shadowWorker struct {
+	primary     *GrpcWorker
+	secondary   *GrpcWorker
+	candidate   *GrpcWorker
+	diffOptions *diff.Options
+	report      *ShadowReport
+}
+
+func (w *shadowWorker) execute(msgChannel chan *protocol.Message) {
+	defer w.close()
+
+	for msg := range msgChannel {
+		w.compare(msg)
+	}
+}
+
+func (w *shadowWorker) close() {
+	for _, worker := range []*GrpcWorker{w.primary, w.secondary, w.candidate} {
+		if worker != nil {
+			worker.cc.Close()
+		}
+	}
+}
+
+// compare sends the message to all targets at the same time, so that their states are as close as possible
+func (w *shadowWorker) compare(msg *protocol.Message) {
+	var wg sync.WaitGroup
+	var primary, secondary, candidate *Response
+	var primaryErr, secondaryErr, candidateErr error
+	fetch := func(worker *GrpcWorker, resp **Response, err *error) {
+		defer wg.Done()
+		*resp, *err = worker.Fetch(msg)
+	}
+
+	wg.Add(2)
+	go fetch(w.primary, &primary, &primaryErr)
+	go fetch(w.candidate, &candidate, &candidateErr)
+	if w.secondary != nil {
+		wg.Add(1)
+		go fetch(w.secondary, &secondary, &secondaryErr)
+	}
+	wg.Wait()
+
+	if primaryErr != nil || candidateErr != nil {
+		slog.Error("shadow, method:%v, primary error:%v, candidate error:%v", msg.Method, primaryErr, candidateErr)
+		w.report.AddError(msg.Method)
+		return
+	}
+
+	diffs := compareResponse(primary, candidate, w.diffOptions)
+	var noise []diff.Difference
+	if secondary != nil {
+		noise = compareResponse(primary, secondary, w.diffOptions)
+	} else if secondaryErr != nil {
+		slog.Warn("shadow, method:%v, secondary error:%v", msg.Method, secondaryErr)
+	}
+
+	if w.report.Add(msg.Method, msg.Meta.UUID, diffs, noise) {
+		slog.Debug("shadow mismatch, method:%v, uuid:%v, diffs:%v", msg.Method, msg.Meta.UUID, diffs)
+	}
+}
+
+// compareResponse compares the status, and the body if both calls succeeded
+func compareResponse(expected, actual *Response, opts *diff.Options) []diff.Difference {
+	if expected.Status.Code() != actual.Status.Code() {
+		return []diff.Difference{{Path: "grpc-status", Expected: expected.Status.Code(), Actual: actual.Status.Code()}}
+	}
+	if expected.Status.Code() != codes.OK {
+		return nil
+	}
+
+	diffs, err := diff.Compare([]byte(expected.Body), []byte(actual.Body), opts)
+	if err != nil {
+		return []diff.Difference{{Path: "body", Expected: expected.Body, Actual: actual.Body}}
+	}
+	return diffs
+}
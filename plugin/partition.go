@@ -0,0 +1,33 @@
+package plugin
+
+import (
+	"github.com/vearne/grpcreplay/balance"
+	"github.com/vearne/grpcreplay/protocol"
+)
+
+// Partition keeps the order of the messages with the same key, they are sent by the same worker one by one.
+// The messages without key are not ordered.
+type Partition struct {
+	// the original connection of the message(Meta.Peer) if nil
+	Key *balance.HashKey
+}
+
+// ParsePartition parses "connection", or the keys of balance.ParseHashKey, e.g. "header:x-account-id"
+func ParsePartition(s string) (*Partition, error) {
+	if s == "connection" {
+		return &Partition{}, nil
+	}
+	key, err := balance.ParseHashKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Partition{Key: key}, nil
+}
+
+// Value returns the key of the message, empty if it is absent
+func (p *Partition) Value(msg *protocol.Message) string {
+	if p.Key == nil {
+		return msg.Meta.Peer
+	}
+	return p.Key.Value(msg)
+}
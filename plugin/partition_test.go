@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"testing"
+)
+
+func TestGRPCOutputPartition(t *testing.T) {
+	_, err := ParsePartition("account")
+	assert.NotNil(t, err)
+	p, err := ParsePartition("connection")
+	assert.Nil(t, err)
+
+	o := &GRPCOutput{partition: p}
+	for i := 0; i < 4; i++ {
+		o.msgChannels = append(o.msgChannels, make(chan *protocol.Message, 100))
+	}
+	for i := 0; i < 50; i++ {
+		for _, peer := range []string{"10.0.0.1:50001", "10.0.0.2:50002", "10.0.0.3:50003"} {
+			assert.Nil(t, o.Write(&protocol.Message{Meta: protocol.Meta{Peer: peer, UUID: fmt.Sprint(i)}}))
+		}
+	}
+
+	// the messages of a connection are in the same channel, in order
+	seq := make(map[string]int)
+	channelOf := make(map[string]int)
+	for i, ch := range o.msgChannels {
+		for len(ch) > 0 {
+			msg := <-ch
+			if c, ok := channelOf[msg.Meta.Peer]; ok {
+				assert.Equal(t, c, i)
+			}
+			channelOf[msg.Meta.Peer] = i
+			assert.Equal(t, fmt.Sprint(seq[msg.Meta.Peer]), msg.Meta.UUID)
+			seq[msg.Meta.Peer]++
+		}
+	}
+	assert.Len(t, seq, 3)
+
+	// the messages without key are spread over the channels
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, o.Write(&protocol.Message{}))
+	}
+	for _, ch := range o.msgChannels {
+		assert.Len(t, ch, 1)
+	}
+
+	p, err = ParsePartition("header:x-account-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "42", p.Value(&protocol.Message{Request: &protocol.MsgItem{
+		Headers: map[string]string{"x-account-id": "42"}}}))
+}
@@ -0,0 +1,487 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/codes"
+	"html/template"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// the values below it are exact, each power of 2 above it is divided into histSubBuckets/2 buckets,
+// so the error is less than 1.6%
+const histSubBuckets = 128
+
+// histogram records the latencies in microseconds, in the way of HdrHistogram
+type histogram struct {
+	counts []int64
+	total  int64
+	sum    int64
+	min    int64
+	max    int64
+}
+
+func histIndex(v int64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	// v>>shift is in [histSubBuckets/2, histSubBuckets)
+	shift := bits.Len64(uint64(v)) - bits.Len64(histSubBuckets-1)
+	return histSubBuckets + (shift-1)*histSubBuckets/2 + int(v>>shift) - histSubBuckets/2
+}
+
+// histValue returns the largest value of the bucket
+func histValue(i int) int64 {
+	if i < histSubBuckets {
+		return int64(i)
+	}
+	shift := (i-histSubBuckets)/(histSubBuckets/2) + 1
+	sub := int64((i-histSubBuckets)%(histSubBuckets/2) + histSubBuckets/2)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := max(d.Microseconds(), 0)
+	i := histIndex(v)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+	h.sum += v
+}
+
+func (h *histogram) merge(other *histogram) {
+	if other.total == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(other.counts)-len(h.counts))...)
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	h.max = max(h.max, other.max)
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// percentile returns the latency in microseconds which p percent of the calls don't exceed
+func (h *histogram) percentile(p float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := max(int64(float64(h.total)*p/100+0.5), 1)
+	var count int64
+	for i, c := range h.counts {
+		count += c
+		if count >= rank {
+			return min(histValue(i), h.max)
+		}
+	}
+	return h.max
+}
+
+// ReportConfig enables the replay report of GRPCOutput
+type ReportConfig struct {
+	// (optional) the report is written to File+".txt", File+".json" and File+".html" on exit
+	File string
+	// (optional) a summary of each interval is printed to the console
+	Interval time.Duration
+}
+
+// ReplayReport collects the latencies and the status codes of the calls of the gRPC outputs.
+// It is shared by the outputs, the calls are grouped by target and method.
+type ReplayReport struct {
+	sync.Mutex
+	cf *ReportConfig
+	// the time of the first call
+	start time.Time
+	last  time.Time
+	stats map[reportKey]*callStats
+	// the calls of each second
+	timeline []*TimelinePoint
+
+	// the calls since the last console summary
+	interval     histogram
+	intervalErrs int64
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+type reportKey struct {
+	target string
+	method string
+}
+
+type callStats struct {
+	latency histogram
+	codes   map[codes.Code]int64
+}
+
+// TimelinePoint is the number of calls in a second of the replay
+type TimelinePoint struct {
+	// from the first call
+	Second int   `json:"second"`
+	Calls  int64 `json:"calls"`
+	Errors int64 `json:"errors"`
+}
+
+// LatencySummary is in milliseconds
+type LatencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+	// the buckets with calls
+	Histogram []*HistogramBucket `json:"histogram,omitempty"`
+}
+
+// HistogramBucket counts the calls whose latency doesn't exceed UpperBound(millisecond),
+// and exceeds that of the previous bucket
+type HistogramBucket struct {
+	UpperBound float64 `json:"upperBound"`
+	Count      int64   `json:"count"`
+}
+
+type MethodSummary struct {
+	Target     string           `json:"target"`
+	Method     string           `json:"method"`
+	Calls      int64            `json:"calls"`
+	Throughput float64          `json:"throughput"`
+	Codes      map[string]int64 `json:"codes"`
+	Latency    *LatencySummary  `json:"latency"`
+}
+
+// ReportSummary is the content of the report
+type ReportSummary struct {
+	Start time.Time `json:"start"`
+	// seconds
+	Duration float64 `json:"duration"`
+	Calls    int64   `json:"calls"`
+	// calls per second
+	Throughput float64          `json:"throughput"`
+	Codes      map[string]int64 `json:"codes"`
+	Latency    *LatencySummary  `json:"latency"`
+	Methods    []*MethodSummary `json:"methods"`
+	Timeline   []*TimelinePoint `json:"timeline"`
+}
+
+func NewReplayReport(cf *ReportConfig) *ReplayReport {
+	r := &ReplayReport{cf: cf, stats: make(map[reportKey]*callStats), closeChan: make(chan struct{})}
+	if cf.Interval > 0 {
+		go r.printSummaries()
+	}
+	return r
+}
+
+// record is nil-safe
+func (r *ReplayReport) record(target string, method string, latency time.Duration, code codes.Code) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.start.IsZero() {
+		r.start = now
+	}
+	r.last = now
+	key := reportKey{target: target, method: method}
+	stats, ok := r.stats[key]
+	if !ok {
+		stats = &callStats{codes: make(map[codes.Code]int64)}
+		r.stats[key] = stats
+	}
+	stats.latency.record(latency)
+	stats.codes[code]++
+
+	second := int(now.Sub(r.start) / time.Second)
+	for len(r.timeline) <= second {
+		r.timeline = append(r.timeline, &TimelinePoint{Second: len(r.timeline)})
+	}
+	r.timeline[second].Calls++
+	r.interval.record(latency)
+	if code != codes.OK {
+		r.timeline[second].Errors++
+		r.intervalErrs++
+	}
+}
+
+func (r *ReplayReport) printSummaries() {
+	ticker := time.NewTicker(r.cf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Lock()
+			h := r.interval
+			errs := r.intervalErrs
+			r.interval = histogram{}
+			r.intervalErrs = 0
+			r.Unlock()
+			slog.Info("replay, calls:%v, throughput:%.1f/s, errors:%v, p50:%.2fms, p99:%.2fms, max:%.2fms",
+				h.total, float64(h.total)/r.cf.Interval.Seconds(), errs,
+				toMillisecond(h.percentile(50)), toMillisecond(h.percentile(99)), toMillisecond(h.max))
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+func toMillisecond(us int64) float64 {
+	return float64(us) / 1000
+}
+
+func newLatencySummary(h *histogram) *LatencySummary {
+	s := &LatencySummary{
+		Min:  toMillisecond(h.min),
+		P50:  toMillisecond(h.percentile(50)),
+		P90:  toMillisecond(h.percentile(90)),
+		P95:  toMillisecond(h.percentile(95)),
+		P99:  toMillisecond(h.percentile(99)),
+		P999: toMillisecond(h.percentile(99.9)),
+		Max:  toMillisecond(h.max),
+	}
+	if h.total > 0 {
+		s.Mean = toMillisecond(h.sum) / float64(h.total)
+	}
+	for i, c := range h.counts {
+		if c > 0 {
+			s.Histogram = append(s.Histogram, &HistogramBucket{UpperBound: toMillisecond(histValue(i)), Count: c})
+		}
+	}
+	return s
+}
+
+func codeNames(m map[codes.Code]int64) map[string]int64 {
+	names := make(map[string]int64, len(m))
+	for code, count := range m {
+		names[code.String()] += count
+	}
+	return names
+}
+
+// Summary returns the report of the calls so far
+func (r *ReplayReport) Summary() *ReportSummary {
+	r.Lock()
+	defer r.Unlock()
+
+	duration := r.last.Sub(r.start).Seconds()
+	throughput := func(calls int64) float64 {
+		if duration <= 0 {
+			return float64(calls)
+		}
+		return float64(calls) / duration
+	}
+
+	s := &ReportSummary{Start: r.start, Duration: duration, Codes: make(map[string]int64)}
+	var total histogram
+	for key, stats := range r.stats {
+		total.merge(&stats.latency)
+		for code, count := range codeNames(stats.codes) {
+			s.Codes[code] += count
+		}
+		s.Methods = append(s.Methods, &MethodSummary{
+			Target:     key.target,
+			Method:     key.method,
+			Calls:      stats.latency.total,
+			Throughput: throughput(stats.latency.total),
+			Codes:      codeNames(stats.codes),
+			Latency:    newLatencySummary(&stats.latency),
+		})
+	}
+	sort.Slice(s.Methods, func(i, j int) bool {
+		if s.Methods[i].Target != s.Methods[j].Target {
+			return s.Methods[i].Target < s.Methods[j].Target
+		}
+		return s.Methods[i].Method < s.Methods[j].Method
+	})
+	s.Calls = total.total
+	s.Throughput = throughput(total.total)
+	s.Latency = newLatencySummary(&total)
+	for _, p := range r.timeline {
+		point := *p
+		s.Timeline = append(s.Timeline, &point)
+	}
+	return s
+}
+
+// WriteText writes the report like
+//
+//	Summary:
+//	  Calls:       1000
+//	  ...
+func (s *ReportSummary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Summary:\n")
+	fmt.Fprintf(tw, "  Start:\t%v\n", s.Start.Format(time.RFC3339))
+	fmt.Fprintf(tw, "  Duration:\t%.2fs\n", s.Duration)
+	fmt.Fprintf(tw, "  Calls:\t%v\n", s.Calls)
+	fmt.Fprintf(tw, "  Throughput:\t%.2f/s\n", s.Throughput)
+	fmt.Fprintf(tw, "\nLatency(ms):\n")
+	writeLatency(tw, "  ", s.Latency)
+
+	fmt.Fprintf(tw, "\nStatus codes:\n")
+	names := make([]string, 0, len(s.Codes))
+	for name := range s.Codes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %v\t%v\n", name, s.Codes[name])
+	}
+
+	for _, m := range s.Methods {
+		fmt.Fprintf(tw, "\nTarget: %v, method: %v\n", m.Target, m.Method)
+		fmt.Fprintf(tw, "  Calls:\t%v\n", m.Calls)
+		fmt.Fprintf(tw, "  Throughput:\t%.2f/s\n", m.Throughput)
+		fmt.Fprintf(tw, "  Status codes:\t%v\n", m.Codes)
+		writeLatency(tw, "  ", m.Latency)
+	}
+	return tw.Flush()
+}
+
+func writeLatency(w io.Writer, indent string, l *LatencySummary) {
+	fmt.Fprintf(w, "%vmin\tmean\tp50\tp90\tp95\tp99\tp99.9\tmax\n", indent)
+	fmt.Fprintf(w, "%v%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\n", indent,
+		l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.P999, l.Max)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(count int64, total int64) float64 {
+		if total <= 0 {
+			return 0
+		}
+		return float64(count) * 100 / float64(total)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>grpcr replay report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.bar { background: #4a90d9; height: 12px; }
+td.bars { width: 400px; text-align: left; }
+.chart { display: flex; align-items: flex-end; height: 120px; border-bottom: 1px solid #999; }
+.chart div { flex: 1; background: #4a90d9; margin-right: 1px; }
+</style>
+</head>
+<body>
+<h1>Replay report</h1>
+<table>
+<tr><td>Start</td><td>{{.Start.Format "2006-01-02T15:04:05Z07:00"}}</td></tr>
+<tr><td>Duration</td><td>{{printf "%.2f" .Duration}}s</td></tr>
+<tr><td>Calls</td><td>{{.Calls}}</td></tr>
+<tr><td>Throughput</td><td>{{printf "%.2f" .Throughput}}/s</td></tr>
+</table>
+
+<h2>Status codes</h2>
+<table>
+<tr><th>Code</th><th>Calls</th><th>Percent</th></tr>
+{{range $code, $count := .Codes}}<tr><td>{{$code}}</td><td>{{$count}}</td><td>{{printf "%.2f" (percent $count $.Calls)}}%</td></tr>
+{{end}}</table>
+
+<h2>Latency(ms)</h2>
+<table>
+<tr><th>Target</th><th>Method</th><th>Calls</th><th>Throughput</th><th>min</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>p99.9</th><th>max</th></tr>
+<tr><td>all</td><td></td><td>{{.Calls}}</td><td>{{printf "%.2f" .Throughput}}</td>{{with .Latency}}<td>{{printf "%.2f" .Min}}</td><td>{{printf "%.2f" .Mean}}</td><td>{{printf "%.2f" .P50}}</td><td>{{printf "%.2f" .P90}}</td><td>{{printf "%.2f" .P95}}</td><td>{{printf "%.2f" .P99}}</td><td>{{printf "%.2f" .P999}}</td><td>{{printf "%.2f" .Max}}</td>{{end}}</tr>
+{{range .Methods}}<tr><td>{{.Target}}</td><td>{{.Method}}</td><td>{{.Calls}}</td><td>{{printf "%.2f" .Throughput}}</td>{{with .Latency}}<td>{{printf "%.2f" .Min}}</td><td>{{printf "%.2f" .Mean}}</td><td>{{printf "%.2f" .P50}}</td><td>{{printf "%.2f" .P90}}</td><td>{{printf "%.2f" .P95}}</td><td>{{printf "%.2f" .P99}}</td><td>{{printf "%.2f" .P999}}</td><td>{{printf "%.2f" .Max}}</td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Throughput(calls per second)</h2>
+<div class="chart">
+{{range .Timeline}}<div title="{{.Second}}s: {{.Calls}} calls, {{.Errors}} errors" style="height: {{printf "%.1f" (percent .Calls $.MaxCalls)}}%"></div>
+{{end}}</div>
+
+<h2>Latency distribution</h2>
+<table>
+<tr><th>&le; ms</th><th>Calls</th><th></th></tr>
+{{range .Latency.Histogram}}<tr><td>{{printf "%.3f" .UpperBound}}</td><td>{{.Count}}</td><td class="bars"><div class="bar" style="width: {{printf "%.1f" (percent .Count $.Calls)}}%"></div></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a standalone page
+func (s *ReportSummary) WriteHTML(w io.Writer) error {
+	var maxCalls int64
+	for _, p := range s.Timeline {
+		maxCalls = max(maxCalls, p.Calls)
+	}
+	return reportTemplate.Execute(w, struct {
+		*ReportSummary
+		MaxCalls int64
+	}{s, maxCalls})
+}
+
+// WriteReport prints the report to stdout, and writes it to the files of ReportConfig.File
+func (r *ReplayReport) WriteReport() error {
+	s := r.Summary()
+	if s.Calls <= 0 {
+		return nil
+	}
+	err := s.WriteText(os.Stdout)
+	if err != nil || len(r.cf.File) <= 0 {
+		return err
+	}
+
+	writers := map[string]func(io.Writer) error{
+		".txt":  s.WriteText,
+		".json": func(w io.Writer) error { return json.NewEncoder(w).Encode(s) },
+		".html": s.WriteHTML,
+	}
+	for ext, write := range writers {
+		if err = writeFile(r.cf.File+ext, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops the console summaries and writes the report
+func (r *ReplayReport) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+		err = r.WriteReport()
+	})
+	return err
+}
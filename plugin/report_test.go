@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, 1 << 40} {
+		i := histIndex(v)
+		assert.GreaterOrEqual(t, histValue(i), v)
+		assert.LessOrEqual(t, float64(histValue(i)-v), float64(v)/64)
+		if i > 0 {
+			assert.Less(t, histValue(i-1), v)
+		}
+	}
+
+	var h histogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, int64(1000), h.total)
+	assert.Equal(t, int64(1000), h.min)
+	assert.Equal(t, int64(1000000), h.max)
+	assert.InDelta(t, 500000, h.percentile(50), 500000/64)
+	assert.InDelta(t, 990000, h.percentile(99), 990000/64)
+	assert.Equal(t, h.max, h.percentile(100))
+
+	var merged histogram
+	merged.merge(&h)
+	merged.merge(&histogram{})
+	assert.Equal(t, h.percentile(90), merged.percentile(90))
+}
+
+func TestReplayReport(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "report")
+	r := NewReplayReport(&ReportConfig{File: prefix})
+	for i := 0; i < 99; i++ {
+		r.record("127.0.0.1:35001", "/SearchService/Search", 10*time.Millisecond, codes.OK)
+	}
+	r.record("127.0.0.1:35001", "/SearchService/Search", 100*time.Millisecond, codes.Unavailable)
+	r.record("127.0.0.1:35001", "/SearchService/CurrentTime", time.Millisecond, codes.OK)
+
+	s := r.Summary()
+	assert.Equal(t, int64(101), s.Calls)
+	assert.Equal(t, map[string]int64{"OK": 100, "Unavailable": 1}, s.Codes)
+	assert.Len(t, s.Methods, 2)
+	assert.Equal(t, "/SearchService/CurrentTime", s.Methods[0].Method)
+	assert.Equal(t, int64(100), s.Methods[1].Calls)
+	assert.InDelta(t, 10, s.Methods[1].Latency.P99, 0.2)
+	assert.InDelta(t, 100, s.Methods[1].Latency.Max, 0.01)
+	assert.Equal(t, int64(101), s.Timeline[0].Calls)
+	assert.Equal(t, int64(1), s.Timeline[0].Errors)
+
+	var buf bytes.Buffer
+	assert.Nil(t, s.WriteText(&buf))
+	assert.Contains(t, buf.String(), "Unavailable")
+
+	assert.Nil(t, r.Close())
+	data, err := os.ReadFile(prefix + ".json")
+	assert.Nil(t, err)
+	var saved ReportSummary
+	assert.Nil(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, s.Calls, saved.Calls)
+	data, err = os.ReadFile(prefix + ".html")
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "/SearchService/CurrentTime")
+	_, err = os.Stat(prefix + ".txt")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/vearne/grpcreplay/diff"
+	"github.com/vearne/grpcreplay/protocol"
+	slog "github.com/vearne/simplelog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// DiffRecord is the result of comparing the replayed response with the recorded one
+type DiffRecord struct {
+	UUID           string            `json:"uuid"`
+	Method         string            `json:"method"`
+	Target         string            `json:"target"`
+	Match          bool              `json:"match"`
+	ExpectedStatus codes.Code        `json:"expectedStatus"`
+	ActualStatus   codes.Code        `json:"actualStatus"`
+	Diffs          []diff.Difference `json:"diffs,omitempty"`
+	// the responses can't be compared, e.g. one of them is not valid json
+	Error string `json:"error,omitempty"`
+}
+
+// ResponseComparator compares the responses of the replayed requests with the recorded ones,
+// and writes a DiffRecord per call to a file, one json per line
+type ResponseComparator struct {
+	sync.Mutex
+	options *diff.Options
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewResponseComparator(path string, options *diff.Options) *ResponseComparator {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Fatal("NewResponseComparator, open %v, error:%v", path, err)
+	}
+
+	var c ResponseComparator
+	c.options = options
+	c.file = file
+	c.encoder = json.NewEncoder(file)
+	slog.Info("create response comparator, diff file:%v", path)
+	return &c
+}
+
+// Compare compares the response with the one recorded in msg, msg.Response must not be nil
+func (c *ResponseComparator) Compare(target string, msg *protocol.Message, st *status.Status, body string) *DiffRecord {
+	var record DiffRecord
+	record.UUID = msg.Meta.UUID
+	record.Method = msg.Method
+	record.Target = target
+	record.ExpectedStatus = recordedStatus(msg.Response)
+	record.ActualStatus = st.Code()
+
+	// the body of a failed call is meaningless
+	if record.ExpectedStatus == record.ActualStatus && record.ActualStatus == codes.OK {
+		diffs, err := diff.Compare([]byte(msg.Response.Body), []byte(body), c.options)
+		if err != nil {
+			record.Error = err.Error()
+		}
+		record.Diffs = diffs
+	}
+	record.Match = record.ExpectedStatus == record.ActualStatus && len(record.Diffs) <= 0 &&
+		len(record.Error) <= 0
+
+	c.Lock()
+	defer c.Unlock()
+	if err := c.encoder.Encode(&record); err != nil {
+		slog.Error("ResponseComparator, write diff record:%v", err)
+	}
+	return &record
+}
+
+func (c *ResponseComparator) Close() error {
+	return c.file.Close()
+}
+
+// recordedStatus returns the status in the trailers of the recorded response,
+// it is OK if the trailers were not captured
+func recordedStatus(item *protocol.MsgItem) codes.Code {
+	value, ok := item.Headers["grpc-status"]
+	if !ok {
+		return codes.OK
+	}
+	code, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return codes.Unknown
+	}
+	return codes.Code(code)
+}
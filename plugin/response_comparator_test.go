@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/diff"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResponseComparator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diff.log")
+	c := NewResponseComparator(path, &diff.Options{IgnorePaths: []string{"time"}})
+
+	var msg protocol.Message
+	msg.Method = "/SearchService/CurrentTime"
+	msg.Response = &protocol.MsgItem{
+		Headers: map[string]string{"grpc-status": "0"},
+		Body:    `{"requestId":"1","time":"10:00"}`,
+	}
+	record := c.Compare("127.0.0.1:35001", &msg, status.New(codes.OK, ""), `{"requestId":"1","time":"11:00"}`)
+	assert.True(t, record.Match)
+
+	record = c.Compare("127.0.0.1:35001", &msg, status.New(codes.OK, ""), `{"requestId":"2"}`)
+	assert.False(t, record.Match)
+	assert.Equal(t, "requestId", record.Diffs[0].Path)
+
+	record = c.Compare("127.0.0.1:35001", &msg, status.New(codes.Internal, "boom"), "")
+	assert.False(t, record.Match)
+	assert.Equal(t, codes.Internal, record.ActualStatus)
+	assert.Nil(t, c.Close())
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+	var r DiffRecord
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &r))
+	assert.Equal(t, msg.Method, r.Method)
+	assert.False(t, r.Match)
+}
@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retries the calls failed with the status codes, with exponential backoff
+type RetryPolicy struct {
+	// including the first call, no retry if it is less than 2
+	MaxAttempts int
+	Codes       []codes.Code
+	// the backoff before the first retry, doubled for each retry until MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p *RetryPolicy) retryable(code codes.Code) bool {
+	if p == nil {
+		return false
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the backoff before the retry, attempt is the number of calls made
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 {
+		backoff = min(backoff, p.MaxBackoff)
+	}
+	return backoff
+}
+
+// ParseCodes parses the names of the status codes, e.g. "UNAVAILABLE" or "DEADLINE_EXCEEDED"
+func ParseCodes(names []string) ([]codes.Code, error) {
+	result := make([]codes.Code, 0, len(names))
+	for _, name := range names {
+		var code codes.Code
+		// UnmarshalJSON accepts the quoted name
+		err := code.UnmarshalJSON([]byte(`"` + strings.ToUpper(strings.TrimSpace(name)) + `"`))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code:%v", name)
+		}
+		result = append(result, code)
+	}
+	return result, nil
+}
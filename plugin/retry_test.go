@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/grpc/codes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	list, err := ParseCodes([]string{"UNAVAILABLE", " resource_exhausted"})
+	assert.Nil(t, err)
+	assert.Equal(t, []codes.Code{codes.Unavailable, codes.ResourceExhausted}, list)
+	_, err = ParseCodes([]string{"NOT_A_CODE"})
+	assert.NotNil(t, err)
+
+	p := &RetryPolicy{MaxAttempts: 5, Codes: list,
+		InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	assert.True(t, p.retryable(codes.Unavailable))
+	assert.False(t, p.retryable(codes.NotFound))
+	assert.Equal(t, 100*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 300*time.Millisecond, p.backoff(3))
+
+	var none *RetryPolicy
+	assert.False(t, none.retryable(codes.Unavailable))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := getBreaker("127.0.0.1:35101", &BreakerConfig{Threshold: 2, OpenTime: 50 * time.Millisecond})
+	assert.Nil(t, getBreaker("127.0.0.1:35101", nil))
+
+	b.Done(codes.Unavailable)
+	b.Done(codes.NotFound)
+	b.Done(codes.Unavailable)
+	assert.Equal(t, breakerClosed, b.state)
+	b.Done(codes.DeadlineExceeded)
+	assert.Equal(t, breakerOpen, b.state)
+
+	start := time.Now()
+	b.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, breakerHalfOpen, b.state)
+
+	// the probe failed
+	b.Done(codes.Unavailable)
+	assert.Equal(t, breakerOpen, b.state)
+	b.Wait()
+	b.Done(codes.OK)
+	assert.Equal(t, breakerClosed, b.state)
+}
+
+func TestCircuitBreakerLocalError(t *testing.T) {
+	b := getBreaker("127.0.0.1:35102", &BreakerConfig{Threshold: 1, OpenTime: 50 * time.Millisecond})
+	b.Done(codes.Unavailable)
+	assert.Equal(t, breakerOpen, b.state)
+	time.Sleep(50 * time.Millisecond)
+
+	// the probe fails in grpcr, before reaching the target
+	w := &GrpcWorker{addr: "127.0.0.1:35102", breaker: b}
+	_, err := w.sendWithRetry(&protocol.Message{}, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, breakerOpen, b.state, "still open")
+
+	// another caller probes the target without waiting for OpenTime again
+	start := time.Now()
+	b.Wait()
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, breakerHalfOpen, b.state)
+}
+
+func TestReinforcedReaderSkipBadRecord(t *testing.T) {
+	codec := protocol.GetCodec("simple")
+	var content []byte
+	for _, uuid := range []string{"uuid-1", "uuid-2"} {
+		data, err := codec.Marshal(&protocol.Message{Meta: protocol.Meta{Version: 2, UUID: uuid},
+			Method: "/SearchService/Search", Request: &protocol.MsgItem{Body: "{}"}})
+		assert.Nil(t, err)
+		content = append(content, data...)
+		content = append(content, '\n', '\n')
+		if uuid == "uuid-1" {
+			content = append(content, []byte("2 uuid-bad 0 0\n/SearchService/Search\n{bad json\n\n")...)
+			// truncated record, and an extra empty line
+			content = append(content, []byte("2 uuid-truncated 0 0\n\n\n")...)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "capture.log")
+	assert.Nil(t, os.WriteFile(path, content, 0644))
+
+	r := NewReinforcedReader([]string{path}, codec)
+	defer r.Close()
+	msg, err := r.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "uuid-1", msg.Meta.UUID)
+	msg, err = r.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "uuid-2", msg.Meta.UUID)
+	assert.Equal(t, 3, r.Skipped)
+}
+
+func TestReinforcedReaderTruncatedGzip(t *testing.T) {
+	codec := protocol.GetCodec("simple")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for i := 0; i < 100; i++ {
+		data, err := codec.Marshal(&protocol.Message{Meta: protocol.Meta{Version: 2, UUID: fmt.Sprintf("uuid-%v", i)},
+			Method: "/SearchService/Search", Request: &protocol.MsgItem{Body: "{}"}})
+		assert.Nil(t, err)
+		_, err = gz.Write(append(data, '\n', '\n'))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, gz.Close())
+
+	dir := t.TempDir()
+	// grpcr was killed while the file was compressed
+	truncated := filepath.Join(dir, "capture-2022-10-14T05-50-39.473.log.gz")
+	assert.Nil(t, os.WriteFile(truncated, buf.Bytes()[:buf.Len()/2], 0644))
+	data, err := codec.Marshal(&protocol.Message{Meta: protocol.Meta{Version: 2, UUID: "uuid-last"},
+		Method: "/SearchService/Search", Request: &protocol.MsgItem{Body: "{}"}})
+	assert.Nil(t, err)
+	current := filepath.Join(dir, "capture.log")
+	assert.Nil(t, os.WriteFile(current, append(data, '\n', '\n'), 0644))
+
+	r := NewReinforcedReader([]string{truncated, current}, codec)
+	defer r.Close()
+	done := make(chan []string)
+	go func() {
+		uuids := make([]string, 0)
+		for {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				assert.ErrorIs(t, err, io.EOF)
+				done <- uuids
+				return
+			}
+			uuids = append(uuids, msg.Meta.UUID)
+		}
+	}()
+	select {
+	case uuids := <-done:
+		// the readable part of the truncated file, then the next file
+		assert.Less(t, len(uuids), 101)
+		assert.Equal(t, "uuid-last", uuids[len(uuids)-1])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the truncated file is read forever")
+	}
+}
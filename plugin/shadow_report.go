@@ -0,0 +1,217 @@
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/vearne/grpcreplay/diff"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the number of calls kept as examples of a field that differs
+const maxShadowSamples = 3
+
+// ShadowReport counts the differences between the primary and candidate per method and field.
+// As in Diffy, the differences between the primary and secondary, which run the same build, are noise.
+// A field is noisy if the candidate doesn't differ from the primary on it much more often than the secondary does.
+type ShadowReport struct {
+	sync.Mutex
+	// in percent
+	relativeThreshold float64
+	absoluteThreshold float64
+	methods           map[string]*methodStats
+	// the periodic and the final writes share the temporary file
+	writeMu sync.Mutex
+}
+
+type methodStats struct {
+	requests   int64
+	errors     int64
+	mismatches int64
+	fields     map[string]*fieldStats
+}
+
+type fieldStats struct {
+	differences int64
+	noise       int64
+	samples     []string
+}
+
+type ShadowMethodReport struct {
+	Method       string              `json:"method"`
+	Requests     int64               `json:"requests"`
+	Errors       int64               `json:"errors"`
+	Mismatches   int64               `json:"mismatches"`
+	MismatchRate float64             `json:"mismatchRate"`
+	Fields       []ShadowFieldReport `json:"fields,omitempty"`
+}
+
+type ShadowFieldReport struct {
+	Path string `json:"path"`
+	// the number of calls in which the candidate differs from the primary
+	Differences int64 `json:"differences"`
+	// the number of calls in which the secondary differs from the primary
+	Noise int64 `json:"noise"`
+	Noisy bool  `json:"noisy"`
+	// uuid of the calls
+	Samples []string `json:"samples,omitempty"`
+}
+
+// NewShadowReport creates a ShadowReport, the thresholds are in percent
+func NewShadowReport(relativeThreshold, absoluteThreshold float64) *ShadowReport {
+	var r ShadowReport
+	r.relativeThreshold = relativeThreshold
+	r.absoluteThreshold = absoluteThreshold
+	r.methods = make(map[string]*methodStats)
+	return &r
+}
+
+func (r *ShadowReport) getMethod(method string) *methodStats {
+	ms, ok := r.methods[method]
+	if !ok {
+		ms = &methodStats{fields: make(map[string]*fieldStats)}
+		r.methods[method] = ms
+	}
+	return ms
+}
+
+func (ms *methodStats) getField(path string) *fieldStats {
+	fs, ok := ms.fields[path]
+	if !ok {
+		fs = &fieldStats{}
+		ms.fields[path] = fs
+	}
+	return fs
+}
+
+// AddError counts a call which failed without a status, e.g. the request can't be encoded
+func (r *ShadowReport) AddError(method string) {
+	r.Lock()
+	defer r.Unlock()
+	r.getMethod(method).errors++
+}
+
+// Add counts a call, diffs are the differences between the primary and candidate,
+// noise are the ones between the primary and secondary.
+// Returns true if the candidate differs from the primary on a field which is not noisy.
+func (r *ShadowReport) Add(method, uuid string, diffs, noise []diff.Difference) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	ms := r.getMethod(method)
+	ms.requests++
+
+	noiseSet := make(map[string]struct{}, len(noise))
+	for _, path := range normalizePaths(noise) {
+		noiseSet[path] = struct{}{}
+		ms.getField(path).noise++
+	}
+	diffPaths := normalizePaths(diffs)
+	for _, path := range diffPaths {
+		ms.getField(path).differences++
+	}
+
+	mismatch := false
+	for _, path := range diffPaths {
+		fs := ms.fields[path]
+		if _, ok := noiseSet[path]; ok || r.isNoisy(ms, fs) {
+			continue
+		}
+		mismatch = true
+		if len(fs.samples) < maxShadowSamples {
+			fs.samples = append(fs.samples, uuid)
+		}
+	}
+	if mismatch {
+		ms.mismatches++
+	}
+	return mismatch
+}
+
+func (r *ShadowReport) isNoisy(ms *methodStats, fs *fieldStats) bool {
+	if fs.differences <= 0 {
+		return false
+	}
+	diffRate := float64(fs.differences) / float64(ms.requests) * 100
+	noiseRate := float64(fs.noise) / float64(ms.requests) * 100
+	absolute := diffRate - noiseRate
+	relative := absolute / diffRate * 100
+	return absolute <= r.absoluteThreshold || relative <= r.relativeThreshold
+}
+
+// Snapshot returns the report of each method, ordered by method
+func (r *ShadowReport) Snapshot() []ShadowMethodReport {
+	r.Lock()
+	defer r.Unlock()
+
+	result := make([]ShadowMethodReport, 0, len(r.methods))
+	for method, ms := range r.methods {
+		mr := ShadowMethodReport{
+			Method:     method,
+			Requests:   ms.requests,
+			Errors:     ms.errors,
+			Mismatches: ms.mismatches,
+		}
+		if ms.requests > 0 {
+			mr.MismatchRate = float64(ms.mismatches) / float64(ms.requests)
+		}
+		for path, fs := range ms.fields {
+			mr.Fields = append(mr.Fields, ShadowFieldReport{
+				Path:        path,
+				Differences: fs.differences,
+				Noise:       fs.noise,
+				Noisy:       r.isNoisy(ms, fs),
+				Samples:     append([]string(nil), fs.samples...),
+			})
+		}
+		sort.Slice(mr.Fields, func(i, j int) bool {
+			return mr.Fields[i].Path < mr.Fields[j].Path
+		})
+		result = append(result, mr)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Method < result[j].Method
+	})
+	return result
+}
+
+// WriteFile writes the report to path as json, readers never see a partial file
+func (r *ShadowReport) WriteFile(path string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	data, err := json.MarshalIndent(r.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// normalizePaths returns the distinct paths, array indexes are replaced with "*"
+func normalizePaths(diffs []diff.Difference) []string {
+	seen := make(map[string]struct{}, len(diffs))
+	paths := make([]string, 0, len(diffs))
+	for _, d := range diffs {
+		// the differences of the elements of an array are counted together
+		items := strings.Split(d.Path, ".")
+		for i, item := range items {
+			if _, err := strconv.Atoi(item); err == nil {
+				items[i] = "*"
+			}
+		}
+		path := strings.Join(items, ".")
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		paths = append(paths, path)
+	}
+	return paths
+}
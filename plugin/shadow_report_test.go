@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/diff"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestShadowReport(t *testing.T) {
+	r := NewShadowReport(20, 0.03)
+	method := "/SearchService/Search"
+	timestamp := []diff.Difference{{Path: "timestamp"}}
+	price := []diff.Difference{{Path: "items.0.price"}, {Path: "items.1.price"}}
+
+	// the secondary differs on the timestamp as well
+	for i := 0; i < 5; i++ {
+		assert.False(t, r.Add(method, "1", timestamp, timestamp))
+	}
+	// not noise in this call, but the secondary differs on it almost as often as the candidate
+	assert.False(t, r.Add(method, "2", timestamp, nil))
+	assert.True(t, r.Add(method, "3", append(price, timestamp...), timestamp))
+	assert.False(t, r.Add(method, "4", nil, nil))
+
+	reports := r.Snapshot()
+	assert.Len(t, reports, 1)
+	mr := reports[0]
+	assert.Equal(t, int64(8), mr.Requests)
+	assert.Equal(t, int64(1), mr.Mismatches)
+	assert.Equal(t, 0.125, mr.MismatchRate)
+	assert.Len(t, mr.Fields, 2)
+	assert.Equal(t, "items.*.price", mr.Fields[0].Path)
+	assert.Equal(t, int64(1), mr.Fields[0].Differences)
+	assert.False(t, mr.Fields[0].Noisy)
+	assert.Equal(t, []string{"3"}, mr.Fields[0].Samples)
+	assert.Equal(t, "timestamp", mr.Fields[1].Path)
+	assert.True(t, mr.Fields[1].Noisy)
+}
+
+func TestShadowOutputWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow-report.json")
+	o := &ShadowOutput{report: NewShadowReport(20, 0.03), reportFile: path}
+	o.report.Add("/SearchService/Search", "1", []diff.Difference{{Path: "price"}}, nil)
+	assert.Nil(t, o.WriteReport())
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"price"`)
+}
+
+func TestShadowReportWriteFileConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow-report.json")
+	r := NewShadowReport(20, 0.03)
+	r.Add("/SearchService/Search", "1", []diff.Difference{{Path: "price"}}, nil)
+
+	// the periodic write and the final one
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.WriteFile(path)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, json.Valid(data))
+}
@@ -20,9 +20,12 @@ type CodecSimple struct{}
 func (c CodecSimple) Marshal(msg *Message) ([]byte, error) {
 	buff := bytes.NewBuffer(make([]byte, 0))
 	// line 1
-	//{version} {uuid} {start-timestamp} {containResponse}
+	//{version} {uuid} {start-timestamp} {containResponse} [{peer}]
 	fmt.Fprintf(buff, "%d %s %d %d", msg.Meta.Version, msg.Meta.UUID,
 		msg.Meta.Timestamp, bool2Int(msg.Meta.ContainResponse))
+	if msg.Meta.Version >= VersionPeer && len(msg.Meta.Peer) > 0 {
+		fmt.Fprintf(buff, " %s", msg.Meta.Peer)
+	}
 	buff.Write([]byte{'\n'})
 	// line 2
 	// method
@@ -37,7 +40,7 @@ func (c CodecSimple) Marshal(msg *Message) ([]byte, error) {
 	buff.Write(data)
 	// line 4
 	// response (optional)
-	if msg.Meta.ContainResponse {
+	if msg.Meta.ContainResponse || msg.Replay != nil {
 		buff.Write([]byte{'\n'})
 		data, err = json.Marshal(msg.Response)
 		if err != nil {
@@ -45,6 +48,16 @@ func (c CodecSimple) Marshal(msg *Message) ([]byte, error) {
 		}
 		buff.Write(data)
 	}
+	// line 5
+	// replay result (optional)
+	if msg.Replay != nil {
+		buff.Write([]byte{'\n'})
+		data, err = json.Marshal(msg.Replay)
+		if err != nil {
+			return nil, err
+		}
+		buff.Write(data)
+	}
 
 	return buff.Bytes(), nil
 }
@@ -52,16 +65,27 @@ func (c CodecSimple) Marshal(msg *Message) ([]byte, error) {
 func (c CodecSimple) Unmarshal(data []byte, msg *Message) error {
 	var err error
 	lines := bytes.Split(data, []byte{'\n'})
+	// meta, method and request at least, e.g. the record is truncated
+	if len(lines) < 3 {
+		return consts.ErrProtocal
+	}
 	// line 1
 	line1 := string(lines[0])
 	strList := strings.Split(line1, " ")
-	if len(strList) != 4 {
+	if len(strList) != 4 && len(strList) != 5 {
 		return consts.ErrProtocal
 	}
 	msg.Meta.Version, err = strconv.Atoi(strList[0])
 	if err != nil {
 		return err
 	}
+	// peer is absent in the files written by the earlier versions
+	if len(strList) == 5 {
+		if msg.Meta.Version < VersionPeer {
+			return consts.ErrProtocal
+		}
+		msg.Meta.Peer = strList[4]
+	}
 
 	msg.Meta.UUID = strList[1]
 	tmp, err := strconv.Atoi(strList[2])
@@ -92,6 +116,13 @@ func (c CodecSimple) Unmarshal(data []byte, msg *Message) error {
 			return err
 		}
 	}
+	// line 5
+	if len(lines) >= 5 {
+		err = json.Unmarshal(lines[4], &msg.Replay)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/vearne/grpcreplay/consts"
 	"testing"
 	"time"
 )
@@ -46,6 +49,42 @@ func TestCodecSimple_MarshalUnmarshal(t *testing.T) {
 			wantErrMarshal:   false,
 			wantErrUnmarshal: false,
 		},
+		{
+			name: "message with peer",
+			msg: &Message{
+				Meta: Meta{
+					Version:   VersionPeer,
+					UUID:      "test-uuid-3",
+					Timestamp: time.Now().Unix(),
+					Peer:      "192.168.1.100:51234",
+				},
+				Method:  "/test.Method3",
+				Request: &MsgItem{Body: "request data 3"},
+			},
+			wantErrMarshal:   false,
+			wantErrUnmarshal: false,
+		},
+		{
+			name: "message with replay result",
+			msg: &Message{
+				Meta: Meta{
+					Version:   2,
+					UUID:      "test-uuid-4",
+					Timestamp: time.Now().Unix(),
+				},
+				Method:  "/test.Method4",
+				Request: &MsgItem{Body: "request data 4"},
+				Replay: &ReplayResult{
+					Target:   "127.0.0.1:35001",
+					Latency:  int64(3 * time.Millisecond),
+					Code:     5,
+					Message:  "not found",
+					Response: &MsgItem{Headers: map[string]string{"grpc-status": "5"}},
+				},
+			},
+			wantErrMarshal:   false,
+			wantErrUnmarshal: false,
+		},
 	}
 
 	codec := CodecSimple{}
@@ -75,6 +114,7 @@ func TestCodecSimple_MarshalUnmarshal(t *testing.T) {
 				tt.msg.Meta.UUID != got.Meta.UUID ||
 				tt.msg.Meta.Timestamp != got.Meta.Timestamp ||
 				tt.msg.Meta.ContainResponse != got.Meta.ContainResponse ||
+				tt.msg.Meta.Peer != got.Meta.Peer ||
 				tt.msg.Method != got.Method ||
 				tt.msg.Request.Body != got.Request.Body {
 				t.Errorf("Unmarshal() got = %+v, want %+v", got, tt.msg)
@@ -86,6 +126,48 @@ func TestCodecSimple_MarshalUnmarshal(t *testing.T) {
 					t.Errorf("Unmarshal() response got = %+v, want %+v", got.Response, tt.msg.Response)
 				}
 			}
+
+			if tt.msg.Replay != nil {
+				if got.Replay == nil ||
+					tt.msg.Replay.Latency != got.Replay.Latency ||
+					tt.msg.Replay.Code != got.Replay.Code ||
+					got.Replay.Response.Headers["grpc-status"] != "5" {
+					t.Errorf("Unmarshal() replay got = %+v, want %+v", got.Replay, tt.msg.Replay)
+				}
+			}
 		})
 	}
 }
+
+func TestCodecSimple_UnmarshalTruncated(t *testing.T) {
+	var c CodecSimple
+	for _, data := range []string{"", "2 uuid-1 0 0", "2 uuid-1 0 0\n/SearchService/Search"} {
+		var msg Message
+		if err := c.Unmarshal([]byte(data), &msg); !errors.Is(err, consts.ErrProtocal) {
+			t.Errorf("Unmarshal(%q) error = %v, want %v", data, err, consts.ErrProtocal)
+		}
+	}
+}
+
+func TestCodecSimple_PeerVersion(t *testing.T) {
+	var c CodecSimple
+	msg := &Message{Meta: Meta{Version: VersionPeer, UUID: "uuid-1", Peer: "192.168.1.100:51234"},
+		Method: "/SearchService/Search", Request: &MsgItem{Body: "{}"}}
+	data, err := c.Marshal(msg)
+	if err != nil || !bytes.HasPrefix(data, []byte("3 uuid-1 0 0 192.168.1.100:51234\n")) {
+		t.Errorf("Marshal() = %q, error = %v", data, err)
+	}
+
+	// the peer isn't written to the records of the earlier versions
+	msg.Meta.Version = VersionBasic
+	data, err = c.Marshal(msg)
+	if err != nil || !bytes.HasPrefix(data, []byte("2 uuid-1 0 0\n")) {
+		t.Errorf("Marshal() = %q, error = %v", data, err)
+	}
+
+	var got Message
+	data = []byte("2 uuid-1 0 0 192.168.1.100:51234\n/SearchService/Search\n{}")
+	if err := c.Unmarshal(data, &got); !errors.Is(err, consts.ErrProtocal) {
+		t.Errorf("Unmarshal(%q) error = %v, want %v", data, err, consts.ErrProtocal)
+	}
+}
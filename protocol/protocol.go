@@ -11,17 +11,46 @@ type Message struct {
 	Method   string   `json:"method"`
 	Request  *MsgItem `json:"request"`
 	Response *MsgItem `json:"response"`
+	// the result of replaying the request, Response is the recorded response
+	Replay *ReplayResult `json:"replay,omitempty"`
 }
 
+// the versions of the records
+const (
+	VersionBasic = 2
+	// the peer is added to line 1 of the simple codec,
+	// the earlier versions of grpcr reject these records
+	VersionPeer = 3
+)
+
 type Meta struct {
 	Version int    `json:"version"`
 	UUID    string `json:"uuid"`
 	// Nanosecond
 	Timestamp       int64 `json:"timestamp"`
 	ContainResponse bool  `json:"containResponse"`
+	// address of the client which sent the request, e.g. "192.168.1.100:51234",
+	// only kept by the simple codec if Version is VersionPeer or later
+	Peer string `json:"peer,omitempty"`
 }
 
 type MsgItem struct {
 	Headers map[string]string `json:"headers"`
 	Body    string            `json:"body"`
 }
+
+// ReplayResult is the outcome of sending a request to a target
+type ReplayResult struct {
+	Target string `json:"target"`
+	// Nanosecond, when the request was sent
+	Timestamp int64 `json:"timestamp"`
+	// Nanosecond
+	Latency int64 `json:"latency"`
+	// Nanosecond, the deadline of the call, 0 means no deadline
+	Timeout int64 `json:"timeout,omitempty"`
+	// gRPC status code and message
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	// the new response, nil if the call failed before a response was received
+	Response *MsgItem `json:"response"`
+}
@@ -0,0 +1,435 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ActionSet sets the field to Value, which is the JSON form of the field
+	ActionSet = "set"
+	// ActionDelete clears the field
+	ActionDelete = "delete"
+	// ActionMap replaces the values found in the mapping file, the others are left unchanged
+	ActionMap = "map"
+	// ActionShift moves a point in time by the time elapsed since the message was captured
+	ActionShift = "shift"
+)
+
+const timestampName = "google.protobuf.Timestamp"
+
+// Rule changes one field of the request body.
+//
+// Path is a list of field names separated by ".", both the proto names and the JSON names are accepted.
+// "*" matches all the elements of a repeated field or all the values of a map, e.g. "items.*.user_id".
+type Rule struct {
+	// regular expression of the methods the rule applies to, all methods if empty
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// set, delete, map or shift
+	Action string `json:"action"`
+	// for set
+	Value json.RawMessage `json:"value"`
+	// for map, a json object whose keys are the old values and values the new ones
+	MappingFile string `json:"mappingFile"`
+	// for shift on integer fields: s(default), ms, us or ns
+	Unit string `json:"unit"`
+
+	methodRegexp *regexp.Regexp
+	segments     []string
+	mapping      map[string]string
+	unit         time.Duration
+}
+
+// Transformer edits the request bodies according to the rules.
+// The bodies are decoded with the descriptors of the methods, so the values are checked against the field types.
+type Transformer struct {
+	rules  []*Rule
+	finder http2.PBFinder
+	now    func() time.Time
+}
+
+// LoadRules reads the rules from a json file containing an array of Rule
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("parse %v:%w", path, err)
+	}
+	return rules, nil
+}
+
+// NewTransformer checks the rules, the descriptors of the methods are obtained from finder
+func NewTransformer(rules []*Rule, finder http2.PBFinder) (*Transformer, error) {
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %v:%w", i, err)
+		}
+	}
+	return &Transformer{rules: rules, finder: finder, now: time.Now}, nil
+}
+
+func (rule *Rule) compile() error {
+	var err error
+	if len(rule.Method) > 0 {
+		rule.methodRegexp, err = regexp.Compile(rule.Method)
+		if err != nil {
+			return fmt.Errorf("method:%w", err)
+		}
+	}
+	if len(rule.Path) <= 0 {
+		return fmt.Errorf("path is empty")
+	}
+	rule.segments = strings.Split(rule.Path, ".")
+	if rule.segments[0] == "*" {
+		return fmt.Errorf("path %v doesn't start with a field", rule.Path)
+	}
+
+	switch rule.Action {
+	case ActionSet:
+		if len(rule.Value) <= 0 {
+			return fmt.Errorf("value is required by set")
+		}
+	case ActionDelete:
+		if rule.segments[len(rule.segments)-1] == "*" {
+			return fmt.Errorf("delete can't be applied to the elements of %v", rule.Path)
+		}
+	case ActionMap:
+		data, err := os.ReadFile(rule.MappingFile)
+		if err != nil {
+			return fmt.Errorf("mapping file:%w", err)
+		}
+		err = json.Unmarshal(data, &rule.mapping)
+		if err != nil {
+			return fmt.Errorf("parse mapping file %v:%w", rule.MappingFile, err)
+		}
+	case ActionShift:
+		units := map[string]time.Duration{"": time.Second, "s": time.Second,
+			"ms": time.Millisecond, "us": time.Microsecond, "ns": time.Nanosecond}
+		var ok bool
+		rule.unit, ok = units[rule.Unit]
+		if !ok {
+			return fmt.Errorf("unknown unit:%v", rule.Unit)
+		}
+	default:
+		return fmt.Errorf("unknown action:%v", rule.Action)
+	}
+	return nil
+}
+
+// Transform edits msg.Request.Body in place, the message is left untouched if no rule applies to it
+func (t *Transformer) Transform(msg *protocol.Message) error {
+	rules := make([]*Rule, 0, len(t.rules))
+	for _, rule := range t.rules {
+		if rule.methodRegexp == nil || rule.methodRegexp.MatchString(msg.Method) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) <= 0 || msg.Request == nil {
+		return nil
+	}
+
+	mio, err := t.finder.Get(msg.Method)
+	if err != nil {
+		return err
+	}
+	m := mio.InType.ProtoReflect()
+	err = protojson.Unmarshal([]byte(msg.Request.Body), mio.InType)
+	if err != nil {
+		return fmt.Errorf("decode request of %v:%w", msg.Method, err)
+	}
+
+	// Meta.Timestamp is the capture time in nanoseconds
+	elapsed := t.now().Sub(time.Unix(0, msg.Meta.Timestamp))
+	for _, rule := range rules {
+		a := &applier{rule: rule, elapsed: elapsed}
+		if err = a.apply(m, rule.segments); err != nil {
+			return fmt.Errorf("method:%v, path:%v, %w", msg.Method, rule.Path, err)
+		}
+	}
+
+	data, err := protojson.Marshal(mio.InType)
+	if err != nil {
+		return err
+	}
+	msg.Request.Body = string(data)
+	return nil
+}
+
+type applier struct {
+	rule    *Rule
+	elapsed time.Duration
+}
+
+func findField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if fd := md.Fields().ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	return md.Fields().ByJSONName(name)
+}
+
+func (a *applier) apply(m protoreflect.Message, segments []string) error {
+	fd := findField(m.Descriptor(), segments[0])
+	if fd == nil {
+		return fmt.Errorf("%v has no field %v", m.Descriptor().FullName(), segments[0])
+	}
+	rest := segments[1:]
+
+	if len(rest) <= 0 {
+		return a.applyField(m, fd)
+	}
+	if fd.IsList() || fd.IsMap() {
+		return a.applyElements(m, fd, rest)
+	}
+	if fd.Message() == nil {
+		return fmt.Errorf("%v is not a message", fd.Name())
+	}
+	if !m.Has(fd) && a.rule.Action != ActionSet {
+		return nil
+	}
+	return a.apply(m.Mutable(fd).Message(), rest)
+}
+
+// applyField applies the rule to the field as a whole
+func (a *applier) applyField(m protoreflect.Message, fd protoreflect.FieldDescriptor) error {
+	switch a.rule.Action {
+	case ActionSet:
+		v, err := parseValue(m.Descriptor(), fd, a.rule.Value, false)
+		if err != nil {
+			return err
+		}
+		m.Set(fd, v)
+		return nil
+	case ActionDelete:
+		m.Clear(fd)
+		return nil
+	}
+
+	if fd.IsList() || fd.IsMap() {
+		return a.applyElements(m, fd, []string{"*"})
+	}
+	if !m.Has(fd) {
+		return nil
+	}
+
+	var v protoreflect.Value
+	if fd.Message() != nil {
+		v = m.Mutable(fd)
+	} else {
+		v = m.Get(fd)
+	}
+	v, err := a.transformValue(m.Descriptor(), fd, v)
+	if err != nil {
+		return err
+	}
+	m.Set(fd, v)
+	return nil
+}
+
+// applyElements applies the rule to the elements of a repeated field or the values of a map,
+// selected by "*", an index or a key
+func (a *applier) applyElements(m protoreflect.Message, fd protoreflect.FieldDescriptor, segments []string) error {
+	if !m.Has(fd) {
+		return nil
+	}
+	selector, rest := segments[0], segments[1:]
+
+	visit := func(get func() protoreflect.Value, set func(protoreflect.Value)) error {
+		if len(rest) > 0 {
+			if fd.Message() == nil || (fd.IsMap() && fd.MapValue().Message() == nil) {
+				return fmt.Errorf("elements of %v are not messages", fd.Name())
+			}
+			return a.apply(get().Message(), rest)
+		}
+		var v protoreflect.Value
+		var err error
+		if a.rule.Action == ActionSet {
+			v, err = parseValue(m.Descriptor(), fd, a.rule.Value, true)
+		} else {
+			v, err = a.transformValue(m.Descriptor(), fd, get())
+		}
+		if err != nil {
+			return err
+		}
+		set(v)
+		return nil
+	}
+
+	if fd.IsList() {
+		list := m.Mutable(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			if selector != "*" && selector != strconv.Itoa(i) {
+				continue
+			}
+			idx := i
+			err := visit(func() protoreflect.Value { return list.Get(idx) },
+				func(v protoreflect.Value) { list.Set(idx, v) })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	mp := m.Mutable(fd).Map()
+	keys := make([]protoreflect.MapKey, 0, mp.Len())
+	mp.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		if selector == "*" || k.String() == selector {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	for _, k := range keys {
+		key := k
+		var get func() protoreflect.Value
+		if fd.MapValue().Message() != nil {
+			get = func() protoreflect.Value { return mp.Mutable(key) }
+		} else {
+			get = func() protoreflect.Value { return mp.Get(key) }
+		}
+		err := visit(get, func(v protoreflect.Value) { mp.Set(key, v) })
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformValue applies map or shift to a single value, fd may be a repeated field or a map
+func (a *applier) transformValue(parent protoreflect.MessageDescriptor, fd protoreflect.FieldDescriptor,
+	v protoreflect.Value) (protoreflect.Value, error) {
+	element := fd.IsList() || fd.IsMap()
+	kindFd := fd
+	if fd.IsMap() {
+		kindFd = fd.MapValue()
+	}
+
+	switch a.rule.Action {
+	case ActionMap:
+		key, err := valueString(kindFd, v)
+		if err != nil {
+			return v, err
+		}
+		replacement, ok := a.rule.mapping[key]
+		if !ok {
+			return v, nil
+		}
+		raw, _ := json.Marshal(replacement)
+		return parseValue(parent, fd, raw, element)
+	case ActionShift:
+		return a.shift(kindFd, v)
+	}
+	return v, fmt.Errorf("action %v can't be applied to a value", a.rule.Action)
+}
+
+func (a *applier) shift(fd protoreflect.FieldDescriptor, v protoreflect.Value) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		if fd.Message().FullName() != timestampName {
+			return v, fmt.Errorf("%v is not a %v", fd.Name(), timestampName)
+		}
+		m := v.Message()
+		secondsFd := m.Descriptor().Fields().ByName("seconds")
+		nanosFd := m.Descriptor().Fields().ByName("nanos")
+		t := time.Unix(m.Get(secondsFd).Int(), m.Get(nanosFd).Int()).Add(a.elapsed)
+		m.Set(secondsFd, protoreflect.ValueOfInt64(t.Unix()))
+		m.Set(nanosFd, protoreflect.ValueOfInt32(int32(t.Nanosecond())))
+		return v, nil
+	case protoreflect.StringKind:
+		if len(v.String()) <= 0 {
+			return v, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, v.String())
+		if err != nil {
+			return v, fmt.Errorf("%v is not a RFC3339 time:%w", fd.Name(), err)
+		}
+		return protoreflect.ValueOfString(t.Add(a.elapsed).Format(time.RFC3339Nano)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		if v.Int() == 0 {
+			return v, nil
+		}
+		return protoreflect.ValueOfInt64(v.Int() + int64(a.elapsed/a.rule.unit)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if v.Uint() == 0 {
+			return v, nil
+		}
+		return protoreflect.ValueOfUint64(uint64(int64(v.Uint()) + int64(a.elapsed/a.rule.unit))), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		if v.Int() == 0 {
+			return v, nil
+		}
+		return protoreflect.ValueOfInt32(int32(v.Int() + int64(a.elapsed/a.rule.unit))), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		if v.Uint() == 0 {
+			return v, nil
+		}
+		return protoreflect.ValueOfUint32(uint32(int64(v.Uint()) + int64(a.elapsed/a.rule.unit))), nil
+	}
+	return v, fmt.Errorf("shift can't be applied to %v of kind %v", fd.Name(), fd.Kind())
+}
+
+// valueString returns the key of the value in the mapping file
+func valueString(fd protoreflect.FieldDescriptor, v protoreflect.Value) (string, error) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind, protoreflect.BoolKind, protoreflect.BytesKind:
+		return "", fmt.Errorf("map can't be applied to %v of kind %v", fd.Name(), fd.Kind())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name()), nil
+		}
+		return strconv.Itoa(int(v.Enum())), nil
+	}
+	return v.String(), nil
+}
+
+// parseValue converts the JSON form of a value of fd into a protoreflect.Value, so it is checked against the field type.
+// If element is true, raw is an element of the repeated field or a value of the map.
+func parseValue(parent protoreflect.MessageDescriptor, fd protoreflect.FieldDescriptor,
+	raw json.RawMessage, element bool) (protoreflect.Value, error) {
+	data := string(raw)
+	if element {
+		switch {
+		case fd.IsList():
+			data = "[" + data + "]"
+		case fd.IsMap():
+			key := `"1"`
+			if fd.MapKey().Kind() == protoreflect.BoolKind {
+				key = `"true"`
+			}
+			data = "{" + key + ":" + data + "}"
+		}
+	}
+
+	// decoded as a field of the parent, protojson takes care of the well-known types, enums and so on
+	wrapper := dynamicpb.NewMessage(parent)
+	err := protojson.Unmarshal([]byte(`{"`+fd.JSONName()+`":`+data+`}`), wrapper)
+	if err != nil {
+		return protoreflect.Value{}, fmt.Errorf("invalid value %s for %v:%w", raw, fd.Name(), err)
+	}
+	v := wrapper.Get(fd)
+	if !element {
+		return v, nil
+	}
+	if fd.IsList() {
+		return v.List().Get(0), nil
+	}
+	v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+		v = mv
+		return false
+	})
+	return v, nil
+}
@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/grpcreplay/http2"
+	"github.com/vearne/grpcreplay/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTransform(t *testing.T) {
+	mappingFile := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(mappingFile, []byte(`{"u1":"staging-1","u2":"staging-2"}`), 0600)
+	assert.Nil(t, err)
+
+	rules := []*Rule{
+		{Path: "user_id", Action: ActionMap, MappingFile: mappingFile},
+		{Path: "items.*.userId", Action: ActionMap, MappingFile: mappingFile},
+		{Path: "items.*.expire_time", Action: ActionShift},
+		{Path: "create_time", Action: ActionShift, Unit: "ms"},
+		{Path: "labels.env", Action: ActionSet, Value: json.RawMessage(`"staging"`)},
+		{Path: "note", Action: ActionDelete},
+		{Method: "Create$", Path: "status", Action: ActionSet, Value: json.RawMessage(`"PAID"`)},
+		{Method: "Delete$", Path: "tags", Action: ActionSet, Value: json.RawMessage(`["x"]`)},
+	}
+	finder := http2.NewFilePBFinder([]string{"testdata/order.proto"}, ".")
+	transformer, err := NewTransformer(rules, finder)
+	assert.Nil(t, err)
+
+	captured := time.Date(2025, 4, 24, 10, 0, 0, 0, time.UTC)
+	transformer.now = func() time.Time { return captured.Add(48 * time.Hour) }
+
+	msg := &protocol.Message{
+		Meta:   protocol.Meta{Timestamp: captured.UnixNano()},
+		Method: "/OrderService/Create",
+		Request: &protocol.MsgItem{Body: `{"userId":"u1","items":[{"userId":"u2","expireTime":"2025-04-25T10:00:00Z"},` +
+			`{"userId":"u3"}],"labels":{"env":"prod"},"createTime":"1745488800000","note":"hello","tags":["a"]}`},
+	}
+	err = transformer.Transform(msg)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"userId":"staging-1","items":[{"userId":"staging-2","expireTime":"2025-04-27T10:00:00Z"},`+
+		`{"userId":"u3"}],"labels":{"env":"staging"},"createTime":"1745661600000","status":"PAID","tags":["a"]}`,
+		msg.Request.Body)
+
+	// the values are checked against the field types
+	transformer, err = NewTransformer([]*Rule{{Path: "create_time", Action: ActionSet,
+		Value: json.RawMessage(`"abc"`)}}, finder)
+	assert.Nil(t, err)
+	assert.NotNil(t, transformer.Transform(msg))
+
+	transformer, err = NewTransformer([]*Rule{{Path: "not_exist", Action: ActionDelete}}, finder)
+	assert.Nil(t, err)
+	assert.NotNil(t, transformer.Transform(msg))
+
+	_, err = NewTransformer([]*Rule{{Path: "note", Action: "rename"}}, finder)
+	assert.NotNil(t, err)
+}